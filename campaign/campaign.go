@@ -0,0 +1,442 @@
+package campaign
+
+import (
+	"cmp"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mrfgo/cl"
+	. "mrfgo/global"
+	"mrfgo/guid"
+	"mrfgo/sip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A campaign dials a list of numbers through call origination (sip.Originate), within a concurrency and a CPS limit.
+// Each answered call plays the prompts, "${name}" being replaced by the variables of the number, and optionally
+// collects a DTMF acknowledgement. Busy and unanswered calls are retried, the delay doubling at each attempt.
+
+const (
+	defaultConcurrency   = 10
+	defaultMaxAttempts   = 3
+	defaultRetryDelaySec = 60
+	idleWait             = 100 * time.Millisecond // between checks when no number is due or the CPS is reached
+)
+
+// Request describes a campaign - the numbers come from Numbers and/or CSV, whose header row names the number column
+// "number" and the variables columns
+type Request struct {
+	Name         string
+	Route        string
+	Prompts      []string
+	Peer         string
+	From         string
+	Username     string
+	Password     string
+	Concurrency  int
+	CPS          int // calls per second, no limit when 0
+	AckDigits    int // DTMF acknowledgement digits, none when 0
+	DigitTimeout int
+	RingTimeout  int
+	MaxAttempts  int
+	RetryDelay   int // seconds before the first retry
+	Numbers      []Target
+	CSV          string
+}
+
+type Target struct {
+	Number    string
+	Variables map[string]string
+}
+
+// Result of a number
+type Result struct {
+	Target
+	Status      string // pending, dialing, then answered, acknowledged, unacknowledged, busy, noanswer or failed
+	Attempts    int
+	SIPStatus   int
+	Reason      string
+	Digits      string
+	Duration    int
+	CallID      string
+	LastAttempt time.Time
+	nextAttempt time.Time
+	final       bool
+}
+
+const (
+	stPending        = "pending"
+	stDialing        = "dialing"
+	stAnswered       = "answered"
+	stAcknowledged   = "acknowledged"
+	stUnacknowledged = "unacknowledged"
+	stBusy           = "busy"
+	stNoAnswer       = "noanswer"
+	stFailed         = "failed"
+)
+
+// Progress summarizes a campaign
+type Progress struct {
+	ID        string
+	Name      string
+	State     string // running, paused, stopped or completed
+	Total     int
+	Completed int
+	InFlight  int
+	Counts    map[string]int
+	Created   time.Time
+	Ended     time.Time `json:",omitzero"`
+}
+
+type Campaign struct {
+	Request
+	ID      string
+	created time.Time
+
+	mu       sync.Mutex
+	results  []*Result
+	state    string
+	endedAt  time.Time
+	inFlight int
+	limiter  *cl.CallLimiter
+	wg       sync.WaitGroup
+	wake     chan struct{}
+	stop     chan struct{}
+}
+
+var (
+	campaigns   = make(map[string]*Campaign)
+	campaignsMu sync.Mutex
+)
+
+// New validates the request and starts dialing
+func New(req Request) (*Campaign, error) {
+	if req.Route == "" || len(req.Prompts) == 0 {
+		return nil, errors.New("route and prompts are mandatory")
+	}
+	if req.Concurrency < 0 || req.CPS < 0 || req.AckDigits < 0 || req.MaxAttempts < 0 || req.RetryDelay < 0 {
+		return nil, errors.New("negative value")
+	}
+	targets := slices.Clone(req.Numbers)
+	if req.CSV != "" {
+		parsed, err := parseCSV(req.CSV)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, parsed...)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no number")
+	}
+	c := &Campaign{Request: req, ID: guid.NewTag(), created: time.Now(), state: "running", wake: make(chan struct{}, 1), stop: make(chan struct{})}
+	c.Numbers, c.CSV = nil, ""
+	c.Concurrency = cmp.Or(c.Concurrency, defaultConcurrency)
+	c.MaxAttempts = cmp.Or(c.MaxAttempts, defaultMaxAttempts)
+	c.RetryDelay = cmp.Or(c.RetryDelay, defaultRetryDelaySec)
+	for _, t := range targets {
+		if t.Number = strings.TrimSpace(t.Number); t.Number == "" {
+			return nil, errors.New("empty number")
+		}
+		c.results = append(c.results, &Result{Target: t, Status: stPending})
+	}
+	rate := c.CPS
+	if rate == 0 {
+		rate = -1
+	}
+	c.limiter = cl.NewCallLimiter(rate, nil, &c.wg)
+
+	campaignsMu.Lock()
+	campaigns[c.ID] = c
+	campaignsMu.Unlock()
+	LogInfo(LTSystem, fmt.Sprintf("Campaign [%s] (%s) started - %d numbers", c.ID, c.Name, len(c.results)))
+	go c.run()
+	return c, nil
+}
+
+func Get(id string) (*Campaign, bool) {
+	campaignsMu.Lock()
+	defer campaignsMu.Unlock()
+	c, ok := campaigns[id]
+	return c, ok
+}
+
+// List returns the progress of all campaigns, oldest first
+func List() []Progress {
+	campaignsMu.Lock()
+	lst := slices.Collect(maps.Values(campaigns))
+	campaignsMu.Unlock()
+	slices.SortFunc(lst, func(a, b *Campaign) int { return a.created.Compare(b.created) })
+	progress := make([]Progress, 0, len(lst))
+	for _, c := range lst {
+		progress = append(progress, c.Progress())
+	}
+	return progress
+}
+
+// Delete stops a campaign and forgets it
+func Delete(id string) bool {
+	campaignsMu.Lock()
+	c, ok := campaigns[id]
+	delete(campaigns, id)
+	campaignsMu.Unlock()
+	if ok {
+		c.Stop()
+	}
+	return ok
+}
+
+// parseCSV reads the numbers and their variables, the header row naming the columns
+func parseCSV(text string) ([]Target, error) {
+	r := csv.NewReader(strings.NewReader(text))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header - %v", err)
+	}
+	col := slices.IndexFunc(header, func(h string) bool { return strings.EqualFold(strings.TrimSpace(h), "number") })
+	if col < 0 {
+		return nil, errors.New("no number column in CSV")
+	}
+	var targets []Target
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return targets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV - %v", err)
+		}
+		t := Target{Number: rec[col], Variables: make(map[string]string)}
+		for i, name := range header {
+			if i != col {
+				t.Variables[strings.TrimSpace(name)] = rec[i]
+			}
+		}
+		targets = append(targets, t)
+	}
+}
+
+// run dials the due numbers until all are done or the campaign is stopped
+func (c *Campaign) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			LogCallStack(r)
+		}
+	}()
+	defer c.limiter.Stop()
+	for {
+		res, done := c.next()
+		switch {
+		case done:
+			c.finish("completed")
+			return
+		case res != nil && c.limiter.AcceptNewCall():
+			c.dial(res)
+			continue
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-c.wake:
+		case <-time.After(idleWait):
+		}
+	}
+}
+
+// next returns a number due for an attempt when a call slot is free, and whether all numbers are done
+func (c *Campaign) next() (*Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != "running" {
+		return nil, false
+	}
+	if !slices.ContainsFunc(c.results, func(r *Result) bool { return !r.final }) {
+		return nil, true
+	}
+	if c.inFlight >= c.Concurrency {
+		return nil, false
+	}
+	now := time.Now()
+	for _, res := range c.results {
+		if res.Status == stPending && !res.nextAttempt.After(now) {
+			return res, false
+		}
+	}
+	return nil, false
+}
+
+// dial places a call to the number
+func (c *Campaign) dial(res *Result) {
+	c.mu.Lock()
+	res.Status = stDialing
+	res.Attempts++
+	res.LastAttempt = time.Now()
+	res.SIPStatus, res.Reason, res.Digits, res.Duration = 0, "", "", 0
+	c.inFlight++
+	prompts := make([]string, len(c.Prompts))
+	for i, prompt := range c.Prompts {
+		prompts[i] = os.Expand(prompt, func(name string) string { return res.Variables[name] })
+	}
+	c.mu.Unlock()
+
+	_, err := sip.Originate(sip.OriginationRequest{
+		To:           res.Number,
+		Peer:         c.Peer,
+		From:         c.From,
+		Route:        c.Route,
+		Prompts:      prompts,
+		Digits:       c.AckDigits,
+		DigitTimeout: c.DigitTimeout,
+		RingTimeout:  c.RingTimeout,
+		Username:     c.Username,
+		Password:     c.Password,
+	}, func(ev sip.OriginationEvent) {
+		switch ev.Event {
+		case "trying":
+			c.mu.Lock()
+			res.CallID = ev.CallID
+			c.mu.Unlock()
+		case "ended":
+			c.ended(res, ev)
+		}
+	})
+	if err != nil {
+		c.ended(res, sip.OriginationEvent{Reason: err.Error()})
+	}
+}
+
+// ended records the outcome of an attempt, scheduling a retry for busy and unanswered calls
+func (c *Campaign) ended(res *Result, ev sip.OriginationEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	res.SIPStatus, res.Reason, res.Digits, res.Duration = ev.Status, ev.Reason, ev.Digits, ev.Duration
+	res.final = true
+	switch {
+	case ev.Answered && c.AckDigits == 0:
+		res.Status = stAnswered
+	case ev.Answered && ev.Digits != "":
+		res.Status = stAcknowledged
+	case ev.Answered:
+		res.Status = stUnacknowledged
+	case ev.Status == 486 || ev.Status == 600:
+		res.Status = stBusy
+	case ev.Status == 480 || ev.Status == 408 || ev.Status == 487 || (ev.CallID != "" && ev.Status == 0):
+		res.Status = stNoAnswer
+	default:
+		res.Status = stFailed
+	}
+	if (res.Status == stBusy || res.Status == stNoAnswer) && res.Attempts < c.MaxAttempts && c.state != "stopped" {
+		res.final = false
+		res.nextAttempt = time.Now().Add(time.Duration(c.RetryDelay<<(res.Attempts-1)) * time.Second)
+		res.Reason = fmt.Sprintf("%s - retry at %s", cmp.Or(res.Reason, res.Status), res.nextAttempt.Format(time.TimeOnly))
+		res.Status = stPending
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pause suspends the dialing, the calls in progress go on
+func (c *Campaign) Pause() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != "running" {
+		return false
+	}
+	c.state = "paused"
+	return true
+}
+
+func (c *Campaign) Resume() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != "paused" {
+		return false
+	}
+	c.state = "running"
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Stop ends the dialing - the numbers not dialed yet stay pending, the calls in progress go on
+func (c *Campaign) Stop() bool {
+	return c.finish("stopped")
+}
+
+func (c *Campaign) finish(state string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == "stopped" || c.state == "completed" {
+		return false
+	}
+	c.state, c.endedAt = state, time.Now()
+	if state == "stopped" {
+		close(c.stop)
+	}
+	LogInfo(LTSystem, fmt.Sprintf("Campaign [%s] (%s) %s", c.ID, c.Name, state))
+	return true
+}
+
+func (c *Campaign) Progress() Progress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := Progress{ID: c.ID, Name: c.Name, State: c.state, Total: len(c.results), InFlight: c.inFlight, Counts: make(map[string]int), Created: c.created, Ended: c.endedAt}
+	for _, res := range c.results {
+		p.Counts[res.Status]++
+		if res.final {
+			p.Completed++
+		}
+	}
+	return p
+}
+
+// Results returns a copy of the per-number results
+func (c *Campaign) Results() []Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := make([]Result, len(c.results))
+	for i, res := range c.results {
+		results[i] = *res
+	}
+	return results
+}
+
+// WriteCSV exports the results, with a column per variable
+func (c *Campaign) WriteCSV(w io.Writer) error {
+	results := c.Results()
+	var names []string
+	for _, res := range results {
+		for name := range res.Variables {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	cw := csv.NewWriter(w)
+	_ = cw.Write(append([]string{"number", "status", "attempts", "sip_status", "reason", "digits", "duration", "call_id", "last_attempt"}, names...))
+	for _, res := range results {
+		var last string
+		if !res.LastAttempt.IsZero() {
+			last = res.LastAttempt.Format(time.RFC3339)
+		}
+		rec := []string{res.Number, res.Status, fmt.Sprint(res.Attempts), fmt.Sprint(res.SIPStatus), res.Reason, res.Digits, fmt.Sprint(res.Duration), res.CallID, last}
+		for _, name := range names {
+			rec = append(rec, res.Variables[name])
+		}
+		_ = cw.Write(rec)
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -7,16 +7,20 @@ import (
 )
 
 type CallLimiter struct {
-	rate      int          // rate limiter
-	ticker    *time.Ticker // ticker for timing
-	callCount int          // current call count
-	mu        sync.Mutex   // mutex for thread safety
+	rate      int           // rate limiter
+	ticker    *time.Ticker  // ticker for timing
+	callCount int           // current call count
+	mu        sync.Mutex    // mutex for thread safety
+	done      chan struct{} // closed by Stop
 }
 
+// NewCallLimiter accepts up to rate calls per second, -1 for no limit - the count of each second is reported
+// to pm when not nil
 func NewCallLimiter(rate int, pm *prometheus.Metrics, wg *sync.WaitGroup) *CallLimiter {
 	cl := &CallLimiter{
 		rate:   rate,
 		ticker: time.NewTicker(time.Second),
+		done:   make(chan struct{}),
 	}
 	wg.Add(1)
 	go cl.resetCount(pm, wg)
@@ -25,9 +29,16 @@ func NewCallLimiter(rate int, pm *prometheus.Metrics, wg *sync.WaitGroup) *CallL
 
 func (clmtr *CallLimiter) resetCount(pm *prometheus.Metrics, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for range clmtr.ticker.C {
+	for {
+		select {
+		case <-clmtr.done:
+			return
+		case <-clmtr.ticker.C:
+		}
 		clmtr.mu.Lock()
-		pm.Caps.Set(float64(clmtr.callCount))
+		if pm != nil {
+			pm.Caps.Set(float64(clmtr.callCount))
+		}
 		clmtr.callCount = 0
 		clmtr.mu.Unlock()
 	}
@@ -42,3 +53,9 @@ func (clmtr *CallLimiter) AcceptNewCall() bool {
 	}
 	return false // Rate limit exceeded
 }
+
+// Stop ends the counting, for limiters not living as long as the process
+func (clmtr *CallLimiter) Stop() {
+	clmtr.ticker.Stop()
+	close(clmtr.done)
+}
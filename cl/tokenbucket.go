@@ -0,0 +1,114 @@
+package cl
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket accepts calls at rate per second on average, with bursts up to burst calls
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return newTokenBucket(rate, burst, time.Now())
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *TokenBucket {
+	burst = max(burst, 1)
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (tb *TokenBucket) AcceptNewCall() bool {
+	return tb.accept(time.Now())
+}
+
+func (tb *TokenBucket) accept(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// full returns whether the bucket has refilled completely, i.e. it is idle
+func (tb *TokenBucket) full(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.tokens+now.Sub(tb.last).Seconds()*tb.rate >= tb.burst
+}
+
+// SourceLimiter holds a token bucket per source, those refilled being discarded every minute
+type SourceLimiter struct {
+	rate    float64
+	burst   int
+	buckets map[string]*TokenBucket
+	mu      sync.Mutex
+	done    chan struct{}
+}
+
+func NewSourceLimiter(rate float64, burst int, wg *sync.WaitGroup) *SourceLimiter {
+	sl := &SourceLimiter{rate: rate, burst: burst, buckets: make(map[string]*TokenBucket), done: make(chan struct{})}
+	wg.Add(1)
+	go sl.prune(wg)
+	return sl
+}
+
+func (sl *SourceLimiter) prune(wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sl.done:
+			return
+		case now := <-ticker.C:
+			sl.pruneIdle(now)
+		}
+	}
+}
+
+func (sl *SourceLimiter) pruneIdle(now time.Time) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	for src, tb := range sl.buckets {
+		if tb.full(now) {
+			delete(sl.buckets, src)
+		}
+	}
+}
+
+func (sl *SourceLimiter) AcceptNewCall(src string) bool {
+	return sl.accept(src, time.Now())
+}
+
+func (sl *SourceLimiter) accept(src string, now time.Time) bool {
+	sl.mu.Lock()
+	tb, ok := sl.buckets[src]
+	if !ok {
+		tb = newTokenBucket(sl.rate, sl.burst, now)
+		sl.buckets[src] = tb
+	}
+	sl.mu.Unlock()
+	return tb.accept(now)
+}
+
+// Reset discards the bucket of a source, its next call starting a full one
+func (sl *SourceLimiter) Reset(src string) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	delete(sl.buckets, src)
+}
+
+// Stop ends the pruning, for limiters not living as long as the process
+func (sl *SourceLimiter) Stop() {
+	close(sl.done)
+}
@@ -0,0 +1,72 @@
+package cl
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t0 := time.Now()
+	type step struct {
+		at       time.Duration // since the bucket creation
+		calls    int
+		accepted int
+	}
+	for _, tc := range []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{"burst then rate", 10, 5, []step{{0, 7, 5}, {100 * time.Millisecond, 2, 1}, {250 * time.Millisecond, 3, 1}, {10 * time.Second, 10, 5}}},
+		{"burst of at least 1", 2, 0, []step{{0, 3, 1}, {400 * time.Millisecond, 1, 0}, {600 * time.Millisecond, 1, 1}}},
+		{"rate below 1", 0.5, 1, []step{{0, 1, 1}, {time.Second, 1, 0}, {2 * time.Second, 1, 1}}},
+	} {
+		tb := newTokenBucket(tc.rate, tc.burst, t0)
+		for _, st := range tc.steps {
+			accepted := 0
+			for range st.calls {
+				if tb.accept(t0.Add(st.at)) {
+					accepted++
+				}
+			}
+			if accepted != st.accepted {
+				t.Errorf("%s: at %s, %d calls accepted, want %d", tc.name, st.at, accepted, st.accepted)
+			}
+		}
+	}
+}
+
+func TestSourceLimiter(t *testing.T) {
+	var wg sync.WaitGroup
+	sl := NewSourceLimiter(1, 2, &wg)
+	defer wg.Wait()
+	defer sl.Stop()
+
+	t0 := time.Now()
+	for i, tc := range []struct {
+		src  string
+		want bool
+	}{
+		{"10.0.0.1", true}, {"10.0.0.1", true}, {"10.0.0.1", false},
+		{"10.0.0.2", true}, {"10.0.0.2", true}, // a bucket per source
+	} {
+		if got := sl.accept(tc.src, t0); got != tc.want {
+			t.Errorf("call %d from %s accepted = %v, want %v", i, tc.src, got, tc.want)
+		}
+	}
+	sl.Reset("10.0.0.1")
+	if !sl.accept("10.0.0.1", t0) {
+		t.Errorf("call after Reset refused")
+	}
+
+	// one token left for 10.0.0.1, none for 10.0.0.2: only the first one is refilled after 1 s
+	sl.pruneIdle(t0.Add(time.Second))
+	if _, ok := sl.buckets["10.0.0.1"]; ok {
+		t.Errorf("refilled bucket of 10.0.0.1 kept")
+	}
+	if _, ok := sl.buckets["10.0.0.2"]; !ok {
+		t.Errorf("bucket of 10.0.0.2 pruned before refilling")
+	}
+}
@@ -170,6 +170,8 @@ const (
 	FQDNPort
 	TransportProtocol
 	ViaIPv4Socket
+	ViaRport
+	ViaReceived
 	IP6
 	IP4
 	HeaderParameter
@@ -283,6 +285,9 @@ const (
 	RouteBlackhole
 	ExceededCallRate
 	UnknownEndPoint
+	AccessDenied
+	Overloaded
+	Banned
 )
 
 // ==============================================================
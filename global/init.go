@@ -12,9 +12,8 @@ func InitializeEngine() {
 
 	BufferPool = newSyncPool(BufferSize, BufferSize)
 
-	rtpsz := RTPHeaderSize + RTPPayloadSize
-	RTPRXBufferPool = newSyncPool(rtpsz, rtpsz)
-	RTPTXBufferPool = newSyncPool(0, rtpsz)
+	RTPRXBufferPool = newSyncPool(RTPBufferSize, RTPBufferSize)
+	RTPTXBufferPool = newSyncPool(0, RTPBufferSize)
 
 	IsSystemBigEndian = checkSystemIndian()
 	rtp.InitializeTX()
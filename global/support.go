@@ -80,9 +80,21 @@ func AreUAddrsEqual(addr1, addr2 *net.UDPAddr) bool {
 
 // ============================================================
 
-func GenerateViaWithoutBranch(conn *net.UDPConn) string {
-	udpsocket := GetUDPAddrFromConn(conn)
-	return fmt.Sprintf("SIP/2.0/UDP %s", udpsocket)
+func GenerateViaWithoutBranch(skt *net.UDPAddr) string {
+	return fmt.Sprintf("SIP/2.0/UDP %s", skt)
+}
+
+// ParseIPv4List parses comma separated IPv4 addresses
+func ParseIPv4List(s string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, text := range strings.Split(s, ",") {
+		ip := net.ParseIP(strings.TrimSpace(text)).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 [%s]", strings.TrimSpace(text))
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
 }
 
 func GenerateContact(skt *net.UDPAddr) string {
@@ -21,8 +21,7 @@ const (
 
 	RTPHeaderSize  int = 12
 	RTPPayloadSize int = 160
-	MediaStartPort int = 7001
-	MediaEndPort   int = 57000
+	RTPBufferSize  int = 1500 // large enough for any payload and SRTP authentication tag
 
 	PacketizationTime int = 20    // ms
 	PayloadSize       int = 160   // bytes
@@ -31,6 +30,7 @@ const (
 	DTMFPacketsCount  int = 3
 	RTPHeadersSize    int = 12 //bytes
 	AnswerDelay           = 20 //ms
+	RTCPIntervalSec   int = 5
 
 	T1Timer              int    = 500
 	ReTXCount            int    = 5
@@ -38,7 +38,7 @@ const (
 	SipVersion           string = "SIP/2.0"
 	DeltaRune            rune   = 'a' - 'A'
 	MagicCookie          string = "z9hG4bK"
-	AllowedMethods       string = "INVITE, PRACK, ACK, CANCEL, BYE, OPTIONS, UPDATE, INFO, NOTIFY, MESSAGE"
+	AllowedMethods       string = "INVITE, PRACK, ACK, CANCEL, BYE, OPTIONS, UPDATE, INFO"
 	SessionDropDelaySec  int    = 4
 	InDialogueProbingSec int    = 300
 	MaxCallDurationSec   int    = 7200
@@ -49,11 +49,42 @@ var (
 	ServerIPv4        net.IP
 	SipUdpPort        int //TODO add a list of listening UDP ports if needed later, for now, it is a single port
 	HttpTcpPort       int
-	RateLimit         int = -1 //TODO 2000 || 0 = switched off, -1 = unlimited, > 0 = limited
 	IsSystemBigEndian bool
 
 	MediaPath string
 
+	SIPAdvertisedIPv4 net.IP // put in Via, Contact and From instead of ServerIPv4 when set (e.g. public address of a NATed host)
+
+	MediaStartPort         int = 7000  // first port of the media range - RTP on even ports, RTCP on the next odd ones
+	MediaEndPort           int = 57000 // last port of the media range
+	MediaPortQuarantineSec int = 5     // delay before a released port pair is reused, so late packets do not reach new calls
+
+	MediaBindIPv4s       []net.IP          // media bind addresses, ServerIPv4 when empty
+	MediaAdvertisedIPv4s []net.IP          // addresses put in the SDP instead of the bind ones - a single one, or one per bind address
+	MediaRealmsConfig    map[string]string // additional media realms per name: bind, advertised addresses and source networks
+	MediaRealmRoutes     map[string]string // media realm per route (MRF repository), overrides the source network selection
+
+	RTPTimeoutSec     int // release after no RTP for that long, 0 to disable
+	RTPHoldTimeoutSec int // same while the remote sends no RTP (sendonly/recvonly/inactive), 0 to disable
+
+	CodecPolicyGlobal  string            // codec preference applied to all routes
+	CodecPolicyRoutes  map[string]string // codec preference per route (MRF repository), overrides the global one
+	SRTPPolicyGlobal   string            // SRTP policy applied to all routes
+	SRTPPolicyRoutes   map[string]string // SRTP policy per route (MRF repository), overrides the global one
+	RTPLatchingGlobal  string            // symmetric RTP latching applied to all routes
+	RTPLatchingRoutes  map[string]string // symmetric RTP latching per route (MRF repository), overrides the global one
+	SIPNATPolicyGlobal string            // where responses and in-dialogue requests are sent (RFC 3581)
+	EarlyMediaGlobal   string            // announcement before answer applied to all routes
+	EarlyMediaRoutes   map[string]string // announcement before answer per route (MRF repository), overrides the global one
+	SessionTimerGlobal string            // session timer policy applied to all routes (RFC 4028)
+	SessionTimerRoutes map[string]string // session timer policy per route (MRF repository), overrides the global one
+	RegisterAccounts   map[string]string // accounts registered with a registrar per name: AOR, credentials, expiry, outbound proxy and route
+	TrustedPeersConfig map[string]string // trusted peers per name: networks, CPS and concurrent calls limits
+	SIPAuthGlobal      string            // digest authentication of the INVITEs from untrusted sources: users, realm and challenge
+	OverloadGlobal     string            // overload control of the inbound calls: call rates, concurrent calls, queue and CPU thresholds
+	ScannerProtect     string            // scanner and flood protection: User-Agent blocklist, request rate per source, ban and drop mode
+	APIToken           string            // bearer token of the API calls, campaigns and bans management, disabled without it
+
 	BufferPool      *sync.Pool
 	RTPRXBufferPool *sync.Pool
 	RTPTXBufferPool *sync.Pool
@@ -151,6 +182,8 @@ var (
 		FQDNPort:                   regexp.MustCompile(`(?i)(?:sip|sips|tel):(?:[^@]+@)?([\w\-\.]+)(?::(\d+))?;?`),
 		TransportProtocol:          regexp.MustCompile(`(?i)transport\s*=\s*(\w+)`),
 		ViaIPv4Socket:              regexp.MustCompile(`(?i)\s*SIP/2\.0\/(\w+)\s+((?:\d{1,3}\.){3}\d{1,3})(:\d+)?\s*`),
+		ViaRport:                   regexp.MustCompile(`(?i);\s*rport\b(?:\s*=\s*\d*)?`),
+		ViaReceived:                regexp.MustCompile(`(?i);\s*received\s*=\s*[^;,\s]+`),
 		IP6:                        regexp.MustCompile(`(?i)((?:(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){6})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:::(?:(?:(?:[0-9a-f]{1,4})):){5})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:[0-9a-f]{1,4})))?::(?:(?:(?:[0-9a-f]{1,4})):){4})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,1}(?:(?:[0-9a-f]{1,4})))?::(?:(?:(?:[0-9a-f]{1,4})):){3})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,2}(?:(?:[0-9a-f]{1,4})))?::(?:(?:(?:[0-9a-f]{1,4})):){2})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,3}(?:(?:[0-9a-f]{1,4})))?::(?:(?:[0-9a-f]{1,4})):)(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,4}(?:(?:[0-9a-f]{1,4})))?::)(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,5}(?:(?:[0-9a-f]{1,4})))?::)(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,6}(?:(?:[0-9a-f]{1,4})))?::)))))\s*$`),
 		IP4:                        regexp.MustCompile(`(?i)((?:(?:2(?:5[0-5]|[0-4]\d)|1?\d?\d)\.){3}(?:2(?:5[0-5]|[0-4]\d)|1?\d?\d))\s*$`),
 		HeaderParameter:            regexp.MustCompile(`(?i);([^=]+)=([^=;]+)`),
@@ -165,7 +198,7 @@ var (
 		ErrorStack:                 regexp.MustCompile(`(?i)(\w+\.vb):line\s(\d+)`),
 		SDPALineReMapping:          regexp.MustCompile(`(?i)^(a=\w+\s*:\s*)(?:\d+)(.+)`),
 		SDPPTDefinition:            regexp.MustCompile(`(?i)^a=rtpmap\s*:\s*\d+\s(.+)`),
-		CodecPolicy:                regexp.MustCompile(`(?i)(([0-9]|[1-9][0-9]|1[01][0-9]|12[0-7])|\*)`),
+		CodecPolicy:                regexp.MustCompile(`(?i)^(!)?(pcmu|pcma|g722|g729|opus|[0-9]|[1-9][0-9]|1[01][0-9]|12[0-7]|\*)$`),
 		ObjectName:                 regexp.MustCompile(`(?i)^\[.+?\]$`),
 		SignalDTMF:                 regexp.MustCompile(`(?i)^\s*Signal\s*=\s*([^\r\n]+)$`),
 		DurationDTMF:               regexp.MustCompile(`(?i)^\s*Duration\s*=\s*([^\r\n]+)$`),
@@ -256,7 +289,7 @@ var (
 		NOTIFY:    append(RequestHeaderCHs, "Event", "Subscription-State", "Subscription-Expires"),
 		UPDATE:    append(RequestHeaderCHs, "Require", "Session-Expires", "Min-SE"),
 		INFO:      RequestHeaderCHs,
-		REGISTER:  RequestHeaderCHs,
+		REGISTER:  append(RequestHeaderCHs, "Expires", "Authorization", "Proxy-Authorization"),
 		SUBSCRIBE: RequestHeaderCHs,
 		MESSAGE:   RequestHeaderCHs,
 	}
@@ -0,0 +1,174 @@
+// Package ice implements the ICE-lite side of connectivity checks: STUN binding requests are
+// authenticated with the local credentials and answered from the media socket (RFC 8445, RFC 5389)
+package ice
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"strings"
+)
+
+const (
+	headerSize  = 20
+	magicCookie = 0x2112A442
+	fingerprint = 0x5354554E
+
+	typeBindingRequest uint16 = 0x0001
+	typeBindingSuccess uint16 = 0x0101
+
+	attrUsername         uint16 = 0x0006
+	attrMessageIntegrity uint16 = 0x0008
+	attrXORMappedAddress uint16 = 0x0020
+	attrUseCandidate     uint16 = 0x0025
+	attrFingerprint      uint16 = 0x8028
+
+	integritySize   = 20
+	fingerprintSize = 4
+
+	ufragLen = 8
+	pwdLen   = 24
+
+	credentialChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/"
+)
+
+var (
+	errNotBinding = errors.New("not a STUN binding request")
+	errMalformed  = errors.New("malformed STUN message")
+	errUsername   = errors.New("STUN username mismatch")
+	errIntegrity  = errors.New("STUN message integrity check failed")
+)
+
+type BindingRequest struct {
+	TransactionID [12]byte
+	Username      string
+	UseCandidate  bool
+}
+
+// NewCredentials returns random ice-ufrag and ice-pwd values
+func NewCredentials() (ufrag, pwd string, err error) {
+	if ufrag, err = randomString(ufragLen); err != nil {
+		return
+	}
+	pwd, err = randomString(pwdLen)
+	return
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = credentialChars[int(b[i])%len(credentialChars)]
+	}
+	return string(b), nil
+}
+
+// IsSTUN tells STUN from DTLS and RTP/RTCP on a shared media socket (RFC 7983)
+func IsSTUN(b []byte) bool {
+	return len(b) >= headerSize && b[0] < 4 && binary.BigEndian.Uint32(b[4:8]) == magicCookie
+}
+
+// ParseBindingRequest parses a binding request addressed to the local ufrag and checks its integrity with the local password
+func ParseBindingRequest(b []byte, localUfrag, localPwd string) (*BindingRequest, error) {
+	if !IsSTUN(b) || binary.BigEndian.Uint16(b[0:2]) != typeBindingRequest {
+		return nil, errNotBinding
+	}
+	if int(binary.BigEndian.Uint16(b[2:4]))+headerSize != len(b) {
+		return nil, errMalformed
+	}
+	req := &BindingRequest{}
+	copy(req.TransactionID[:], b[8:20])
+	integrityChecked := false
+	for offset := headerSize; offset+4 <= len(b); {
+		typ := binary.BigEndian.Uint16(b[offset : offset+2])
+		size := int(binary.BigEndian.Uint16(b[offset+2 : offset+4]))
+		value := offset + 4
+		if value+size > len(b) {
+			return nil, errMalformed
+		}
+		switch typ {
+		case attrUsername:
+			req.Username = string(b[value : value+size])
+		case attrUseCandidate:
+			req.UseCandidate = true
+		case attrMessageIntegrity:
+			if size != integritySize {
+				return nil, errMalformed
+			}
+			if !hmac.Equal(messageIntegrity(b[:offset], localPwd), b[value:value+size]) {
+				return nil, errIntegrity
+			}
+			integrityChecked = true
+		}
+		if integrityChecked {
+			break // attributes after MESSAGE-INTEGRITY are not covered, only FINGERPRINT may follow
+		}
+		offset = value + (size+3)&^3
+	}
+	if !integrityChecked {
+		return nil, errIntegrity
+	}
+	if !strings.HasPrefix(req.Username, localUfrag+":") {
+		return nil, errUsername
+	}
+	return req, nil
+}
+
+// BindingSuccess builds the binding success response carrying the source address of the request
+func BindingSuccess(txid [12]byte, addr *net.UDPAddr, localPwd string) []byte {
+	msg := make([]byte, headerSize, 80)
+	binary.BigEndian.PutUint16(msg[0:2], typeBindingSuccess)
+	binary.BigEndian.PutUint32(msg[4:8], magicCookie)
+	copy(msg[8:20], txid[:])
+
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+	xaddr := make([]byte, 4+len(ip))
+	xaddr[1] = family
+	binary.BigEndian.PutUint16(xaddr[2:4], uint16(addr.Port)^uint16(magicCookie>>16))
+	key := msg[4:20]
+	for i := range ip {
+		xaddr[4+i] = ip[i] ^ key[i]
+	}
+	msg = appendAttr(msg, attrXORMappedAddress, xaddr)
+
+	msg = appendAttr(msg, attrMessageIntegrity, make([]byte, integritySize))
+	copy(msg[len(msg)-integritySize:], messageIntegrity(msg[:len(msg)-integritySize-4], localPwd))
+
+	msg = appendAttr(msg, attrFingerprint, make([]byte, fingerprintSize))
+	binary.BigEndian.PutUint32(msg[len(msg)-fingerprintSize:], crc32.ChecksumIEEE(msg[:len(msg)-fingerprintSize-4])^fingerprint)
+	return msg
+}
+
+func appendAttr(msg []byte, typ uint16, value []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)))
+	msg = append(msg, value...)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-headerSize))
+	return msg
+}
+
+// messageIntegrity computes the HMAC-SHA1 over the message preceding the MESSAGE-INTEGRITY attribute,
+// with the header length adjusted to end right after that attribute
+func messageIntegrity(preceding []byte, pwd string) []byte {
+	hdr := make([]byte, headerSize)
+	copy(hdr, preceding[:headerSize])
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(preceding)-headerSize+4+integritySize))
+	mac := hmac.New(sha1.New, []byte(pwd))
+	mac.Write(hdr)
+	mac.Write(preceding[headerSize:])
+	return mac.Sum(nil)
+}
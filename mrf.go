@@ -8,6 +8,7 @@ import (
 	"mrfgo/webserver"
 	"net"
 	"os"
+	"strings"
 )
 
 // environment variables
@@ -17,8 +18,35 @@ const (
 	OwnIPv4       string = "server_ipv4"
 	OwnSIPUdpPort string = "sip_udp_port"
 	//nolint:stylecheck
-	OwnHttpPort    string = "http_port"
-	MediaDirectory string = "media_dir"
+	OwnHttpPort      string = "http_port"
+	MediaDirectory   string = "media_dir"
+	CodecPolicy      string = "codec_policy"
+	RouteCodecPolicy string = "codec_policy_" // suffixed with the route (MRF repository) name
+	SRTPPolicy       string = "srtp_policy"
+	RouteSRTPPolicy  string = "srtp_policy_" // suffixed with the route (MRF repository) name
+	RTPLatching      string = "rtp_latching"
+	RouteRTPLatching string = "rtp_latching_" // suffixed with the route (MRF repository) name
+	SIPNATPolicy     string = "sip_nat_policy"
+	RTPTimeout       string = "rtp_timeout"
+	RTPHoldTimeout   string = "rtp_hold_timeout"
+	MediaStartPort   string = "media_start_port"
+	MediaEndPort     string = "media_end_port"
+	MediaQuarantine  string = "media_port_quarantine"
+	MediaBindIPv4    string = "media_bind_ipv4" // comma separated
+	MediaAdvIPv4     string = "media_advertised_ipv4"
+	MediaRealm       string = "realm_"       // suffixed with the realm name
+	RouteMediaRealm  string = "media_realm_" // suffixed with the route (MRF repository) name
+	SIPAdvIPv4       string = "sip_advertised_ipv4"
+	EarlyMedia       string = "early_media"
+	RouteEarlyMedia  string = "early_media_" // suffixed with the route (MRF repository) name
+	SessionTimer     string = "session_timer"
+	RouteSessTimer   string = "session_timer_" // suffixed with the route (MRF repository) name
+	Registration     string = "register_"      // suffixed with the account name
+	TrustedPeer      string = "trusted_peer_"  // suffixed with the peer name
+	SIPAuth          string = "sip_auth"
+	OverloadControl  string = "overload"
+	ScannerProtect   string = "scanner_protection"
+	APIToken         string = "api_token"
 )
 
 func main() {
@@ -45,6 +73,12 @@ func checkArgs() (string, int, int) {
 
 	global.ServerIPv4 = net.ParseIP(ipv4)
 
+	if sa, ok := os.LookupEnv(SIPAdvIPv4); ok {
+		if global.SIPAdvertisedIPv4 = net.ParseIP(sa).To4(); global.SIPAdvertisedIPv4 == nil {
+			global.LogWarning(global.LTConfiguration, "Invalid SIP advertised IPv4: "+sa)
+		}
+	}
+
 	sup, ok := os.LookupEnv(OwnSIPUdpPort)
 	minS := 4999
 	maxS := 6000
@@ -84,5 +118,127 @@ func checkArgs() (string, int, int) {
 		os.Exit(1)
 	}
 
+	if rt, ok := os.LookupEnv(RTPTimeout); ok {
+		if global.RTPTimeoutSec, ok = global.Str2IntDefaultMinMax(rt, global.RTPTimeoutSec, 0, global.MaxCallDurationSec); !ok {
+			global.LogWarning(global.LTConfiguration, "Invalid RTP timeout: "+rt)
+		}
+	}
+	if rt, ok := os.LookupEnv(RTPHoldTimeout); ok {
+		if global.RTPHoldTimeoutSec, ok = global.Str2IntDefaultMinMax(rt, global.RTPHoldTimeoutSec, 0, global.MaxCallDurationSec); !ok {
+			global.LogWarning(global.LTConfiguration, "Invalid RTP hold timeout: "+rt)
+		}
+	}
+
+	checkMediaPortArgs()
+
+	if cp, ok := os.LookupEnv(CodecPolicy); ok {
+		global.CodecPolicyGlobal = cp
+	}
+	if sp, ok := os.LookupEnv(SRTPPolicy); ok {
+		global.SRTPPolicyGlobal = sp
+	}
+	if rl, ok := os.LookupEnv(RTPLatching); ok {
+		global.RTPLatchingGlobal = rl
+	}
+	if np, ok := os.LookupEnv(SIPNATPolicy); ok {
+		global.SIPNATPolicyGlobal = np
+	}
+	if em, ok := os.LookupEnv(EarlyMedia); ok {
+		global.EarlyMediaGlobal = em
+	}
+	if st, ok := os.LookupEnv(SessionTimer); ok {
+		global.SessionTimerGlobal = st
+	}
+	if sa, ok := os.LookupEnv(SIPAuth); ok {
+		global.SIPAuthGlobal = sa
+	}
+	if oc, ok := os.LookupEnv(OverloadControl); ok {
+		global.OverloadGlobal = oc
+	}
+	if sp, ok := os.LookupEnv(ScannerProtect); ok {
+		global.ScannerProtect = sp
+	}
+	global.APIToken = os.Getenv(APIToken)
+	global.CodecPolicyRoutes = make(map[string]string)
+	global.SRTPPolicyRoutes = make(map[string]string)
+	global.RTPLatchingRoutes = make(map[string]string)
+	global.MediaRealmsConfig = make(map[string]string)
+	global.MediaRealmRoutes = make(map[string]string)
+	global.EarlyMediaRoutes = make(map[string]string)
+	global.SessionTimerRoutes = make(map[string]string)
+	global.RegisterAccounts = make(map[string]string)
+	global.TrustedPeersConfig = make(map[string]string)
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if route, ok := strings.CutPrefix(key, RouteCodecPolicy); ok && route != "" {
+			global.CodecPolicyRoutes[route] = value
+		}
+		if route, ok := strings.CutPrefix(key, RouteSRTPPolicy); ok && route != "" {
+			global.SRTPPolicyRoutes[route] = value
+		}
+		if route, ok := strings.CutPrefix(key, RouteRTPLatching); ok && route != "" {
+			global.RTPLatchingRoutes[route] = value
+		}
+		if name, ok := strings.CutPrefix(key, MediaRealm); ok && name != "" {
+			global.MediaRealmsConfig[name] = value
+		}
+		if route, ok := strings.CutPrefix(key, RouteMediaRealm); ok && route != "" {
+			global.MediaRealmRoutes[route] = value
+		}
+		if route, ok := strings.CutPrefix(key, RouteEarlyMedia); ok && route != "" {
+			global.EarlyMediaRoutes[route] = value
+		}
+		if route, ok := strings.CutPrefix(key, RouteSessTimer); ok && route != "" {
+			global.SessionTimerRoutes[route] = value
+		}
+		if name, ok := strings.CutPrefix(key, Registration); ok && name != "" {
+			global.RegisterAccounts[name] = value
+		}
+		if name, ok := strings.CutPrefix(key, TrustedPeer); ok && name != "" {
+			global.TrustedPeersConfig[name] = value
+		}
+	}
+
 	return ipv4, sipuport, httpport
 }
+
+func checkMediaPortArgs() {
+	start, end := global.MediaStartPort, global.MediaEndPort
+	if sp, ok := os.LookupEnv(MediaStartPort); ok {
+		if start, ok = global.Str2IntDefaultMinMax(sp, start, 1024, 65534); !ok {
+			global.LogWarning(global.LTConfiguration, "Invalid media start port: "+sp)
+		}
+	}
+	if ep, ok := os.LookupEnv(MediaEndPort); ok {
+		if end, ok = global.Str2IntDefaultMinMax(ep, end, 1025, 65535); !ok {
+			global.LogWarning(global.LTConfiguration, "Invalid media end port: "+ep)
+		}
+	}
+	if start%2 != 0 {
+		start++
+		global.LogWarning(global.LTConfiguration, fmt.Sprintf("Media start port must be even - %d shall be used", start))
+	}
+	if end <= start {
+		global.LogWarning(global.LTConfiguration, fmt.Sprintf("Invalid media port range %d-%d - %d-%d shall be used", start, end, global.MediaStartPort, global.MediaEndPort))
+	} else {
+		global.MediaStartPort, global.MediaEndPort = start, end
+	}
+
+	if mq, ok := os.LookupEnv(MediaQuarantine); ok {
+		if global.MediaPortQuarantineSec, ok = global.Str2IntDefaultMinMax(mq, global.MediaPortQuarantineSec, 0, 300); !ok {
+			global.LogWarning(global.LTConfiguration, "Invalid media port quarantine: "+mq)
+		}
+	}
+
+	var err error
+	if bi, ok := os.LookupEnv(MediaBindIPv4); ok {
+		if global.MediaBindIPv4s, err = global.ParseIPv4List(bi); err != nil {
+			global.LogWarning(global.LTConfiguration, fmt.Sprintf("Media bind addresses ignored - %v", err))
+		}
+	}
+	if ma, ok := os.LookupEnv(MediaAdvIPv4); ok {
+		if global.MediaAdvertisedIPv4s, err = global.ParseIPv4List(ma); err != nil {
+			global.LogWarning(global.LTConfiguration, fmt.Sprintf("Media advertised addresses ignored - %v", err))
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Package pacer drives periodic media streams (20 ms RTP frames) from a few sharded timing wheels instead of a ticker
+// per stream. Each stream is given a phase (slot) within the period, and slot deadlines are computed from the shard
+// epoch rather than from the previous wake-up, so timer drift never accumulates. The datagrams built by the streams
+// of a slot are queued in the shard batch and sent together once the slot is processed.
+package pacer
+
+import (
+	"fmt"
+	"mrfgo/global"
+	"mrfgo/udpio"
+	"sync"
+	"time"
+)
+
+const (
+	Period         = 20 * time.Millisecond
+	Resolution     = time.Millisecond
+	slotsPerPeriod = int(Period / Resolution)
+)
+
+// Pacer spreads streams over shards, each running its own timing wheel loop
+type Pacer struct {
+	shards []*shard
+}
+
+// Stream is a registered frame function, called on each of its period boundaries until it returns false or is stopped
+type Stream struct {
+	fn       func(out *udpio.Batch) bool
+	shard    *shard
+	slot     int
+	index    int // position in the slot
+	finished bool
+	done     chan struct{}
+
+	mu      sync.Mutex // held while fn runs
+	stopped bool       // fn is not called anymore - mu
+}
+
+type shard struct {
+	mu    sync.Mutex
+	slots [slotsPerPeriod][]*Stream
+	count int
+	wake  chan struct{}
+	out   *udpio.Batch
+	due   []*Stream // streams of the slot being processed, called without the lock - shard loop only
+	ended []*Stream
+
+	// statistics
+	frames    uint64
+	lateSum   time.Duration
+	lateMax   time.Duration
+	lateSlots uint64
+	resyncs   uint64
+}
+
+type Stats struct {
+	Streams     int
+	Frames      uint64
+	MeanLate    time.Duration // mean delay of slot processing after its deadline
+	MaxLate     time.Duration
+	Resyncs     uint64 // times a shard was more than a period late and skipped the missed slots
+	ShardsCount int
+}
+
+// New starts a pacer with the given number of shards (at least one)
+func New(shards int) *Pacer {
+	p := &Pacer{shards: make([]*shard, max(shards, 1))}
+	for i := range p.shards {
+		p.shards[i] = &shard{wake: make(chan struct{}, 1), out: udpio.NewBatch()}
+		go p.shards[i].run()
+	}
+	return p
+}
+
+// Start registers fn on the least loaded shard and slot - fn is first called on the next occurrence of that slot,
+// within one period, with the batch to queue its datagrams in. fn runs on the shard loop: it must not block nor call
+// Stop, it returns false to finish instead.
+func (p *Pacer) Start(fn func(out *udpio.Batch) bool) *Stream {
+	sh := p.shards[0]
+	for _, s := range p.shards[1:] {
+		if s.load() < sh.load() {
+			sh = s
+		}
+	}
+	st := &Stream{fn: fn, shard: sh, done: make(chan struct{})}
+	sh.mu.Lock()
+	st.slot = 0
+	for i := 1; i < slotsPerPeriod; i++ {
+		if len(sh.slots[i]) < len(sh.slots[st.slot]) {
+			st.slot = i
+		}
+	}
+	st.index = len(sh.slots[st.slot])
+	sh.slots[st.slot] = append(sh.slots[st.slot], st)
+	sh.count++
+	sh.mu.Unlock()
+	select {
+	case sh.wake <- struct{}{}:
+	default:
+	}
+	return st
+}
+
+// Stats aggregates the statistics of all shards
+func (p *Pacer) Stats() Stats {
+	var out Stats
+	var lateSum time.Duration
+	var lateSlots uint64
+	for _, sh := range p.shards {
+		sh.mu.Lock()
+		out.Streams += sh.count
+		out.Frames += sh.frames
+		out.MaxLate = max(out.MaxLate, sh.lateMax)
+		out.Resyncs += sh.resyncs
+		lateSum += sh.lateSum
+		lateSlots += sh.lateSlots
+		sh.mu.Unlock()
+	}
+	if lateSlots != 0 {
+		out.MeanLate = lateSum / time.Duration(lateSlots)
+	}
+	out.ShardsCount = len(p.shards)
+	return out
+}
+
+// Done is closed once the stream is finished or stopped
+func (st *Stream) Done() <-chan struct{} {
+	return st.done
+}
+
+// Stop unregisters the stream - once returned, its frame function is not running and is not called anymore
+func (st *Stream) Stop() {
+	st.mu.Lock() // waits for a running frame function
+	st.stopped = true
+	st.mu.Unlock()
+	sh := st.shard
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.finish(st)
+}
+
+func (sh *shard) load() int {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.count
+}
+
+// finish removes the stream from its slot - shard lock held
+func (sh *shard) finish(st *Stream) {
+	if st.finished {
+		return
+	}
+	slot := sh.slots[st.slot]
+	last := len(slot) - 1
+	slot[st.index] = slot[last]
+	slot[st.index].index = st.index
+	slot[last] = nil
+	sh.slots[st.slot] = slot[:last]
+	sh.count--
+	st.finished = true
+	close(st.done)
+}
+
+func (sh *shard) run() {
+	timer := time.NewTimer(Period)
+	timer.Stop()
+	var epoch time.Time
+	var tick int64
+	for {
+		if sh.load() == 0 {
+			<-sh.wake // parked while idle
+			epoch = time.Time{}
+		}
+		if epoch.IsZero() {
+			epoch, tick = time.Now(), 0
+		}
+		due := epoch.Add(time.Duration(tick) * Resolution)
+		if wait := time.Until(due); wait > 0 {
+			timer.Reset(wait)
+			<-timer.C
+		}
+		late := time.Since(due)
+		if late >= Period {
+			// stalled for a whole period: the missed slots are skipped rather than sent in a burst
+			tick += int64(late / Resolution)
+			late %= Resolution
+			sh.mu.Lock()
+			sh.resyncs++
+			sh.mu.Unlock()
+		}
+		sh.runSlot(int(tick%int64(slotsPerPeriod)), late)
+		tick++
+	}
+}
+
+// runSlot calls the streams of the slot without holding the shard lock, so that Start, Stop and Stats do not wait
+// for the frame functions, then removes the finished streams
+func (sh *shard) runSlot(slot int, late time.Duration) {
+	sh.mu.Lock()
+	sh.due = append(sh.due[:0], sh.slots[slot]...)
+	sh.mu.Unlock()
+
+	frames := uint64(0)
+	for _, st := range sh.due {
+		st.mu.Lock()
+		if st.stopped {
+			st.mu.Unlock()
+			continue
+		}
+		frames++
+		if !st.call(sh.out) {
+			st.stopped = true
+			sh.ended = append(sh.ended, st)
+		}
+		st.mu.Unlock()
+	}
+	if sh.out.Len() != 0 {
+		if err := sh.out.Flush(); err != nil && !udpio.IsClosed(err) {
+			global.LogWarning(global.LTMediaStack, fmt.Sprintf("Paced datagrams not sent - %v", err))
+		}
+	}
+
+	sh.mu.Lock()
+	for _, st := range sh.ended {
+		sh.finish(st)
+	}
+	sh.frames += frames
+	sh.lateSum += late
+	sh.lateMax = max(sh.lateMax, late)
+	sh.lateSlots++
+	sh.mu.Unlock()
+	clear(sh.due)
+	clear(sh.ended)
+	sh.ended = sh.ended[:0]
+}
+
+// call runs the frame function - a panic finishes the stream without taking the shard down
+func (st *Stream) call(out *udpio.Batch) (more bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			global.LogCallStack(r)
+			more = false
+		}
+	}()
+	return st.fn(out)
+}
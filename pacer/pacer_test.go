@@ -0,0 +1,78 @@
+package pacer
+
+import (
+	"fmt"
+	"mrfgo/udpio"
+	"testing"
+	"time"
+)
+
+// BenchmarkPeriod measures the processing of one 20 ms period (all slots) by a single shard for a number of streams,
+// each frame building a 172 bytes packet - ns/frame is the shard cost per stream and frame, %period the share of
+// one CPU a shard needs at that load
+func BenchmarkPeriod(b *testing.B) {
+	for _, streams := range []int{5000, 10000, 25000} {
+		b.Run(fmt.Sprintf("streams=%d", streams), func(b *testing.B) {
+			sh := &shard{wake: make(chan struct{}, 1), out: udpio.NewBatch()}
+			for i := range streams {
+				var packet [172]byte
+				seq := 0
+				st := &Stream{shard: sh, slot: i % slotsPerPeriod, done: make(chan struct{})}
+				st.fn = func(*udpio.Batch) bool {
+					seq++
+					for j := range packet {
+						packet[j] = byte(seq + j)
+					}
+					return true
+				}
+				st.index = len(sh.slots[st.slot])
+				sh.slots[st.slot] = append(sh.slots[st.slot], st)
+				sh.count++
+			}
+			for b.Loop() {
+				for slot := range slotsPerPeriod {
+					sh.runSlot(slot, 0)
+				}
+			}
+			perPeriod := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+			b.ReportMetric(perPeriod/float64(streams), "ns/frame")
+			b.ReportMetric(100*perPeriod/float64(Period.Nanoseconds()), "%period")
+		})
+	}
+}
+
+// TestStopWaitsForFrame checks that a stream stopped while its frame function runs is not called afterwards
+func TestStopWaitsForFrame(t *testing.T) {
+	p := New(1)
+	running, release := make(chan struct{}), make(chan struct{})
+	calls := 0
+	st := p.Start(func(*udpio.Batch) bool {
+		calls++
+		if calls == 1 {
+			close(running)
+			<-release
+		}
+		return true
+	})
+	<-running
+	stopped := make(chan struct{})
+	go func() {
+		st.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while the frame function runs")
+	case <-time.After(3 * Period):
+	}
+	close(release)
+	<-stopped
+	n := calls
+	time.Sleep(3 * Period)
+	if calls != n {
+		t.Errorf("frame function called %d times after Stop", calls-n)
+	}
+	if p.Stats().Streams != 0 {
+		t.Errorf("stream still registered")
+	}
+}
@@ -0,0 +1,182 @@
+//go:build unix
+
+// Command pacerbench measures the CPU usage and the frame jitter of paced 20 ms streams, with the shared pacer
+// and with a ticker per stream for comparison:
+//
+//	go run ./pacer/pacerbench -streams 5000,10000,25000 -duration 10s
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/bits"
+	"mrfgo/pacer"
+	"mrfgo/udpio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const buckets = 32 // power-of-two microsecond buckets
+
+// streamStats is only touched by its own stream, then summed once it is stopped
+type streamStats struct {
+	last    time.Time
+	frames  int
+	jitSum  time.Duration
+	jitMax  time.Duration
+	jitHist [buckets]int
+	packet  [172]byte
+}
+
+func (s *streamStats) frame(seq int) {
+	now := time.Now()
+	if !s.last.IsZero() {
+		jit := now.Sub(s.last) - pacer.Period
+		if jit < 0 {
+			jit = -jit
+		}
+		s.jitSum += jit
+		s.jitMax = max(s.jitMax, jit)
+		s.jitHist[min(bits.Len64(uint64(jit.Microseconds())), buckets-1)]++
+		s.frames++
+	}
+	s.last = now
+	// stand-in for building a packet
+	for i := range s.packet {
+		s.packet[i] = byte(seq + i)
+	}
+}
+
+type result struct {
+	frames int
+	jitSum time.Duration
+	jitMax time.Duration
+	hist   [buckets]int
+}
+
+func (r *result) add(s *streamStats) {
+	r.frames += s.frames
+	r.jitSum += s.jitSum
+	r.jitMax = max(r.jitMax, s.jitMax)
+	for i, n := range s.jitHist {
+		r.hist[i] += n
+	}
+}
+
+// percentile returns the upper bound of the bucket holding the percentile
+func (r *result) percentile(p float64) time.Duration {
+	target := int(float64(r.frames) * p)
+	sum := 0
+	for i, n := range r.hist {
+		sum += n
+		if sum > target {
+			return time.Duration(1<<i) * time.Microsecond
+		}
+	}
+	return r.jitMax
+}
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func runPacer(streams int, duration time.Duration) *result {
+	p := pacer.New(runtime.NumCPU())
+	stats := make([]*streamStats, streams)
+	handles := make([]*pacer.Stream, streams)
+	for i := range stats {
+		st, seq := &streamStats{}, 0
+		stats[i] = st
+		handles[i] = p.Start(func(*udpio.Batch) bool {
+			seq++
+			st.frame(seq)
+			return true
+		})
+	}
+	time.Sleep(duration)
+	res := &result{}
+	for i, h := range handles {
+		h.Stop()
+		res.add(stats[i])
+	}
+	return res
+}
+
+func runTickers(streams int, duration time.Duration) *result {
+	stats := make([]*streamStats, streams)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range stats {
+		st := &streamStats{}
+		stats[i] = st
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tckr := time.NewTicker(pacer.Period)
+			defer tckr.Stop()
+			for seq := 0; ; seq++ {
+				select {
+				case <-done:
+					return
+				case <-tckr.C:
+					st.frame(seq)
+				}
+			}
+		}()
+	}
+	time.Sleep(duration)
+	close(done)
+	wg.Wait()
+	res := &result{}
+	for _, st := range stats {
+		res.add(st)
+	}
+	return res
+}
+
+func main() {
+	list := flag.String("streams", "5000,10000,25000", "comma separated numbers of concurrent streams")
+	duration := flag.Duration("duration", 10*time.Second, "measurement duration per run")
+	modes := flag.String("modes", "pacer,ticker", "comma separated modes: pacer (shared scheduler), ticker (ticker per stream)")
+	flag.Parse()
+
+	fmt.Printf("GOMAXPROCS %d - %v per run\n", runtime.GOMAXPROCS(0), *duration)
+	fmt.Printf("%-7s %8s %12s %8s %12s %12s %12s\n", "mode", "streams", "frames/s", "CPU", "mean jitter", "p99 jitter", "max jitter")
+	for _, s := range strings.Split(*list, ",") {
+		streams, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || streams <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid number of streams [%s]\n", s)
+			os.Exit(1)
+		}
+		for _, mode := range strings.Split(*modes, ",") {
+			run := runPacer
+			switch mode = strings.TrimSpace(mode); mode {
+			case "pacer":
+			case "ticker":
+				run = runTickers
+			default:
+				fmt.Fprintf(os.Stderr, "invalid mode [%s]\n", mode)
+				os.Exit(1)
+			}
+			runtime.GC()
+			cpu0, wall0 := cpuTime(), time.Now()
+			res := run(streams, *duration)
+			cpu, wall := cpuTime()-cpu0, time.Since(wall0)
+			mean := time.Duration(0)
+			if res.frames != 0 {
+				mean = res.jitSum / time.Duration(res.frames)
+			}
+			fmt.Printf("%-7s %8d %12.0f %7.1f%% %12v %12v %12v\n", mode, streams, float64(res.frames)/wall.Seconds(),
+				100*cpu.Seconds()/wall.Seconds(), mean.Round(time.Microsecond), res.percentile(0.99), res.jitMax.Round(time.Microsecond))
+		}
+	}
+}
@@ -15,6 +15,23 @@ type Metrics struct {
 	Registry    *prometheus.Registry
 	ConSessions prometheus.Gauge
 	Caps        prometheus.Gauge
+
+	MediaPortsInUse       *prometheus.GaugeVec   // RTP/RTCP port pairs allocated, per bind IP
+	MediaPortsFree        *prometheus.GaugeVec   // port pairs ready for allocation, per bind IP
+	MediaPortsQuarantined *prometheus.GaugeVec   // released port pairs waiting before reuse, per bind IP
+	MediaPortExhaustions  *prometheus.CounterVec // allocations failed for lack of port pairs, per bind IP
+
+	AccessRejections *prometheus.CounterVec // INVITEs denied by the access control, per reason and trusted peer
+
+	OverloadRejections *prometheus.CounterVec // INVITEs rejected with 503 by the overload control, per reason
+	OverloadLimits     *prometheus.GaugeVec   // configured limits of the overload control, per limit
+	InboundCalls       prometheus.Gauge       // inbound calls admitted and not yet released
+	PacketQueueDepth   prometheus.Gauge       // SIP packets waiting for a worker
+	CPUUsage           prometheus.Gauge       // percent of the CPUs used by the process
+
+	ScannerBans      *prometheus.CounterVec // sources banned by the scanner protection, per reason
+	ScreenedRequests *prometheus.CounterVec // requests from banned sources, per action (rejected or dropped)
+	BannedSources    prometheus.Gauge       // sources currently banned
 }
 
 // NewMetrics initializes a new custom Prometheus registry and returns an instance of Metrics.
@@ -49,10 +66,118 @@ func NewMetrics(ua string) *Metrics {
 	})
 	reg.MustRegister(concurrentSessions)
 
+	mediaPortsInUse := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ua,
+		Name:      "MediaPortsInUse",
+		Help:      "Shows RTP/RTCP port pairs allocated",
+	}, []string{"ip"})
+	reg.MustRegister(mediaPortsInUse)
+
+	mediaPortsFree := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ua,
+		Name:      "MediaPortsFree",
+		Help:      "Shows RTP/RTCP port pairs available for allocation",
+	}, []string{"ip"})
+	reg.MustRegister(mediaPortsFree)
+
+	mediaPortsQuarantined := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ua,
+		Name:      "MediaPortsQuarantined",
+		Help:      "Shows released RTP/RTCP port pairs waiting before reuse",
+	}, []string{"ip"})
+	reg.MustRegister(mediaPortsQuarantined)
+
+	mediaPortExhaustions := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ua,
+		Name:      "MediaPortExhaustions",
+		Help:      "Counts media port allocations failed for lack of RTP/RTCP port pairs",
+	}, []string{"ip"})
+	reg.MustRegister(mediaPortExhaustions)
+
+	accessRejections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ua,
+		Name:      "AccessRejections",
+		Help:      "Counts INVITEs rejected or challenged by the access control",
+	}, []string{"reason", "peer"})
+	reg.MustRegister(accessRejections)
+
+	overloadRejections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ua,
+		Name:      "OverloadRejections",
+		Help:      "Counts INVITEs rejected with 503 by the overload control",
+	}, []string{"reason"})
+	reg.MustRegister(overloadRejections)
+
+	overloadLimits := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ua,
+		Name:      "OverloadLimits",
+		Help:      "Shows the configured limits of the overload control, 0 when off",
+	}, []string{"limit"})
+	reg.MustRegister(overloadLimits)
+
+	inboundCalls := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ua,
+		Name:      "InboundCalls",
+		Help:      "Shows inbound calls admitted by the overload control",
+	})
+	reg.MustRegister(inboundCalls)
+
+	packetQueueDepth := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ua,
+		Name:      "PacketQueueDepth",
+		Help:      "Shows SIP packets waiting for a worker",
+	})
+	reg.MustRegister(packetQueueDepth)
+
+	cpuUsage := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ua,
+		Name:      "CPUUsage",
+		Help:      "Shows the percent of the CPUs used by the process",
+	})
+	reg.MustRegister(cpuUsage)
+
+	scannerBans := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ua,
+		Name:      "ScannerBans",
+		Help:      "Counts sources banned by the scanner protection",
+	}, []string{"reason"})
+	reg.MustRegister(scannerBans)
+
+	screenedRequests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ua,
+		Name:      "ScreenedRequests",
+		Help:      "Counts requests from banned sources, rejected or dropped",
+	}, []string{"action"})
+	reg.MustRegister(screenedRequests)
+
+	bannedSources := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ua,
+		Name:      "BannedSources",
+		Help:      "Shows sources currently banned by the scanner protection",
+	})
+	reg.MustRegister(bannedSources)
+
 	metrics := &Metrics{
 		Registry:    reg,
 		ConSessions: concurrentSessions,
 		Caps:        caps,
+
+		MediaPortsInUse:       mediaPortsInUse,
+		MediaPortsFree:        mediaPortsFree,
+		MediaPortsQuarantined: mediaPortsQuarantined,
+		MediaPortExhaustions:  mediaPortExhaustions,
+
+		AccessRejections: accessRejections,
+
+		OverloadRejections: overloadRejections,
+		OverloadLimits:     overloadLimits,
+		InboundCalls:       inboundCalls,
+		PacketQueueDepth:   packetQueueDepth,
+		CPUUsage:           cpuUsage,
+
+		ScannerBans:      scannerBans,
+		ScreenedRequests: screenedRequests,
+		BannedSources:    bannedSources,
 	}
 
 	return metrics
@@ -0,0 +1,59 @@
+package rtp
+
+import "math"
+
+// Comfort Noise (RFC 3389)
+
+const (
+	CN uint8 = 13
+
+	CNDefaultLevel  byte = 80 // -dBov sent between prompts
+	CNUpdatePackets int  = 25 // CN is repeated every 500 ms of silence
+
+	cnSilenceLevel byte = 55 // -dBov below which a packet is considered silent
+	cnHangover     int  = 5  // silent packets still sent as audio before switching to CN, to keep speech tails intact
+)
+
+// NoiseLevel returns the level of the PCM samples in -dBov, as carried in a CN payload
+func NoiseLevel(pcm []int16) byte {
+	if len(pcm) == 0 {
+		return 127
+	}
+	var sum float64
+	for _, s := range pcm {
+		sum += float64(s) * float64(s)
+	}
+	rms := math.Sqrt(sum / float64(len(pcm)))
+	if rms < 1 {
+		return 127
+	}
+	dbov := -20 * math.Log10(rms/32768)
+	if dbov < 0 {
+		return 0
+	}
+	if dbov > 127 {
+		return 127
+	}
+	return byte(dbov)
+}
+
+// ComfortNoiseLevels returns for each 20 ms packet of the PCM the CN noise level to be sent instead of audio,
+// or 0 if the packet is to be sent as audio. The packets match the ones built by EncodePackets.
+func ComfortNoiseLevels(pcm []int16) []byte {
+	count := (len(pcm) + SamplesPerPacket - 1) / SamplesPerPacket
+	measured := make([]byte, count)
+	levels := make([]byte, count)
+	run := 0
+	for i := range count {
+		end := min((i+1)*SamplesPerPacket, len(pcm))
+		measured[i] = NoiseLevel(pcm[i*SamplesPerPacket : end])
+		if measured[i] < cnSilenceLevel {
+			run = 0
+			continue
+		}
+		if run++; run > cnHangover {
+			levels[i] = measured[i]
+		}
+	}
+	return levels
+}
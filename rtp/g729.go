@@ -0,0 +1,127 @@
+//go:build g729
+
+package rtp
+
+/*
+#cgo LDFLAGS: -lbcg729
+#include <stdint.h>
+#include <bcg729/encoder.h>
+#include <bcg729/decoder.h>
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// G729Available is set when mrfgo is built with the g729 tag and linked against bcg729
+const G729Available = true
+
+const g729FrameSamples int = 80 // 10 ms @ 8 kHz
+
+func PCM2G729(pcm []int16) []byte {
+	pkts := PCM2G729Packets(pcm, false)
+	if pkts == nil {
+		return nil
+	}
+	res := make([]byte, 0, len(pkts)*2*G729FrameSize)
+	for _, pkt := range pkts {
+		res = append(res, pkt...)
+	}
+	return res
+}
+
+// PCM2G729Packets encodes PCM into 20 ms packets of two frames each.
+// With VAD enabled, silent packets are left empty. An SID frame must end a packet (RFC 3551 §4.5.6): when voice
+// follows it in the same packet, the SID frame is dropped so that the speech onset is kept.
+func PCM2G729Packets(pcm []int16, vad bool) [][]byte {
+	if len(pcm) < g729FrameSamples {
+		return nil
+	}
+	enc := C.initBcg729EncoderChannel(C.uint8_t(bool2uint8(vad)))
+	if enc == nil {
+		return nil
+	}
+	defer C.closeBcg729EncoderChannel(enc)
+
+	var bitstream [G729FrameSize]C.uint8_t
+	var bslen C.uint8_t
+	pkts := make([][]byte, 0, len(pcm)/SamplesPerPacket)
+	var pkt []byte
+	for i, f := 0, 0; i+g729FrameSamples <= len(pcm); i, f = i+g729FrameSamples, f+1 {
+		C.bcg729Encoder(enc, (*C.int16_t)(unsafe.Pointer(&pcm[i])), &bitstream[0], &bslen)
+		if bslen > 0 {
+			if len(pkt)%G729FrameSize != 0 { // ends with an SID frame
+				pkt = pkt[:0]
+			}
+			pkt = append(pkt, C.GoBytes(unsafe.Pointer(&bitstream[0]), C.int(bslen))...)
+		}
+		if f%2 == 1 {
+			pkts = append(pkts, pkt)
+			pkt = nil
+		}
+	}
+	return pkts
+}
+
+// G729Decoder decodes the frames of a received stream, keeping the decoder state (and the comfort noise parameters
+// of the SID frames) from one packet to the next
+type G729Decoder struct {
+	dec *C.bcg729DecoderChannelContextStruct
+	out [g729FrameSamples]int16
+}
+
+func NewG729Decoder() *G729Decoder {
+	dec := C.initBcg729DecoderChannel()
+	if dec == nil {
+		return nil
+	}
+	return &G729Decoder{dec: dec}
+}
+
+// Decode decodes the voice and SID frames of a payload
+func (d *G729Decoder) Decode(frame []byte) []int16 {
+	res := make([]int16, 0, (len(frame)/G729FrameSize+1)*g729FrameSamples)
+	for len(frame) > 0 {
+		var sz int
+		var sid uint8
+		switch {
+		case len(frame) >= G729FrameSize:
+			sz = G729FrameSize
+		case len(frame) == G729SIDFrameSize:
+			sz = G729SIDFrameSize
+			sid = 1
+		default:
+			return res
+		}
+		C.bcg729Decoder(d.dec, (*C.uint8_t)(unsafe.Pointer(&frame[0])), C.uint8_t(sz), 0, C.uint8_t(sid), 0, (*C.int16_t)(unsafe.Pointer(&d.out[0])))
+		res = append(res, d.out[:]...)
+		frame = frame[sz:]
+	}
+	return res
+}
+
+func (d *G729Decoder) Close() {
+	C.closeBcg729DecoderChannel(d.dec)
+	d.dec = nil
+}
+
+// G729toPCM decodes a standalone payload, streams being decoded by a G729Decoder
+func G729toPCM(frame []byte) []int16 {
+	if len(frame) == 0 {
+		return nil
+	}
+	d := NewG729Decoder()
+	if d == nil {
+		return nil
+	}
+	defer d.Close()
+	return d.Decode(frame)
+}
+
+func bool2uint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
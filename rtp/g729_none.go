@@ -0,0 +1,30 @@
+//go:build !g729
+
+package rtp
+
+// G729Available is false unless mrfgo is built with the g729 tag (requires bcg729)
+const G729Available = false
+
+func PCM2G729(pcm []int16) []byte {
+	return nil
+}
+
+func PCM2G729Packets(pcm []int16, vad bool) [][]byte {
+	return nil
+}
+
+type G729Decoder struct{}
+
+func NewG729Decoder() *G729Decoder {
+	return nil
+}
+
+func (d *G729Decoder) Decode(frame []byte) []int16 {
+	return nil
+}
+
+func (d *G729Decoder) Close() {}
+
+func G729toPCM(frame []byte) []int16 {
+	return nil
+}
@@ -4,6 +4,20 @@ const (
 	PCMU uint8 = 0
 	PCMA uint8 = 8
 	G722 uint8 = 9
+	G729 uint8 = 18
+
+	// codec identifiers above 127 never appear on the wire, they distinguish variants sharing a payload type
+	G729B   uint8 = 128 + G729 // G.729 Annex A with Annex B VAD/CNG
+	OPUS    uint8 = 200        // Opus, dynamic payload type taken from the offer
+	OPUSFEC uint8 = 201        // Opus with inband FEC (useinbandfec=1)
+)
+
+const (
+	SamplesPerPacket int = 160 // 20 ms @ 8 kHz
+	G729FrameSize    int = 10  // bytes per 10 ms voice frame
+	G729SIDFrameSize int = 2   // bytes per Annex B SID frame
+	OpusClockRate    int = 48000
+	opusSourceRate   int = 8000 // prompts are narrowband, Opus encodes them at 8 kHz internally
 )
 
 var codecSilence = map[uint8]byte{PCMU: 255, PCMA: 213, G722: 85}
@@ -21,6 +35,45 @@ func GetSilence(pt uint8) byte {
 	}
 }
 
+// IsCodecAvailable reports whether the codec can be encoded and decoded by this build
+func IsCodecAvailable(codec uint8) bool {
+	switch codec {
+	case PCMU, PCMA, G722:
+		return true
+	case G729, G729B:
+		return G729Available
+	case OPUS, OPUSFEC:
+		return OpusAvailable
+	default:
+		return false
+	}
+}
+
+// IsOpus reports whether the codec is one of the Opus variants
+func IsOpus(codec uint8) bool {
+	return codec == OPUS || codec == OPUSFEC
+}
+
+// ClockTicksPerPacket returns the RTP timestamp increment of a 20 ms packet
+func ClockTicksPerPacket(codec uint8) uint32 {
+	if IsOpus(codec) {
+		return uint32(OpusClockRate / 50)
+	}
+	return uint32(SamplesPerPacket)
+}
+
+// PacketBytes returns the payload size of a full 20 ms voice packet, 0 for variable bitrate codecs
+func PacketBytes(codec uint8) int {
+	switch codec {
+	case G729, G729B:
+		return 2 * G729FrameSize
+	case OPUS, OPUSFEC:
+		return 0
+	default:
+		return SamplesPerPacket
+	}
+}
+
 func DecodeToPCM(frame []byte, pt uint8) []int16 {
 	switch pt {
 	case PCMU:
@@ -29,11 +82,56 @@ func DecodeToPCM(frame []byte, pt uint8) []int16 {
 		return G711A2PCM(frame)
 	case G722:
 		return G722toPCM(frame)
+	case G729, G729B:
+		return G729toPCM(frame)
+	case OPUS, OPUSFEC:
+		return OpusToPCM(frame)
 	default:
 		return nil
 	}
 }
 
+// Decoder decodes the payloads of a received stream, the codecs having a state keeping one decoder for the stream
+type Decoder struct {
+	codec uint8
+	g729  *G729Decoder
+	opus  *OpusDecoder
+}
+
+func NewDecoder(codec uint8) *Decoder {
+	d := &Decoder{codec: codec}
+	switch codec {
+	case G729, G729B:
+		d.g729 = NewG729Decoder()
+	case OPUS, OPUSFEC:
+		d.opus = NewOpusDecoder()
+	}
+	return d
+}
+
+func (d *Decoder) Codec() uint8 {
+	return d.codec
+}
+
+func (d *Decoder) Decode(frame []byte) []int16 {
+	switch {
+	case d.g729 != nil:
+		return d.g729.Decode(frame)
+	case d.opus != nil:
+		return d.opus.Decode(frame)
+	}
+	return DecodeToPCM(frame, d.codec)
+}
+
+func (d *Decoder) Close() {
+	if d.g729 != nil {
+		d.g729.Close()
+	}
+	if d.opus != nil {
+		d.opus.Close()
+	}
+}
+
 func EncodePCM(pcm []int16, pt uint8) []byte {
 	switch pt {
 	case PCMU:
@@ -42,11 +140,37 @@ func EncodePCM(pcm []int16, pt uint8) []byte {
 		return PCM2G711A(pcm)
 	case G722:
 		return PCM2G722(pcm)
+	case G729:
+		return PCM2G729(pcm)
 	default:
 		return nil
 	}
 }
 
+// EncodePackets encodes the PCM into 20 ms RTP payloads, padding the last packet with silence.
+// An empty payload means nothing is to be transmitted for that packet (Annex B DTX).
+func EncodePackets(pcm []int16, codec uint8) [][]byte {
+	if rem := len(pcm) % SamplesPerPacket; rem != 0 {
+		pcm = append(pcm[:len(pcm):len(pcm)], make([]int16, SamplesPerPacket-rem)...)
+	}
+	switch codec {
+	case G729B:
+		return PCM2G729Packets(pcm, true)
+	case OPUS, OPUSFEC:
+		return PCM2OpusPackets(pcm, codec == OPUSFEC)
+	}
+	data := EncodePCM(pcm, codec)
+	if data == nil {
+		return nil
+	}
+	sz := PacketBytes(codec)
+	pkts := make([][]byte, 0, len(data)/sz)
+	for i := 0; i+sz <= len(data); i += sz {
+		pkts = append(pkts, data[i:i+sz])
+	}
+	return pkts
+}
+
 func TxPCMnSilence(pcm []int16, pt byte) ([]byte, byte) {
 	switch pt {
 	case PCMU:
@@ -1,6 +1,119 @@
+//go:build opus
+
 package rtp
 
+/*
+#cgo LDFLAGS: -lopus
+#include <opus/opus.h>
+
+static int mrf_opus_encoder_setup(OpusEncoder *enc, int fec) {
+	int r = opus_encoder_ctl(enc, OPUS_SET_INBAND_FEC(fec));
+	if (r != OPUS_OK) {
+		return r;
+	}
+	r = opus_encoder_ctl(enc, OPUS_SET_PACKET_LOSS_PERC(fec ? 10 : 0));
+	if (r != OPUS_OK) {
+		return r;
+	}
+	return opus_encoder_ctl(enc, OPUS_SET_MAX_BANDWIDTH(OPUS_BANDWIDTH_NARROWBAND));
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// OpusAvailable is set when mrfgo is built with the opus tag and linked against libopus
+const OpusAvailable = true
+
+const opusMaxPacketSize int = 1275 // RFC 6716 maximum frame size
+
 func InitializeOpus() {
+	fmt.Printf("Opus enabled: %s\n", C.GoString(C.opus_get_version_string()))
+}
+
+// PCM2OpusPackets encodes 8 kHz mono PCM into 20 ms Opus packets, with inband FEC if requested
+func PCM2OpusPackets(pcm []int16, fec bool) [][]byte {
+	if len(pcm) < SamplesPerPacket {
+		return nil
+	}
+	var cerr C.int
+	enc := C.opus_encoder_create(C.opus_int32(opusSourceRate), 1, C.OPUS_APPLICATION_VOIP, &cerr)
+	if cerr != C.OPUS_OK || enc == nil {
+		fmt.Println(fmt.Errorf("Failed to create Opus encoder: %d", int(cerr)))
+		return nil
+	}
+	defer C.opus_encoder_destroy(enc)
+	if r := C.mrf_opus_encoder_setup(enc, C.int(bool2int(fec))); r != C.OPUS_OK {
+		fmt.Println(fmt.Errorf("Failed to setup Opus encoder: %d", int(r)))
+		return nil
+	}
+
+	buf := make([]byte, opusMaxPacketSize)
+	pkts := make([][]byte, 0, len(pcm)/SamplesPerPacket)
+	for i := 0; i+SamplesPerPacket <= len(pcm); i += SamplesPerPacket {
+		n := C.opus_encode(enc, (*C.opus_int16)(unsafe.Pointer(&pcm[i])), C.int(SamplesPerPacket),
+			(*C.uchar)(unsafe.Pointer(&buf[0])), C.opus_int32(len(buf)))
+		if n < 0 {
+			fmt.Println(fmt.Errorf("Failed to encode Opus data: %d", int(n)))
+			return nil
+		}
+		pkts = append(pkts, append([]byte(nil), buf[:n]...))
+	}
+	return pkts
+}
+
+// OpusDecoder decodes the packets of a received stream into 8 kHz mono PCM, keeping the decoder state
+type OpusDecoder struct {
+	dec *C.OpusDecoder
+	out []int16
+}
+
+func NewOpusDecoder() *OpusDecoder {
+	var cerr C.int
+	dec := C.opus_decoder_create(C.opus_int32(opusSourceRate), 1, &cerr)
+	if cerr != C.OPUS_OK || dec == nil {
+		return nil
+	}
+	return &OpusDecoder{dec: dec, out: make([]int16, opusSourceRate*120/1000)} // longest Opus packet is 120 ms
+}
+
+func (d *OpusDecoder) Decode(packet []byte) []int16 {
+	if len(packet) == 0 {
+		return nil
+	}
+	n := C.opus_decode(d.dec, (*C.uchar)(unsafe.Pointer(&packet[0])), C.opus_int32(len(packet)),
+		(*C.opus_int16)(unsafe.Pointer(&d.out[0])), C.int(len(d.out)), 0)
+	if n < 0 {
+		fmt.Println(fmt.Errorf("Failed to decode Opus data: %d", int(n)))
+		return nil
+	}
+	return append([]int16(nil), d.out[:n]...)
+}
+
+func (d *OpusDecoder) Close() {
+	C.opus_decoder_destroy(d.dec)
+	d.dec = nil
+}
+
+// OpusToPCM decodes a standalone Opus packet, streams being decoded by an OpusDecoder
+func OpusToPCM(packet []byte) []int16 {
+	if len(packet) == 0 {
+		return nil
+	}
+	d := NewOpusDecoder()
+	if d == nil {
+		return nil
+	}
+	defer d.Close()
+	return d.Decode(packet)
+}
 
-	// opus.
+func bool2int(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,29 @@
+//go:build !opus
+
+package rtp
+
+// OpusAvailable is false unless mrfgo is built with the opus tag (requires libopus)
+const OpusAvailable = false
+
+func InitializeOpus() {
+}
+
+func PCM2OpusPackets(pcm []int16, fec bool) [][]byte {
+	return nil
+}
+
+type OpusDecoder struct{}
+
+func NewOpusDecoder() *OpusDecoder {
+	return nil
+}
+
+func (d *OpusDecoder) Decode(packet []byte) []int16 {
+	return nil
+}
+
+func (d *OpusDecoder) Close() {}
+
+func OpusToPCM(packet []byte) []int16 {
+	return nil
+}
@@ -0,0 +1,18 @@
+package rtp
+
+import "encoding/binary"
+
+const HeaderSize int = 12
+
+// AppendHeader appends the fixed RTP header (RFC 3550, version 2, no padding, extension nor CSRC) to b without allocating
+// when b has the capacity
+func AppendHeader(b []byte, marker bool, pt uint8, seq uint16, ts, ssrc uint32) []byte {
+	mpt := pt & 0x7F
+	if marker {
+		mpt |= 0x80
+	}
+	b = append(b, 0x80, mpt)
+	b = binary.BigEndian.AppendUint16(b, seq)
+	b = binary.BigEndian.AppendUint32(b, ts)
+	return binary.BigEndian.AppendUint32(b, ssrc)
+}
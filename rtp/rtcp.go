@@ -0,0 +1,164 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// RTCP (RFC 3550) packet types
+const (
+	RTCPSR   uint8 = 200
+	RTCPRR   uint8 = 201
+	RTCPSDES uint8 = 202
+	RTCPBYE  uint8 = 203
+	RTCPAPP  uint8 = 204
+
+	sdesCNAME uint8 = 1
+
+	ntpEpochOffset uint64 = 2208988800 // seconds from 1900 to 1970
+)
+
+var errRTCP = errors.New("malformed RTCP packet")
+
+type ReportBlock struct {
+	SSRC           uint32
+	FractionLost   uint8
+	CumulativeLost uint32 // 24 bits
+	HighestSeq     uint32 // extended highest sequence number received
+	Jitter         uint32 // in RTP timestamp units
+	LSR            uint32 // middle 32 bits of the NTP timestamp of the last SR received
+	DLSR           uint32 // delay since the last SR received, in 1/65536 seconds
+}
+
+// RTCPReport is the relevant content of a received compound RTCP packet
+type RTCPReport struct {
+	SenderSSRC uint32
+	IsSR       bool
+	NTPMiddle  uint32 // middle 32 bits of the SR NTP timestamp, used as LSR in our reports
+	Blocks     []ReportBlock
+	IsBYE      bool
+}
+
+// IsRTCP tells RTCP from RTP when both are multiplexed on the same port (RFC 5761)
+func IsRTCP(pkt []byte) bool {
+	return len(pkt) >= 8 && pkt[0]>>6 == 2 && pkt[1] >= 192 && pkt[1] <= 223
+}
+
+// NTPTime returns the 64 bits NTP timestamp of the time
+func NTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// BuildSR builds a compound RTCP packet: a Sender Report (with the report block if any) followed by SDES CNAME
+func BuildSR(ssrc uint32, now time.Time, rtpTS, packets, octets uint32, block *ReportBlock, cname string) []byte {
+	rc := 0
+	if block != nil {
+		rc = 1
+	}
+	pkt := make([]byte, 0, 28+24*rc+12+len(cname))
+	pkt = append(pkt, byte(0x80|rc), RTCPSR)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(6+6*rc))
+	pkt = binary.BigEndian.AppendUint32(pkt, ssrc)
+	pkt = binary.BigEndian.AppendUint64(pkt, NTPTime(now))
+	pkt = binary.BigEndian.AppendUint32(pkt, rtpTS)
+	pkt = binary.BigEndian.AppendUint32(pkt, packets)
+	pkt = binary.BigEndian.AppendUint32(pkt, octets)
+	if block != nil {
+		pkt = appendReportBlock(pkt, block)
+	}
+	return appendSDES(pkt, ssrc, cname)
+}
+
+// BuildRR builds a compound RTCP packet: a Receiver Report followed by SDES CNAME, used when nothing is being sent
+func BuildRR(ssrc uint32, block *ReportBlock, cname string) []byte {
+	rc := 0
+	if block != nil {
+		rc = 1
+	}
+	pkt := make([]byte, 0, 8+24*rc+12+len(cname))
+	pkt = append(pkt, byte(0x80|rc), RTCPRR)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(1+6*rc))
+	pkt = binary.BigEndian.AppendUint32(pkt, ssrc)
+	if block != nil {
+		pkt = appendReportBlock(pkt, block)
+	}
+	return appendSDES(pkt, ssrc, cname)
+}
+
+func appendReportBlock(pkt []byte, rb *ReportBlock) []byte {
+	pkt = binary.BigEndian.AppendUint32(pkt, rb.SSRC)
+	pkt = binary.BigEndian.AppendUint32(pkt, uint32(rb.FractionLost)<<24|rb.CumulativeLost&0xFFFFFF)
+	pkt = binary.BigEndian.AppendUint32(pkt, rb.HighestSeq)
+	pkt = binary.BigEndian.AppendUint32(pkt, rb.Jitter)
+	pkt = binary.BigEndian.AppendUint32(pkt, rb.LSR)
+	return binary.BigEndian.AppendUint32(pkt, rb.DLSR)
+}
+
+func appendSDES(pkt []byte, ssrc uint32, cname string) []byte {
+	cname = cname[:min(len(cname), 255)]
+	// chunk: SSRC, CNAME item, terminating null item, padded to 32 bits
+	chunk := 4 + 2 + len(cname) + 1
+	chunk += (4 - chunk%4) % 4
+	pkt = append(pkt, 0x81, RTCPSDES)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(chunk/4))
+	pkt = binary.BigEndian.AppendUint32(pkt, ssrc)
+	pkt = append(pkt, sdesCNAME, byte(len(cname)))
+	pkt = append(pkt, cname...)
+	return append(pkt, make([]byte, chunk-4-2-len(cname))...)
+}
+
+// ParseRTCP parses a compound RTCP packet, keeping the sender and receiver reports
+func ParseRTCP(pkt []byte) (*RTCPReport, error) {
+	var rpt RTCPReport
+	for len(pkt) > 0 {
+		if len(pkt) < 4 || pkt[0]>>6 != 2 {
+			return nil, errRTCP
+		}
+		count := int(pkt[0] & 0x1F)
+		size := 4 * (int(binary.BigEndian.Uint16(pkt[2:4])) + 1)
+		if size > len(pkt) {
+			return nil, errRTCP
+		}
+		body := pkt[4:size]
+		switch pkt[1] {
+		case RTCPSR:
+			if len(body) < 24+24*count {
+				return nil, errRTCP
+			}
+			rpt.SenderSSRC = binary.BigEndian.Uint32(body[0:4])
+			rpt.IsSR = true
+			rpt.NTPMiddle = binary.BigEndian.Uint32(body[6:10])
+			rpt.Blocks = append(rpt.Blocks, parseReportBlocks(body[24:], count)...)
+		case RTCPRR:
+			if len(body) < 4+24*count {
+				return nil, errRTCP
+			}
+			rpt.SenderSSRC = binary.BigEndian.Uint32(body[0:4])
+			rpt.Blocks = append(rpt.Blocks, parseReportBlocks(body[4:], count)...)
+		case RTCPBYE:
+			rpt.IsBYE = true
+		}
+		pkt = pkt[size:]
+	}
+	return &rpt, nil
+}
+
+func parseReportBlocks(b []byte, count int) []ReportBlock {
+	blocks := make([]ReportBlock, count)
+	for i := range count {
+		rb := b[24*i : 24*(i+1)]
+		blocks[i] = ReportBlock{
+			SSRC:           binary.BigEndian.Uint32(rb[0:4]),
+			FractionLost:   rb[4],
+			CumulativeLost: binary.BigEndian.Uint32(rb[4:8]) & 0xFFFFFF,
+			HighestSeq:     binary.BigEndian.Uint32(rb[8:12]),
+			Jitter:         binary.BigEndian.Uint32(rb[12:16]),
+			LSR:            binary.BigEndian.Uint32(rb[16:20]),
+			DLSR:           binary.BigEndian.Uint32(rb[20:24]),
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,209 @@
+package rtp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Stats keeps the media statistics of a session, fed by the RTP/RTCP sender and receiver (RFC 3550 Appendix A)
+type Stats struct {
+	mu sync.Mutex
+
+	packetsSent uint32
+	octetsSent  uint32
+	lastTS      uint32 // RTP timestamp of the last packet sent
+	lastSent    time.Time
+	reportedAt  uint32 // packets sent at the previous report
+
+	// reception of the remote stream
+	remoteSSRC     uint32
+	started        bool
+	baseSeq        uint16
+	maxSeq         uint16
+	cycles         uint32
+	received       uint32
+	octetsReceived uint64
+	expectedPrior  uint32
+	receivedPrior  uint32
+	transit        int64
+	jitter         float64
+	lastSR         uint32
+	lastSRArrival  time.Time
+
+	// as reported by the remote in its RTCP reports
+	remoteFractionLost uint8
+	remoteLost         uint32
+	remoteJitter       uint32
+	rtt                time.Duration
+	rtcpReceived       int
+}
+
+// StatsReport is a snapshot of the session media statistics
+type StatsReport struct {
+	PacketsSent      uint32
+	OctetsSent       uint32
+	PacketsReceived  uint32
+	OctetsReceived   uint64
+	PacketsLost      int64
+	JitterMs         float64
+	RemoteLostPct    float64 // fraction of our packets lost, as reported by the remote
+	RemotePacketLost uint32
+	RemoteJitterMs   float64
+	RTTMs            float64
+	RTCPReceived     int
+}
+
+func NewStats() *Stats {
+	return &Stats{}
+}
+
+// OnSent accounts a sent RTP packet, ts being its RTP timestamp
+func (st *Stats) OnSent(payloadSize int, ts uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.packetsSent++
+	st.octetsSent += uint32(payloadSize)
+	st.lastTS = ts
+	st.lastSent = time.Now()
+}
+
+// SenderInfo returns the sender counters as carried in a Sender Report, the RTP timestamp being extrapolated to now,
+// and whether packets were sent since the previous call, a Receiver Report being due otherwise (RFC 3550 6.4)
+func (st *Stats) SenderInfo(now time.Time, clockRate int) (packets, octets, ts uint32, sending bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sending = st.packetsSent != st.reportedAt
+	st.reportedAt = st.packetsSent
+	ts = st.lastTS
+	if !st.lastSent.IsZero() {
+		ts += uint32(now.Sub(st.lastSent).Seconds() * float64(clockRate))
+	}
+	return st.packetsSent, st.octetsSent, ts, sending
+}
+
+// OnReceived accounts a received RTP packet, clockRate is the RTP clock of its payload
+func (st *Stats) OnReceived(ssrc uint32, seq uint16, ts uint32, payloadSize int, clockRate int, arrival time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.started || ssrc != st.remoteSSRC {
+		st.remoteSSRC = ssrc
+		st.started = true
+		st.baseSeq = seq
+		st.maxSeq = seq
+		st.cycles = 0
+		st.received = 0
+		st.expectedPrior = 0
+		st.receivedPrior = 0
+		st.transit = 0
+	} else if delta := seq - st.maxSeq; delta < 0x8000 {
+		if seq < st.maxSeq {
+			st.cycles += 1 << 16
+		}
+		st.maxSeq = seq
+	}
+	st.received++
+	st.octetsReceived += uint64(payloadSize)
+
+	// interarrival jitter in timestamp units
+	arrivalTS := arrival.UnixNano() * int64(clockRate) / int64(time.Second)
+	transit := arrivalTS - int64(ts)
+	if st.transit != 0 {
+		d := transit - st.transit
+		if d < 0 {
+			d = -d
+		}
+		st.jitter += (float64(d) - st.jitter) / 16
+	}
+	st.transit = transit
+}
+
+// OnRTCP accounts a received RTCP report, ssrc being ours to pick the report block about our stream
+func (st *Stats) OnRTCP(rpt *RTCPReport, ssrc uint32, arrival time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.rtcpReceived++
+	if rpt.IsSR {
+		st.lastSR = rpt.NTPMiddle
+		st.lastSRArrival = arrival
+	}
+	for _, rb := range rpt.Blocks {
+		if rb.SSRC != ssrc {
+			continue
+		}
+		st.remoteFractionLost = rb.FractionLost
+		st.remoteLost = rb.CumulativeLost
+		st.remoteJitter = rb.Jitter
+		if rb.LSR != 0 {
+			a := uint32(NTPTime(arrival) >> 16)
+			if rtt := a - rb.LSR - rb.DLSR; rtt < 1<<31 {
+				st.rtt = time.Duration(uint64(rtt) * uint64(time.Second) >> 16)
+			}
+		}
+	}
+}
+
+// ReportBlock returns the reception report about the remote stream, nil if nothing was received
+func (st *Stats) ReportBlock(now time.Time) *ReportBlock {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.started {
+		return nil
+	}
+	extMax := st.cycles + uint32(st.maxSeq)
+	expected := extMax - uint32(st.baseSeq) + 1
+	lost := int64(expected) - int64(st.received)
+	lost = max(min(lost, 0x7FFFFF), -0x800000)
+
+	expectedInterval := expected - st.expectedPrior
+	receivedInterval := st.received - st.receivedPrior
+	st.expectedPrior = expected
+	st.receivedPrior = st.received
+	var fraction uint8
+	if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval != 0 && lostInterval > 0 {
+		fraction = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+
+	rb := &ReportBlock{
+		SSRC:           st.remoteSSRC,
+		FractionLost:   fraction,
+		CumulativeLost: uint32(lost) & 0xFFFFFF,
+		HighestSeq:     extMax,
+		Jitter:         uint32(st.jitter),
+	}
+	if !st.lastSRArrival.IsZero() {
+		rb.LSR = st.lastSR
+		rb.DLSR = uint32(now.Sub(st.lastSRArrival) * 65536 / time.Second)
+	}
+	return rb
+}
+
+// Report returns a snapshot of the statistics, clockRate being the RTP clock of the negotiated codec
+func (st *Stats) Report(clockRate int) StatsReport {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rpt := StatsReport{
+		PacketsSent:      st.packetsSent,
+		OctetsSent:       st.octetsSent,
+		PacketsReceived:  st.received,
+		OctetsReceived:   st.octetsReceived,
+		RemoteLostPct:    float64(st.remoteFractionLost) * 100 / 256,
+		RemotePacketLost: st.remoteLost,
+		RTTMs:            float64(st.rtt.Microseconds()) / 1000,
+		RTCPReceived:     st.rtcpReceived,
+	}
+	if st.started {
+		rpt.PacketsLost = int64(st.cycles+uint32(st.maxSeq)-uint32(st.baseSeq)+1) - int64(st.received)
+	}
+	if clockRate > 0 {
+		rpt.JitterMs = st.jitter * 1000 / float64(clockRate)
+		rpt.RemoteJitterMs = float64(st.remoteJitter) * 1000 / float64(clockRate)
+	}
+	return rpt
+}
+
+func (rpt StatsReport) String() string {
+	return fmt.Sprintf("TX: %d pkts/%d bytes, RX: %d pkts/%d bytes, Lost: %d, Jitter: %.1f ms, Remote Lost: %d (%.1f%%), Remote Jitter: %.1f ms, RTT: %.1f ms",
+		rpt.PacketsSent, rpt.OctetsSent, rpt.PacketsReceived, rpt.OctetsReceived, rpt.PacketsLost, rpt.JitterMs,
+		rpt.RemotePacketLost, rpt.RemoteLostPct, rpt.RemoteJitterMs, rpt.RTTMs)
+}
@@ -13,6 +13,8 @@ var (
 
 const (
 	TelephoneEvents = "telephone-event"
+	Opus            = "opus"
+	ComfortNoise    = "CN"
 )
 
 const (
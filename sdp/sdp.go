@@ -108,15 +108,7 @@ func (s *Session) GetEffectiveMediaDirective() string {
 
 func (s *Session) IsCallHeld() bool {
 	media := s.GetChosenMedia()
-	var mode string
-	if media.Mode != "" {
-		mode = media.Mode
-	} else if s.Mode != "" {
-		mode = s.Mode
-	} else {
-		mode = SendRecv
-	}
-	if mode == SendOnly || mode == Inactive {
+	if mode := s.mediaMode(media); mode == SendOnly || mode == Inactive {
 		return true
 	}
 	if ipv4 := s.GetEffectiveConnection(media); ipv4 == "" || ipv4 == "0.0.0.0" {
@@ -125,6 +117,27 @@ func (s *Session) IsCallHeld() bool {
 	return false
 }
 
+// SendsMedia tells whether the owner of the session sends RTP on the chosen media: neither recvonly nor inactive,
+// nor a null connection address
+func (s *Session) SendsMedia() bool {
+	media := s.GetChosenMedia()
+	if mode := s.mediaMode(media); mode == RecvOnly || mode == Inactive {
+		return false
+	}
+	ipv4 := s.GetEffectiveConnection(media)
+	return ipv4 != "" && ipv4 != "0.0.0.0"
+}
+
+func (s *Session) mediaMode(media *Media) string {
+	if media.Mode != "" {
+		return media.Mode
+	}
+	if s.Mode != "" {
+		return s.Mode
+	}
+	return SendRecv
+}
+
 // Origin represents an originator of the session.
 type Origin struct {
 	Username       string
@@ -208,6 +221,20 @@ const (
 	RecvOnly = "recvonly"
 	Inactive = "inactive"
 
+	RTCP    = "rtcp"     //[RFC3605]
+	RTCPMux = "rtcp-mux" //[RFC5761]
+	Crypto  = "crypto"   //[RFC4568]
+
+	ICELite         = "ice-lite"          //[RFC8839]
+	ICEUfrag        = "ice-ufrag"         //[RFC8839]
+	ICEPwd          = "ice-pwd"           //[RFC8839]
+	Candidate       = "candidate"         //[RFC8839]
+	EndOfCandidates = "end-of-candidates" //[RFC8840]
+	Fingerprint     = "fingerprint"       //[RFC8122]
+	Setup           = "setup"             //[RFC4145]
+	MID             = "mid"               //[RFC5888]
+	Group           = "group"             //[RFC5888]
+
 	Audio       = "audio"       //[RFC8866]
 	Video       = "video"       //[RFC8866]
 	Text        = "text"        //[RFC8866]
@@ -335,6 +362,25 @@ func (f *Format) String() string {
 	return f.Name
 }
 
+// Param returns the value of a "fmtp" parameter by name (case insensitive)
+func (f *Format) Param(name string) (string, bool) {
+	for _, it := range f.Params {
+		for _, p := range strings.Split(it, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, name) {
+				return strings.TrimSpace(v), true
+			}
+		}
+	}
+	return "", false
+}
+
+// IsAnnexBEnabled reports whether G.729 Annex B is in use - "annexb" defaults to yes when absent (RFC 4856)
+func (f *Format) IsAnnexBEnabled() bool {
+	v, ok := f.Param("annexb")
+	return !ok || strings.EqualFold(v, "yes")
+}
+
 var epoch = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
 
 func isRTP(media, proto string) bool {
@@ -0,0 +1,340 @@
+package sip
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"mrfgo/cl"
+	. "mrfgo/global"
+	"mrfgo/q850"
+	"mrfgo/sip/status"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access control of new INVITEs: calls from a trusted peer are accepted within its CPS and concurrent calls limits,
+// other sources must authenticate with digest credentials (RFC 3261 §22, qop=auth) when users are configured, and are
+// rejected with 403 otherwise. Without trusted peers nor users, every source is accepted.
+//
+// Trusted peer syntax: "networks=<IP or CIDR>[,...] [cps=<calls per second>] [calls=<concurrent calls>]", no limit when 0.
+// Authentication syntax: "users=<user>:<password>[,...] [realm=<realm>] [challenge=401|407]".
+
+type TrustedPeer struct {
+	Name     string
+	networks []*net.IPNet
+	cps      int
+	calls    int
+	limiter  *cl.CallLimiter
+
+	mu     sync.Mutex
+	active int
+}
+
+type SIPAuth struct {
+	realm     string
+	users     map[string]string
+	challenge int // 401 or 407
+}
+
+const nonceLifetime = 5 * time.Minute
+
+var (
+	TrustedPeers   []*TrustedPeer
+	DefaultSIPAuth *SIPAuth // nil without users
+
+	nonceSecret = make([]byte, 32)
+	nonceCounts = make(map[string]uint64) // highest nc accepted per nonce, against replays
+	nonceMu     sync.Mutex
+)
+
+func NewTrustedPeer(name, text string) (*TrustedPeer, error) {
+	peer := &TrustedPeer{Name: name}
+	for _, field := range strings.Fields(text) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "networks":
+			for _, cidr := range strings.Split(value, ",") {
+				cidr = strings.TrimSpace(cidr)
+				if !strings.Contains(cidr, "/") {
+					cidr += "/32"
+				}
+				_, ipnet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, err
+				}
+				peer.networks = append(peer.networks, ipnet)
+			}
+		case "cps", "calls":
+			limit, ok := Str2IntCheck[int](value)
+			if !ok || limit < 0 {
+				return nil, fmt.Errorf("invalid %s [%s]", key, value)
+			}
+			if strings.EqualFold(key, "cps") {
+				peer.cps = limit
+			} else {
+				peer.calls = limit
+			}
+		default:
+			return nil, fmt.Errorf("unknown field [%s]", key)
+		}
+	}
+	if len(peer.networks) == 0 {
+		return nil, fmt.Errorf("no network")
+	}
+	return peer, nil
+}
+
+func (peer *TrustedPeer) String() string {
+	nets := make([]string, len(peer.networks))
+	for i, n := range peer.networks {
+		nets[i] = n.String()
+	}
+	return fmt.Sprintf("%s (%s, cps %d, calls %d)", peer.Name, strings.Join(nets, ", "), peer.cps, peer.calls)
+}
+
+func NewSIPAuth(text string) (*SIPAuth, error) {
+	auth := &SIPAuth{realm: "mrfgo", users: make(map[string]string), challenge: status.Unauthorized}
+	for _, field := range strings.Fields(text) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "realm":
+			auth.realm = value
+		case "users":
+			for _, cred := range strings.Split(value, ",") {
+				user, password, ok := strings.Cut(cred, ":")
+				if !ok || user == "" {
+					return nil, fmt.Errorf("invalid credentials [%s]", user)
+				}
+				auth.users[user] = password
+			}
+		case "challenge":
+			switch value {
+			case "401":
+				auth.challenge = status.Unauthorized
+			case "407":
+				auth.challenge = status.ProxyAuthenticationRequired
+			default:
+				return nil, fmt.Errorf("invalid challenge [%s]", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown field [%s]", key)
+		}
+	}
+	if len(auth.users) == 0 {
+		return nil, fmt.Errorf("no user")
+	}
+	return auth, nil
+}
+
+func (auth *SIPAuth) String() string {
+	return fmt.Sprintf("realm %s, %d users, challenge %d", auth.realm, len(auth.users), auth.challenge)
+}
+
+func initAccessControl() {
+	_, _ = rand.Read(nonceSecret)
+	if SIPAuthGlobal != "" {
+		if auth, err := NewSIPAuth(SIPAuthGlobal); err != nil {
+			LogWarning(LTConfiguration, fmt.Sprintf("SIP authentication ignored - %v", err))
+		} else {
+			DefaultSIPAuth = auth
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(TrustedPeersConfig)) {
+		peer, err := NewTrustedPeer(name, TrustedPeersConfig[name])
+		if err != nil {
+			LogWarning(LTConfiguration, fmt.Sprintf("Trusted peer [%s] ignored - %v", name, err))
+			continue
+		}
+		rate := peer.cps
+		if rate == 0 {
+			rate = -1
+		}
+		peer.limiter = cl.NewCallLimiter(rate, nil, &WtGrp)
+		TrustedPeers = append(TrustedPeers, peer)
+	}
+}
+
+func trustedPeer(ip net.IP) *TrustedPeer {
+	for _, peer := range TrustedPeers {
+		for _, n := range peer.networks {
+			if n.Contains(ip) {
+				return peer
+			}
+		}
+	}
+	return nil
+}
+
+// checkAccess admits a new INVITE from src, or sets the response rejecting it
+func (ss *SipSession) checkAccess(sipmsg *SipMessage, src *net.UDPAddr) bool {
+	if peer := trustedPeer(src.IP); peer != nil {
+		switch {
+		case !peer.limiter.AcceptNewCall():
+			ss.denyAccess(sipmsg, src, peer.Name, "peer_cps", NewResponsePackSIPQ850Details(status.ServiceUnavailable, q850.NoCircuitChannelAvailable, "Peer call rate exceeded"))
+			return false
+		case !peer.acquire():
+			ss.denyAccess(sipmsg, src, peer.Name, "peer_calls", NewResponsePackSIPQ850Details(status.ServiceUnavailable, q850.NoCircuitChannelAvailable, "Peer concurrent calls exceeded"))
+			return false
+		}
+		ss.trustedPeer = peer
+		return true
+	}
+	auth := DefaultSIPAuth
+	if auth == nil {
+		if len(TrustedPeers) == 0 {
+			return true
+		}
+		ss.denyAccess(sipmsg, src, "", "untrusted", NewResponsePackSIPQ850Details(status.Forbidden, q850.CallRejected, "Source not allowed"))
+		return false
+	}
+	credentials := sipmsg.Headers.ValueHeader(Authorization)
+	if auth.challenge == status.ProxyAuthenticationRequired {
+		credentials = sipmsg.Headers.ValueHeader(Proxy_Authorization)
+	}
+	switch user, result := auth.verify(INVITE, credentials); result {
+	case authOK:
+		LogInfo(LTSecurity, fmt.Sprintf("Call-ID [%s] - INVITE from %s authenticated as [%s]", sipmsg.CallID, src, user))
+		return true
+	case authMissing:
+		ss.denyAccess(sipmsg, src, "", "challenged", auth.challengeResponse(false))
+	case authStale:
+		ss.denyAccess(sipmsg, src, "", "stale_nonce", auth.challengeResponse(true))
+	default:
+		ss.denyAccess(sipmsg, src, "", "bad_credentials", NewResponsePackSIPQ850Details(status.Forbidden, q850.CallRejected, "Invalid credentials"))
+	}
+	return false
+}
+
+func (ss *SipSession) denyAccess(sipmsg *SipMessage, src *net.UDPAddr, peer, reason string, pack ResponsePack) {
+	ss.rejection = pack
+	Prometrics.AccessRejections.WithLabelValues(reason, peer).Inc()
+	if reason != "challenged" {
+		LogWarning(LTSecurity, fmt.Sprintf("Call-ID [%s] - INVITE from %s rejected (%d) - %s - User-Agent [%s]", sipmsg.CallID, src, pack.StatusCode, reason, sipmsg.Headers.ValueHeader(User_Agent)))
+	}
+}
+
+func (peer *TrustedPeer) acquire() bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.calls != 0 && peer.active >= peer.calls {
+		return false
+	}
+	peer.active++
+	return true
+}
+
+func (peer *TrustedPeer) release() {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.active--
+}
+
+// ==================================================================
+// Digest authentication of the received requests
+
+type authResult int
+
+const (
+	authOK authResult = iota
+	authMissing
+	authStale
+	authFailed
+)
+
+// newNonce returns a nonce made of its creation time, random bytes so that each challenge has its own nonce count, and
+// a MAC of them, so it is checked without being stored
+func newNonce() string {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint64(raw, uint64(time.Now().Unix()))
+	_, _ = rand.Read(raw[8:])
+	return hex.EncodeToString(raw) + hex.EncodeToString(nonceMAC(raw))
+}
+
+func nonceMAC(raw []byte) []byte {
+	mac := hmac.New(sha256.New, nonceSecret)
+	mac.Write(raw)
+	return mac.Sum(nil)[:16]
+}
+
+// checkNonce returns whether the nonce was issued by us, and whether it is still valid
+func checkNonce(nonce string) (bool, bool) {
+	raw, err := hex.DecodeString(nonce)
+	if err != nil || len(raw) != 32 || !hmac.Equal(raw[16:], nonceMAC(raw[:16])) {
+		return false, false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return true, time.Since(issued) < nonceLifetime
+}
+
+// acceptNonceCount records the nonce count of a verified request, refusing those already used
+func acceptNonceCount(nonce string, nc uint64) bool {
+	nonceMu.Lock()
+	defer nonceMu.Unlock()
+	if nc <= nonceCounts[nonce] {
+		return false
+	}
+	if _, ok := nonceCounts[nonce]; !ok {
+		for n := range nonceCounts {
+			if _, valid := checkNonce(n); !valid {
+				delete(nonceCounts, n)
+			}
+		}
+	}
+	nonceCounts[nonce] = nc
+	return true
+}
+
+func (auth *SIPAuth) challengeResponse(stale bool) ResponsePack {
+	value := fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=MD5, qop="auth"`, auth.realm, newNonce())
+	if stale {
+		value += ", stale=true"
+	}
+	pack := ResponsePack{StatusCode: auth.challenge, CustomHeaders: NewSipHeaders()}
+	if auth.challenge == status.ProxyAuthenticationRequired {
+		pack.CustomHeaders.AddHeader(Proxy_Authenticate, value)
+	} else {
+		pack.CustomHeaders.AddHeader(WWW_Authenticate, value)
+	}
+	return pack
+}
+
+// verify checks the credentials of a request, qop=auth being required
+func (auth *SIPAuth) verify(m Method, credentials string) (string, authResult) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(credentials), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return "", authMissing
+	}
+	p := parseAuthParams(params)
+	user, nonce := p["username"], p["nonce"]
+	if p["realm"] != auth.realm {
+		return user, authMissing
+	}
+	issued, valid := checkNonce(nonce)
+	if !issued {
+		return user, authMissing
+	}
+	password, known := auth.users[user]
+	nc, err := strconv.ParseUint(p["nc"], 16, 64)
+	if !known || err != nil || !strings.EqualFold(p["qop"], "auth") || (p["algorithm"] != "" && !strings.EqualFold(p["algorithm"], "MD5")) {
+		return user, authFailed
+	}
+	expected := digestResponse(m.String(), p["uri"], user, auth.realm, password, nonce, p["nc"], p["cnonce"])
+	switch {
+	case subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(p["response"]))) != 1:
+		return user, authFailed
+	case !valid:
+		return user, authStale
+	case !acceptNonceCount(nonce, nc):
+		return user, authStale
+	}
+	return user, authOK
+}
@@ -0,0 +1,51 @@
+package sip
+
+import (
+	"mrfgo/rtp"
+	"sync"
+	"time"
+)
+
+// CallRecord is the summary of an ended call, with its media statistics
+type CallRecord struct {
+	CallID    string
+	Direction string
+	Mode      string
+	State     string
+	Ended     time.Time
+	Media     *rtp.StatsReport `json:",omitempty"` // calls with SDP only
+}
+
+const maxCallRecords = 1000
+
+var (
+	callRecords     = make([]CallRecord, 0, maxCallRecords)
+	callRecordsNext int // oldest record once the ring is full
+	callRecordsMu   sync.Mutex
+)
+
+// addCallRecord records the end of the call, from DropMe - multiUseMutex held
+func (ss *SipSession) addCallRecord() {
+	rec := CallRecord{CallID: ss.CallID, Direction: ss.Direction.String(), Mode: string(ss.Mode), State: ss.state.String(), Ended: time.Now()}
+	if ss.LocalSDP != nil {
+		stats := ss.MediaStats()
+		rec.Media = &stats
+	}
+	callRecordsMu.Lock()
+	defer callRecordsMu.Unlock()
+	if len(callRecords) < maxCallRecords {
+		callRecords = append(callRecords, rec)
+		return
+	}
+	callRecords[callRecordsNext] = rec
+	callRecordsNext = (callRecordsNext + 1) % maxCallRecords
+}
+
+// CallRecords returns the records of the last ended calls, oldest first
+func CallRecords() []CallRecord {
+	callRecordsMu.Lock()
+	defer callRecordsMu.Unlock()
+	lst := make([]CallRecord, 0, len(callRecords))
+	lst = append(lst, callRecords[callRecordsNext:]...)
+	return append(lst, callRecords[:callRecordsNext]...)
+}
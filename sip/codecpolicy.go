@@ -0,0 +1,105 @@
+package sip
+
+import (
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/rtp"
+	"strings"
+)
+
+// CodecPreference ranks and filters the offered codecs.
+//
+// Syntax: codecs separated by '>' or ',' in order of preference, e.g. "G722>PCMA>PCMU".
+// A codec is a name (PCMU, PCMA, G722, G729, OPUS) or a static payload type number.
+// '*' stands for any other codec (in the order offered); without it the policy restricts to the listed codecs.
+// '!' forbids a codec, e.g. "*,!G729".
+type CodecPreference struct {
+	text      string
+	rank      map[uint8]int
+	forbidden map[uint8]bool
+	wildcard  int // rank of unlisted codecs, -1 if not allowed
+}
+
+var (
+	codecPolicyNames = map[string]uint8{"pcmu": rtp.PCMU, "pcma": rtp.PCMA, "g722": rtp.G722, "g729": rtp.G729, "opus": rtp.OPUS}
+
+	// variants sharing a policy entry with their base codec
+	codecPolicyVariants = map[uint8]uint8{rtp.G729B: rtp.G729, rtp.OPUSFEC: rtp.OPUS}
+
+	DefaultCodecPreference = &CodecPreference{text: "*", wildcard: 0}
+)
+
+func NewCodecPreference(text string) (*CodecPreference, error) {
+	cp := &CodecPreference{text: text, rank: make(map[uint8]int), forbidden: make(map[uint8]bool), wildcard: -1}
+	tokens := strings.FieldsFunc(text, func(r rune) bool { return r == '>' || r == ',' })
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty codec policy")
+	}
+	var mtch []string
+	for i, tkn := range tokens {
+		tkn = strings.TrimSpace(tkn)
+		if !RMatch(tkn, CodecPolicy, &mtch) {
+			return nil, fmt.Errorf("invalid codec policy entry [%s]", tkn)
+		}
+		if mtch[2] == "*" {
+			if mtch[1] != "" {
+				return nil, fmt.Errorf("invalid codec policy entry [%s]", tkn)
+			}
+			cp.wildcard = i
+			continue
+		}
+		codec, ok := codecPolicyNames[ASCIIToLower(mtch[2])]
+		if !ok {
+			pt := Str2Int[int](mtch[2])
+			if pt != int(rtp.PCMU) && pt != int(rtp.PCMA) && pt != int(rtp.G722) && pt != int(rtp.G729) {
+				return nil, fmt.Errorf("unsupported codec in policy [%s]", tkn)
+			}
+			codec = uint8(pt)
+		}
+		if mtch[1] != "" {
+			cp.forbidden[codec] = true
+			continue
+		}
+		if _, ok := cp.rank[codec]; !ok {
+			cp.rank[codec] = i
+		}
+	}
+	if len(cp.rank) == 0 && cp.wildcard == -1 {
+		return nil, fmt.Errorf("codec policy [%s] allows no codec", text)
+	}
+	return cp, nil
+}
+
+func (cp *CodecPreference) String() string {
+	return cp.text
+}
+
+// Rank returns the preference of the codec (lower is better) and whether it is allowed at all
+func (cp *CodecPreference) Rank(codec uint8) (int, bool) {
+	if base, ok := codecPolicyVariants[codec]; ok {
+		codec = base
+	}
+	if cp.forbidden[codec] {
+		return 0, false
+	}
+	if r, ok := cp.rank[codec]; ok {
+		return r, true
+	}
+	return cp.wildcard, cp.wildcard != -1
+}
+
+func initCodecPolicies() {
+	initRoutePolicy("Codec policy", CodecPolicyGlobal, CodecPolicyRoutes, NewCodecPreference,
+		func(cp *CodecPreference) { DefaultCodecPreference = cp },
+		func(repo *MRFRepo, cp *CodecPreference) error {
+			repo.codecPolicy = cp
+			return nil
+		})
+}
+
+func (ss *SipSession) codecPolicy() *CodecPreference {
+	if ss.MRFRepo != nil && ss.MRFRepo.codecPolicy != nil {
+		return ss.MRFRepo.codecPolicy
+	}
+	return DefaultCodecPreference
+}
@@ -0,0 +1,175 @@
+package sip
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/q850"
+	"mrfgo/rtp"
+	"mrfgo/sdp"
+	"mrfgo/sip/status"
+	"mrfgo/srtp"
+	"slices"
+)
+
+// Delayed offer (RFC 3261 §13.2.1, RFC 3264): an INVITE or re-INVITE without SDP is answered by a 2xx carrying our offer,
+// and the answer comes in the ACK. The offer lists all the codecs allowed by the route codec policy, so that a re-INVITE
+// sent after a transfer can renegotiate with a far end supporting other codecs. Media goes on with the current parameters
+// until the answer is applied; an unacceptable or missing answer releases the call.
+
+var offerCodecs = []uint8{rtp.OPUS, rtp.G722, rtp.PCMA, rtp.PCMU, rtp.G729} // in the order used for the policy wildcard
+
+const (
+	offerOpusPayload   uint8 = 111
+	offerDTMFPayload   uint8 = 101 // telephone-event/8000
+	offerDTMFWBPayload uint8 = 110 // telephone-event/48000, along with Opus
+)
+
+var offerCodecNames = map[uint8]string{rtp.PCMU: "PCMU", rtp.PCMA: "PCMA", rtp.G722: "G722", rtp.G729: "G729"}
+
+// buildSDPOffer builds the local offer sent in the 2xx to an INVITE without SDP
+func (ss *SipSession) buildSDPOffer() (sipcode, q850code int, warn string) {
+	if ss.webrtc != nil {
+		// ICE and DTLS roles cannot be restarted from our side
+		sipcode = status.NotAcceptableHere
+		q850code = q850.BearerCapabilityNotImplemented
+		warn = "Not supported delayed offer with ICE/DTLS"
+		return
+	}
+
+	policy := ss.codecPolicy()
+	codecs := make([]uint8, 0, len(offerCodecs))
+	ranks := make(map[uint8]int, len(offerCodecs))
+	for _, codec := range offerCodecs {
+		if rank, ok := policy.Rank(codec); ok && rtp.IsCodecAvailable(codec) {
+			codecs = append(codecs, codec)
+			ranks[codec] = rank
+		}
+	}
+	if len(codecs) == 0 {
+		sipcode = status.NotAcceptableHere
+		q850code = q850.IncompatibleDestination
+		warn = "No audio codec allowed for the offer"
+		return
+	}
+	slices.SortStableFunc(codecs, func(a, b uint8) int { return ranks[a] - ranks[b] })
+
+	if !ss.reserveMedia() {
+		sipcode = status.NotAcceptableHere
+		q850code = q850.ResourceUnavailableUnspecified
+		warn = "Media pool depleted"
+		return
+	}
+
+	media := &sdp.Media{
+		Type:       "audio",
+		Port:       GetUDPortFromConn(ss.MediaListener),
+		Proto:      sdp.RtpAvp,
+		Attributes: []*sdp.Attr{{Name: "ptime", Value: "20"}, sdp.NewAttrFlag(sdp.RTCPMux)},
+		Mode:       sdp.SendRecv,
+	}
+	var narrowband, opus, genericCN bool
+	for _, codec := range codecs {
+		if rtp.IsOpus(codec) {
+			opus = true
+			media.Format = append(media.Format, answerFormat(&sdp.Format{Payload: offerOpusPayload}, codec))
+			continue
+		}
+		narrowband = true
+		genericCN = genericCN || withGenericCN(codec)
+		media.Format = append(media.Format, &sdp.Format{Payload: codec, Name: offerCodecNames[codec], ClockRate: 8000, Channels: 1})
+	}
+	if narrowband {
+		media.Format = append(media.Format, &sdp.Format{Payload: offerDTMFPayload, Name: sdp.TelephoneEvents, ClockRate: 8000, Params: []string{"0-16"}})
+	}
+	if opus {
+		media.Format = append(media.Format, &sdp.Format{Payload: offerDTMFWBPayload, Name: sdp.TelephoneEvents, ClockRate: rtp.OpusClockRate, Params: []string{"0-16"}})
+	}
+	if genericCN {
+		media.Format = append(media.Format, &sdp.Format{Payload: rtp.CN, Name: sdp.ComfortNoise, ClockRate: 8000, Channels: 1})
+	}
+
+	// SDES is offered when required, or kept when already in use
+	if ss.srtpPolicy() == SRTPMandatory || ss.srtpTx.Load() != nil {
+		cryptoAttr, err := ss.offerSRTP()
+		if err != nil {
+			sipcode = status.NotAcceptableHere
+			q850code = q850.ResourceUnavailableUnspecified
+			warn = "SRTP setup failed"
+			return
+		}
+		media.Proto = sdp.RtpSavp
+		media.Attributes = append(media.Attributes, cryptoAttr)
+	}
+
+	mySDP := ss.newLocalSDP()
+	mySDP.Media = []*sdp.Media{media}
+	if ss.LocalSDP != nil && !mySDP.Equals(ss.LocalSDP) {
+		ss.SDPSessionVersion += 1
+		mySDP.Origin.SessionVersion = ss.SDPSessionVersion
+	}
+	ss.LocalSDP = mySDP
+	ss.sdpAnswerPending = true
+	return
+}
+
+// offerSRTP returns the a=crypto attribute of the offer - the sending context is kept if one exists, and is used
+// once the answer provides the remote key
+func (ss *SipSession) offerSRTP() (*sdp.Attr, error) {
+	suite := srtp.Suites()[0]
+	if ss.srtpTx.Load() == nil {
+		keySalt := make([]byte, srtp.MasterKeyLen+srtp.MasterSaltLen)
+		if _, err := rand.Read(keySalt); err != nil {
+			return nil, err
+		}
+		tx, err := srtp.NewContext(suite, keySalt)
+		if err != nil {
+			return nil, err
+		}
+		ss.srtpTx.Store(tx)
+		ss.srtpSuite = suite
+		ss.srtpLocalKey = base64.StdEncoding.EncodeToString(keySalt)
+	}
+	return sdp.NewAttr(sdp.Crypto, fmt.Sprintf("1 %s inline:%s", ss.srtpSuite, ss.srtpLocalKey)), nil
+}
+
+// applySDPAnswer applies the answer received in the ACK to our offer
+func (ss *SipSession) applySDPAnswer(sipmsg *SipMessage) (sipcode, q850code int, warn string) {
+	ss.sdpAnswerPending = false
+	if !sipmsg.Body.ContainsSDP() {
+		sipcode = status.NotAcceptableHere
+		q850code = q850.MandatoryInformationElementIsMissing
+		warn = "No SDP answer in ACK"
+		return
+	}
+	// the answer is processed as an offer would be, restricted to what we offered - our offer stays the local SDP
+	offer, version := ss.LocalSDP, ss.SDPSessionVersion
+	sipcode, q850code, warn = ss.buildSDPAnswer(sipmsg)
+	ss.LocalSDP, ss.SDPSessionVersion = offer, version
+	if sipcode == 0 && !ss.isOfferedPayload(ss.rtpPayloadType) {
+		sipcode = status.NotAcceptableHere
+		q850code = q850.IncompatibleDestination
+		warn = "Answered codec not offered"
+	}
+	return
+}
+
+// acceptSDPAnswer applies the answer received in the ACK, or releases the call when it is unacceptable
+func (ss *SipSession) acceptSDPAnswer(sipmsg *SipMessage) bool {
+	sc, qc, wr := ss.applySDPAnswer(sipmsg)
+	if sc == 0 {
+		return true
+	}
+	LogWarning(LTSDPStack, fmt.Sprintf("Call-ID [%s] - SDP answer in ACK rejected (%d) - %s", ss.CallID, sc, wr))
+	ss.ReleaseMeDetailed(qc, wr)
+	return false
+}
+
+// isOfferedPayload tells whether the payload type is one of our offer
+func (ss *SipSession) isOfferedPayload(pt uint8) bool {
+	if ss.LocalSDP == nil || len(ss.LocalSDP.Media) == 0 {
+		return false
+	}
+	return slices.ContainsFunc(ss.LocalSDP.Media[0].Format, func(f *sdp.Format) bool { return f.Payload == pt })
+}
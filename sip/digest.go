@@ -0,0 +1,135 @@
+package sip
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	. "mrfgo/global"
+	"strings"
+)
+
+// DigestChallenge is a WWW-Authenticate or Proxy-Authenticate challenge (RFC 2617, RFC 3261 §22), only MD5 being supported
+type DigestChallenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string
+	QOP       string // "auth" when offered, empty otherwise
+	Stale     bool
+
+	nc uint32 // requests answered with the nonce
+}
+
+// parseDigestChallenge parses the value of a WWW-Authenticate or Proxy-Authenticate header
+func parseDigestChallenge(value string) (*DigestChallenge, bool) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, false
+	}
+	ch := &DigestChallenge{}
+	for key, val := range parseAuthParams(params) {
+		switch key {
+		case "realm":
+			ch.Realm = val
+		case "nonce":
+			ch.Nonce = val
+		case "opaque":
+			ch.Opaque = val
+		case "algorithm":
+			ch.Algorithm = val
+		case "qop":
+			for _, q := range strings.Split(val, ",") {
+				if strings.EqualFold(strings.TrimSpace(q), "auth") {
+					ch.QOP = "auth"
+				}
+			}
+		case "stale":
+			ch.Stale = strings.EqualFold(val, "true")
+		}
+	}
+	if ch.Nonce == "" || (ch.Algorithm != "" && !strings.EqualFold(ch.Algorithm, "MD5")) {
+		return nil, false
+	}
+	return ch, true
+}
+
+// parseAuthParams parses comma separated auth-params, unquoting the quoted values - names are in lower case
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, ", \t") {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = ASCIIToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				break
+			}
+			val, s = rest[1:end+1], rest[end+2:]
+		} else {
+			val, s, _ = strings.Cut(rest, ",")
+			val = strings.TrimSpace(val)
+		}
+		params[key] = val
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func newCNonce() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// digestResponse returns the MD5 request-digest (RFC 2617 §3.2.2.1), with qop=auth when nc is given
+func digestResponse(method, uri, username, realm, password, nonce, nc, cnonce string) string {
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", username, realm, password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, uri))
+	if nc == "" {
+		return md5Hex(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
+	}
+	return md5Hex(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, nonce, nc, cnonce, ha2))
+}
+
+// Authorization returns the Authorization or Proxy-Authorization value answering the challenge for a request, the nonce
+// count being incremented at each call so that the challenge can be reused - it is not safe for concurrent use
+func (ch *DigestChallenge) Authorization(m Method, uri, username, password string) string {
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5`, username, ch.Realm, ch.Nonce, uri)
+	if ch.QOP == "" {
+		auth += fmt.Sprintf(`, response="%s"`, digestResponse(m.String(), uri, username, ch.Realm, password, ch.Nonce, "", ""))
+	} else {
+		ch.nc++
+		nc := fmt.Sprintf("%08x", ch.nc)
+		cnonce := newCNonce()
+		auth += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, digestResponse(m.String(), uri, username, ch.Realm, password, ch.Nonce, nc, cnonce))
+	}
+	if ch.Opaque != "" {
+		auth += fmt.Sprintf(`, opaque="%s"`, ch.Opaque)
+	}
+	return auth
+}
+
+// digestChallenge returns the challenge of a 401 or 407 response, and the header to answer it with
+func (sipmsg *SipMessage) digestChallenge() (*DigestChallenge, HeaderEnum, bool) {
+	hdr, answer := WWW_Authenticate, Authorization
+	if sipmsg.StartLine.StatusCode == 407 {
+		hdr, answer = Proxy_Authenticate, Proxy_Authorization
+	}
+	_, values := sipmsg.Headers.ValuesHeader(hdr)
+	for _, value := range values {
+		if ch, ok := parseDigestChallenge(value); ok {
+			return ch, answer, true
+		}
+	}
+	return nil, answer, false
+}
@@ -0,0 +1,91 @@
+package sip
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	. "mrfgo/global"
+	"testing"
+	"time"
+)
+
+// TestDigestResponse checks the request-digest against the example of RFC 2617 §3.5
+func TestDigestResponse(t *testing.T) {
+	got := digestResponse("GET", "/dir/index.html", "Mufasa", "testrealm@host.com", "Circle Of Life", "dcd98b7102dd2f0e8b11d0f600bfb0c093", "00000001", "0a4f113b")
+	if want := "6629fae49393a05397450978507c4ef1"; got != want {
+		t.Errorf("response = %s, want %s", got, want)
+	}
+}
+
+func newTestAuth(t *testing.T) *SIPAuth {
+	t.Helper()
+	auth, err := NewSIPAuth("users=alice:secret,bob:pw realm=mrfgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+// TestDigestRoundTrip answers our challenge and verifies the credentials, each nonce count being accepted once
+func TestDigestRoundTrip(t *testing.T) {
+	auth := newTestAuth(t)
+	if a, b := newNonce(), newNonce(); a == b {
+		t.Fatalf("two challenges share the nonce %s", a)
+	}
+	pack := auth.challengeResponse(false)
+	ch, ok := parseDigestChallenge(pack.CustomHeaders.ValueHeader(WWW_Authenticate))
+	if !ok || ch.Realm != "mrfgo" || ch.QOP != "auth" {
+		t.Fatalf("challenge = %+v, %v", ch, ok)
+	}
+	first := ch.Authorization(INVITE, "sip:ivr@10.0.0.1", "alice", "secret")
+	second := ch.Authorization(INVITE, "sip:ivr@10.0.0.1", "alice", "secret")
+	for _, tc := range []struct {
+		name        string
+		credentials string
+		want        authResult
+	}{
+		{"first use", first, authOK},
+		{"next nonce count", second, authOK},
+		{"replayed nonce count", second, authStale},
+		{"older nonce count", first, authStale},
+	} {
+		if user, got := auth.verify(INVITE, tc.credentials); got != tc.want || user != "alice" {
+			t.Errorf("%s: verify = %q, %d, want %q, %d", tc.name, user, got, "alice", tc.want)
+		}
+	}
+}
+
+// nonceIssued returns a nonce of ours issued at the given time
+func nonceIssued(at time.Time) string {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint64(raw, uint64(at.Unix()))
+	return hex.EncodeToString(raw) + hex.EncodeToString(nonceMAC(raw))
+}
+
+func TestDigestVerify(t *testing.T) {
+	auth := newTestAuth(t)
+	answer := func(realm, nonce, qop string, m Method, user, password string) string {
+		ch := &DigestChallenge{Realm: realm, Nonce: nonce, QOP: qop}
+		return ch.Authorization(m, "sip:ivr@10.0.0.1", user, password)
+	}
+	for _, tc := range []struct {
+		name        string
+		credentials string
+		want        authResult
+	}{
+		{"no credentials", "", authMissing},
+		{"other scheme", `Basic YWxpY2U6c2VjcmV0`, authMissing},
+		{"valid", answer("mrfgo", newNonce(), "auth", INVITE, "bob", "pw"), authOK},
+		{"wrong realm", answer("other", newNonce(), "auth", INVITE, "alice", "secret"), authMissing},
+		{"nonce not ours", answer("mrfgo", "dcd98b7102dd2f0e8b11d0f600bfb0c093", "auth", INVITE, "alice", "secret"), authMissing},
+		{"stale nonce", answer("mrfgo", nonceIssued(time.Now().Add(-nonceLifetime-time.Minute)), "auth", INVITE, "alice", "secret"), authStale},
+		{"stale nonce, wrong password", answer("mrfgo", nonceIssued(time.Now().Add(-nonceLifetime-time.Minute)), "auth", INVITE, "alice", "guess"), authFailed},
+		{"wrong password", answer("mrfgo", newNonce(), "auth", INVITE, "alice", "guess"), authFailed},
+		{"unknown user", answer("mrfgo", newNonce(), "auth", INVITE, "carol", "secret"), authFailed},
+		{"without qop", answer("mrfgo", newNonce(), "", INVITE, "alice", "secret"), authFailed},
+		{"other method", answer("mrfgo", newNonce(), "auth", BYE, "alice", "secret"), authFailed},
+	} {
+		if _, got := auth.verify(INVITE, tc.credentials); got != tc.want {
+			t.Errorf("%s: verify = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package sip
+
+import (
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/sip/status"
+	"strings"
+)
+
+// EarlyMedia plays an announcement before answer: the SDP answer is sent in a 183 Session Progress (reliably when the
+// caller supports 100rel), the prompt is streamed in the early dialogue, then the call is either rejected, so that the
+// caller is not charged, or answered.
+//
+// Syntax: "prompt=<audio key> then=answer" or "prompt=<audio key> then=reject:<SIP code> [cause=<Q.850 cause>]",
+// "off" disables it. The Q.850 cause goes in the Reason header of the rejection, a Warning header is sent without it.
+type EarlyMedia struct {
+	text     string
+	prompt   string // empty when off
+	answer   bool
+	sipCode  int
+	q850Code int
+}
+
+var DefaultEarlyMedia = &EarlyMedia{text: "off"}
+
+func NewEarlyMedia(text string) (*EarlyMedia, error) {
+	em := &EarlyMedia{text: text}
+	if strings.EqualFold(strings.TrimSpace(text), "off") {
+		return em, nil
+	}
+	var then string
+	for _, field := range strings.Fields(text) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "prompt":
+			em.prompt = value
+		case "then":
+			then = value
+		case "cause":
+			cause, ok := Str2IntCheck[int](value)
+			if !ok || cause < 1 || cause > 127 {
+				return nil, fmt.Errorf("invalid Q.850 cause [%s]", value)
+			}
+			em.q850Code = cause
+		default:
+			return nil, fmt.Errorf("unknown field [%s]", key)
+		}
+	}
+	if em.prompt == "" {
+		return nil, fmt.Errorf("no prompt")
+	}
+	action, code, _ := strings.Cut(then, ":")
+	switch strings.ToLower(action) {
+	case "answer":
+		em.answer = true
+		if em.q850Code != 0 {
+			return nil, fmt.Errorf("cause given without rejection")
+		}
+	case "reject":
+		sc, ok := Str2IntCheck[int](code)
+		if !ok || sc < 400 || sc > 699 {
+			return nil, fmt.Errorf("invalid SIP rejection code [%s]", code)
+		}
+		em.sipCode = sc
+	default:
+		return nil, fmt.Errorf("invalid action [%s]", then)
+	}
+	return em, nil
+}
+
+func (em *EarlyMedia) String() string {
+	return em.text
+}
+
+func initEarlyMediaPolicies() {
+	initRoutePolicy("Early media", EarlyMediaGlobal, EarlyMediaRoutes, NewEarlyMedia,
+		func(em *EarlyMedia) { DefaultEarlyMedia = em },
+		func(repo *MRFRepo, em *EarlyMedia) error {
+			if em.prompt != "" && !repo.AudioFileExists(em.prompt) {
+				return fmt.Errorf("prompt [%s] not found", em.prompt)
+			}
+			repo.earlyMedia = em
+			return nil
+		})
+}
+
+// earlyMedia returns the early media of the route, nil when off or when its prompt is missing from the repository
+func (ss *SipSession) earlyMedia() *EarlyMedia {
+	em := DefaultEarlyMedia
+	if ss.MRFRepo != nil && ss.MRFRepo.earlyMedia != nil {
+		em = ss.MRFRepo.earlyMedia
+	}
+	if em.prompt == "" || ss.MRFRepo == nil || !ss.MRFRepo.AudioFileExists(em.prompt) {
+		return nil
+	}
+	return em
+}
+
+// startMediaReceivers starts receiving RTP and RTCP, once
+func (ss *SipSession) startMediaReceivers() {
+	ss.mediaRxOnce.Do(func() {
+		ss.mediaActive.Store(true)
+		go ss.mediaReceiver()
+		go ss.rtcpReceiver()
+	})
+}
+
+// playEarlyMedia sends the 183 with the SDP answer, streams the prompt, then rejects or answers the call
+func (ss *SipSession) playEarlyMedia(trans *Transaction, em *EarlyMedia) {
+	defer func() {
+		if r := recover(); r != nil {
+			LogCallStack(r)
+		}
+	}()
+
+	ss.SendResponseDetailed(trans, ResponsePack{StatusCode: status.SessionProgress, PRACKRequested: ss.IsPRACKSupported}, NewMessageSDPBody(ss.LocalSDP.Bytes()))
+	ss.startMediaReceivers()
+	ss.startRTPStreaming(em.prompt, true, false, false)
+
+	if !ss.IsBeingEstablished() { // cancelled meanwhile
+		return
+	}
+	if em.answer {
+		ss.sendAnswerAfterPRACK(trans)
+		return
+	}
+	ss.RejectMe(trans, em.sipCode, em.q850Code, "Early media announcement played")
+}
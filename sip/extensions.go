@@ -0,0 +1,71 @@
+package sip
+
+import (
+	. "mrfgo/global"
+	"mrfgo/q850"
+	"mrfgo/sip/status"
+	"slices"
+	"strings"
+)
+
+// SupportedExtensions are the option tags (RFC 3261 §19.2) implemented by mrfgo: accepted in Require, and advertised
+// in the Supported header of the 2xx to INVITE, re-INVITE, UPDATE and OPTIONS. A request requiring any other tag is
+// rejected with 420 Bad Extension listing the unknown tags in Unsupported.
+var SupportedExtensions = []string{"100rel", "timer", "replaces"}
+
+func supportedHeader() string {
+	return strings.Join(SupportedExtensions, ", ")
+}
+
+// unsupportedExtensions returns the option tags of the Require header not implemented by mrfgo
+func (sipmsg *SipMessage) unsupportedExtensions() []string {
+	return slices.DeleteFunc(sipmsg.RequiredOptions(), func(o string) bool { return slices.Contains(SupportedExtensions, o) })
+}
+
+// badExtension is the 420 response to a request requiring unsupported option tags
+func badExtension(unsupported []string) ResponsePack {
+	pack := ResponsePack{StatusCode: status.BadExtension, CustomHeaders: NewSHQ850OrSIP(q850.NoRCProvided, "Unsupported extension required", "")}
+	pack.CustomHeaders.AddHeader(Unsupported, strings.Join(unsupported, ", "))
+	return pack
+}
+
+// addCapabilityHeaders advertises Supported, and Accept for OPTIONS, in a 2xx - Allow is set on all messages
+func addCapabilityHeaders(hdrs *SipHeaders, m Method) {
+	hdrs.SetHeader(Supported, supportedHeader())
+	if m == OPTIONS {
+		hdrs.SetHeader(Accept, "application/sdp")
+	}
+}
+
+// matchReplaces finds the confirmed dialogue an INVITE with Replaces takes over (RFC 3891), released once the new one
+// is confirmed - it returns the SIP code to reject the INVITE with when there is none
+func (ss *SipSession) matchReplaces(sipmsg *SipMessage) int {
+	value := sipmsg.Headers.ValueHeader(Replaces)
+	if value == "" {
+		return 0
+	}
+	callID, params, _ := strings.Cut(value, ";")
+	var toTag, fromTag string
+	var earlyOnly bool
+	for _, param := range strings.Split(params, ";") {
+		key, val, _ := strings.Cut(param, "=")
+		switch ASCIIToLower(strings.TrimSpace(key)) {
+		case "to-tag":
+			toTag = strings.TrimSpace(val)
+		case "from-tag":
+			fromTag = strings.TrimSpace(val)
+		case "early-only":
+			earlyOnly = true
+		}
+	}
+	// the to-tag is ours, the dialogues initiated by mrfgo cannot be replaced
+	old, ok := Sessions.Load(strings.TrimSpace(callID))
+	if !ok || old == ss || old.Direction != INBOUND || old.ToTag != toTag || old.FromTag != fromTag || !old.IsEstablished() {
+		return status.CallTransactionDoesNotExist
+	}
+	if earlyOnly {
+		return status.BusyHere
+	}
+	ss.replacedSession = old
+	return 0
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"mrfgo/cl"
 	"mrfgo/global"
+	"mrfgo/pacer"
 	"net"
 	"os"
 	"runtime"
@@ -12,6 +13,9 @@ import (
 
 var (
 	Sessions ConcurrentMapMutex
+	RTPPacer *pacer.Pacer // paces the RTP playback of all sessions
+
+	serverConn *net.UDPConn // SIP listener, used by the sessions initiated by mrfgo
 )
 
 func StartServer(ipv4 string, sup, htp int) *net.UDPConn {
@@ -37,20 +41,57 @@ tryAgain:
 		triedAlready = true
 		goto tryAgain
 	}
-	MediaPorts = NewMediaPortPool()
+	MediaRealms = NewMediaRealms()
+	RTPPacer = pacer.New(runtime.NumCPU())
+	global.WtGrp.Add(1)
+	go mediaSweeper()
 
+	serverConn = serverUDPListener
 	startWorkers(serverUDPListener)
 	udpLoopWorkers(serverUDPListener)
 	fmt.Println("Success: UDP", serverUDPListener.LocalAddr().String())
 
-	fmt.Print("Setting Rate Limiter...")
-	global.CallLimiter = cl.NewCallLimiter(global.RateLimit, global.Prometrics, &global.WtGrp)
-	fmt.Printf("OK (%d)\n", global.RateLimit)
+	global.CallLimiter = cl.NewCallLimiter(-1, global.Prometrics, &global.WtGrp) // counts the call attempts per second
+	initOverloadControl()
+	fmt.Printf("Overload control: %s\n", Overload)
 
 	fmt.Printf("Loading files in directory: %s\n", global.MediaPath)
 	MRFRepos = NewMRFRepoCollection(global.MRFRepoName)
 	fmt.Printf("Audio files loaded: %d\n", MRFRepos.FilesCount(global.MRFRepoName))
 
+	initCodecPolicies()
+	fmt.Printf("Codec policy: %s\n", DefaultCodecPreference)
+	initSRTPPolicies()
+	fmt.Printf("SRTP policy: %s\n", DefaultSRTPPolicy)
+	initLatchingPolicies()
+	fmt.Printf("RTP latching: %t\n", DefaultRTPLatching)
+	initSIPNATPolicy()
+	fmt.Printf("SIP NAT policy: %s\n", DefaultSIPNATPolicy)
+	initEarlyMediaPolicies()
+	fmt.Printf("Early media: %s\n", DefaultEarlyMedia)
+	initSessionTimerPolicies()
+	fmt.Printf("Session timer: %s\n", DefaultSessionTimer)
+	initMediaRealmRoutes()
+	for _, realm := range MediaRealms {
+		fmt.Printf("Media realm: %s\n", realm)
+	}
+	if global.SIPAdvertisedIPv4 != nil {
+		fmt.Printf("SIP advertised address: %s\n", global.SIPAdvertisedIPv4)
+	}
+	initAccessControl()
+	if DefaultSIPAuth != nil {
+		fmt.Printf("SIP authentication: %s\n", DefaultSIPAuth)
+	}
+	for _, peer := range TrustedPeers {
+		fmt.Printf("Trusted peer: %s\n", peer)
+	}
+	initScannerProtection()
+	fmt.Printf("Scanner protection: %s\n", Scanner)
+	initRegistrations()
+	for _, reg := range Registrations {
+		fmt.Printf("Registration: %s\n", reg)
+	}
+
 	return serverUDPListener
 }
 
@@ -167,9 +208,12 @@ func processPacket(packet Packet, conn *net.UDPConn) {
 		} else if msg == nil {
 			break
 		}
-		ss, newSesType := sessionGetter(msg)
-		if ss != nil {
-			ss.RemoteUDP = packet.sourceAddr
+		ss, newSesType := sessionGetter(msg, packet.sourceAddr)
+		switch {
+		case newSesType == global.Banned:
+			refuseRequest(msg, packet.sourceAddr, conn)
+		case ss != nil:
+			ss.updateSignallingSource(msg, packet.sourceAddr)
 			ss.SIPUDPListenser = conn
 		}
 		sipStack(msg, ss, newSesType)
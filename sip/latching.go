@@ -0,0 +1,132 @@
+package sip
+
+import (
+	"fmt"
+	. "mrfgo/global"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Symmetric RTP (RFC 4961 / latching): media is sent to where the remote media comes from rather than to the SDP address,
+// which NAT may have rewritten. A source is latched only after consecutive valid packets of one stream (negotiated payload
+// type, same SSRC, in sequence, authenticated if SRTP) so that a few third-party packets cannot hijack the session.
+// Once latched, other sources are ignored until the next offer/answer changes the remote media address.
+
+const (
+	latchPackets  int    = 3  // consecutive valid packets from a new source before latching onto it
+	latchSeqDelta uint16 = 10 // tolerated sequence gap between those packets
+)
+
+var DefaultRTPLatching = false
+
+func initLatchingPolicies() {
+	parse := func(text string) (bool, error) {
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return false, fmt.Errorf("invalid value [%s]", text)
+		}
+		return b, nil
+	}
+	initRoutePolicy("RTP latching", RTPLatchingGlobal, RTPLatchingRoutes, parse,
+		func(b bool) { DefaultRTPLatching = b },
+		func(repo *MRFRepo, b bool) error {
+			repo.rtpLatching = &b
+			return nil
+		})
+}
+
+// rtpLatching tells whether symmetric RTP applies - never to ICE, which latches on its own connectivity checks
+func (ss *SipSession) rtpLatching() bool {
+	if ss.webrtc != nil {
+		return false
+	}
+	if ss.MRFRepo != nil && ss.MRFRepo.rtpLatching != nil {
+		return *ss.MRFRepo.rtpLatching
+	}
+	return DefaultRTPLatching
+}
+
+type mediaLatch struct {
+	mu        sync.Mutex
+	enabled   bool
+	latched   bool
+	signalled *net.UDPAddr // remote media address from the last offer/answer
+	candidate *net.UDPAddr
+	ssrc      uint32
+	seq       uint16
+	count     int
+}
+
+// reset applies a new offer/answer - the latched address is kept if the signalled address did not change
+func (ml *mediaLatch) reset(enabled bool, signalled *net.UDPAddr) (keep bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	keep = enabled && ml.enabled && ml.latched && AreUAddrsEqual(ml.signalled, signalled)
+	ml.enabled = enabled
+	ml.signalled = signalled
+	if !keep {
+		ml.latched = false
+		ml.candidate = nil
+		ml.count = 0
+	}
+	return
+}
+
+func (ml *mediaLatch) isOpen() bool {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.enabled && !ml.latched
+}
+
+func (ml *mediaLatch) isLatched() bool {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.enabled && ml.latched
+}
+
+// check accounts a valid RTP packet and tells whether it is accepted and whether the media is to be latched onto its source
+func (ml *mediaLatch) check(addr *net.UDPAddr, fromCurrent bool, ssrc uint32, seq uint16) (accept, latch bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if !ml.enabled {
+		return fromCurrent, false
+	}
+	if fromCurrent {
+		ml.latched = true // the current address is sending: lock onto it
+		return true, false
+	}
+	if ml.latched {
+		return false, false
+	}
+	if AreUAddrsEqual(ml.candidate, addr) && ssrc == ml.ssrc && seq-ml.seq > 0 && seq-ml.seq <= latchSeqDelta {
+		ml.count++
+	} else {
+		ml.candidate = addr
+		ml.ssrc = ssrc
+		ml.count = 1
+	}
+	ml.seq = seq
+	if ml.count < latchPackets {
+		return false, false
+	}
+	ml.latched = true
+	ml.candidate = nil
+	return true, true
+}
+
+// latchMedia sends the media and RTCP to the latched source
+func (ss *SipSession) latchMedia(addr *net.UDPAddr) {
+	LogInfo(LTNAT, fmt.Sprintf("Call-ID [%s] - media latched onto %s (signalled %s)", ss.CallID, addr, ss.RemoteMedia))
+	ss.RemoteMedia = addr
+	if ss.rtcpMux {
+		ss.RemoteRTCP = addr
+	} else {
+		ss.RemoteRTCP = &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1} // corrected once RTCP is received
+	}
+}
+
+// isNegotiatedPayload tells whether the payload type is one of the answered ones
+func (ss *SipSession) isNegotiatedPayload(pt uint8) bool {
+	return pt == ss.rtpPayloadType || (ss.WithTeleEvents && pt == ss.rtpDTMFPayload) || (ss.WithCN && pt == ss.rtpCNPayload)
+}
@@ -2,56 +2,238 @@ package sip
 
 import (
 	"fmt"
-	"log"
 	"mrfgo/global"
 	"net"
 	"sync"
+	"time"
 )
 
-var MediaPorts *MediaPool
+const maxBindAttempts = 16 // ports taken by other processes are skipped, up to that many per allocation
 
+// MediaPool allocates RTP/RTCP port pairs on a bind address: RTP on an even port, RTCP on the next odd one.
+// Free pairs are handed out in FIFO order and released pairs are quarantined before joining the free list again,
+// so late packets of a finished call do not reach a new one.
 type MediaPool struct {
-	mu    sync.Mutex
-	alloc map[int]bool
+	ip         net.IP
+	advertised net.IP // put in the SDP, the bind address when nil
+	start      int
+	quarantine time.Duration
+
+	mu        sync.Mutex
+	free      portQueue[int] // even RTP ports, oldest released first
+	waiting   portQueue[quarantinedPort]
+	allocated []bool // indexed by (port - start) / 2
+	inUse     int
+}
+
+type quarantinedPort struct {
+	port  int
+	until time.Time
+}
+
+// portQueue is a FIFO ring sized for all the pairs of a pool, so that it never overflows
+type portQueue[T any] struct {
+	items []T
+	head  int
+	count int
+}
+
+func newPortQueue[T any](size int) portQueue[T] {
+	return portQueue[T]{items: make([]T, size)}
 }
 
-func NewMediaPortPool() *MediaPool {
-	mpp := &MediaPool{alloc: make(map[int]bool, global.MediaEndPort-global.MediaStartPort+1)}
-	for port := global.MediaStartPort; port <= global.MediaEndPort; port++ {
-		mpp.alloc[port] = false
+func (q *portQueue[T]) len() int {
+	return q.count
+}
+
+func (q *portQueue[T]) push(v T) {
+	q.items[(q.head+q.count)%len(q.items)] = v
+	q.count++
+}
+
+// front returns the oldest item - the queue is not empty
+func (q *portQueue[T]) front() T {
+	return q.items[q.head]
+}
+
+func (q *portQueue[T]) pop() T {
+	v := q.items[q.head]
+	q.head = (q.head + 1) % len(q.items)
+	q.count--
+	return v
+}
+
+// MediaPools holds the pools of all media bind addresses
+type MediaPools struct {
+	pools []*MediaPool
+}
+
+// NewMediaPortPools creates a pool per bind address over the configured port range - advertised holds either
+// no address, a single one for all bind addresses, or one per bind address
+func NewMediaPortPools(ips, advertised []net.IP) *MediaPools {
+	mpp := &MediaPools{}
+	for i, ip := range ips {
+		var adv net.IP
+		switch len(advertised) {
+		case 0:
+		case 1:
+			adv = advertised[0]
+		default:
+			adv = advertised[i]
+		}
+		mpp.pools = append(mpp.pools, NewMediaPool(ip, adv, global.MediaStartPort, global.MediaEndPort, time.Duration(global.MediaPortQuarantineSec)*time.Second))
 	}
 	return mpp
 }
 
-func (mpp *MediaPool) ReserveSocket() *net.UDPConn {
-	mpp.mu.Lock()
-	defer mpp.mu.Unlock()
-	for port, inUse := range mpp.alloc {
-		if !inUse {
-			socket, err := global.StartListening(global.ServerIPv4, port)
-			if err != nil {
-				continue
-			}
-			mpp.alloc[port] = true
-			return socket
+// ReserveSockets reserves a port pair on the bind address having the most free pairs
+func (mpp *MediaPools) ReserveSockets() (*MediaPool, *net.UDPConn, *net.UDPConn) {
+	var best *MediaPool
+	bestFree := -1
+	for _, mp := range mpp.pools {
+		if free := mp.Available(); free > bestFree {
+			best, bestFree = mp, free
 		}
 	}
-	log.Printf("No available ports for IPv4 %s\n", global.ServerIPv4)
-	return nil
+	if best == nil {
+		return nil, nil, nil
+	}
+	rtpSocket, rtcpSocket := best.ReserveSockets()
+	return best, rtpSocket, rtcpSocket
 }
 
-func (mpp *MediaPool) ReleaseSocket(conn *net.UDPConn) bool {
-	if conn == nil {
-		return true
+func (mpp *MediaPools) Pools() []*MediaPool {
+	return mpp.pools
+}
+
+func NewMediaPool(ip, advertised net.IP, start, end int, quarantine time.Duration) *MediaPool {
+	start += start % 2 // RTP ports are even
+	mp := &MediaPool{ip: ip, advertised: advertised, start: start, quarantine: quarantine}
+	pairs := max((end-start+1)/2, 0)
+	mp.free = newPortQueue[int](pairs)
+	mp.waiting = newPortQueue[quarantinedPort](pairs)
+	for port := start; port+1 <= end; port += 2 {
+		mp.free.push(port)
+	}
+	mp.allocated = make([]bool, pairs)
+	mp.updateMetrics()
+	return mp
+}
+
+func (mp *MediaPool) IP() net.IP {
+	return mp.ip
+}
+
+// Advertised returns the address to put in the SDP
+func (mp *MediaPool) Advertised() net.IP {
+	if mp.advertised != nil {
+		return mp.advertised
 	}
-	port := global.GetUDPortFromConn(conn)
-	conn.Close()
-	mpp.mu.Lock()
-	defer mpp.mu.Unlock()
-	if mpp.alloc[port] {
-		mpp.alloc[port] = false
+	return mp.ip
+}
+
+// Available returns the number of port pairs free or about to be released from quarantine
+func (mp *MediaPool) Available() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.free.len() + mp.waiting.len()
+}
+
+func (mp *MediaPool) String() string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	adv := ""
+	if mp.advertised != nil {
+		adv = fmt.Sprintf(" advertised as %s", mp.advertised)
+	}
+	return fmt.Sprintf("%s%s ports %d-%d (%d pairs, quarantine %v)", mp.ip, adv, mp.start, mp.start+2*len(mp.allocated)-1, len(mp.allocated), mp.quarantine)
+}
+
+// ReserveSockets binds the RTP socket on the next free even port and the RTCP socket on the following odd port
+func (mp *MediaPool) ReserveSockets() (*net.UDPConn, *net.UDPConn) {
+	for attempt := 0; attempt < maxBindAttempts; attempt++ {
+		port, ok := mp.take()
+		if !ok {
+			global.LogError(global.LTMediaStack, fmt.Sprintf("No available media ports for IPv4 %s", mp.ip))
+			return nil, nil
+		}
+		rtpSocket, err := global.StartListening(mp.ip, port)
+		if err != nil {
+			mp.giveBack(port)
+			continue
+		}
+		rtcpSocket, err := global.StartListening(mp.ip, port+1)
+		if err != nil {
+			rtpSocket.Close()
+			mp.giveBack(port)
+			continue
+		}
+		return rtpSocket, rtcpSocket
+	}
+	global.LogError(global.LTMediaStack, fmt.Sprintf("Unable to bind media ports for IPv4 %s", mp.ip))
+	return nil, nil
+}
+
+// ReleaseSockets closes the sockets of a pair and quarantines its ports
+func (mp *MediaPool) ReleaseSockets(rtpSocket, rtcpSocket *net.UDPConn) bool {
+	if rtcpSocket != nil {
+		rtcpSocket.Close()
+	}
+	if rtpSocket == nil {
 		return true
 	}
-	global.LogWarning(global.LTMediaStack, fmt.Sprintf("Port [%d] already released!\n", port))
-	return false
+	port := global.GetUDPortFromConn(rtpSocket)
+	rtpSocket.Close()
+	if !mp.giveBack(port) {
+		global.LogWarning(global.LTMediaStack, fmt.Sprintf("Port [%d] already released!", port))
+		return false
+	}
+	return true
+}
+
+// take pops the oldest free port, after moving the ports whose quarantine is over to the free list
+func (mp *MediaPool) take() (int, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	defer mp.updateMetrics()
+	now := time.Now()
+	for mp.waiting.len() != 0 && !mp.waiting.front().until.After(now) {
+		mp.free.push(mp.waiting.pop().port)
+	}
+	if mp.free.len() == 0 {
+		if global.Prometrics != nil {
+			global.Prometrics.MediaPortExhaustions.WithLabelValues(mp.ip.String()).Inc()
+		}
+		return 0, false
+	}
+	port := mp.free.pop()
+	mp.allocated[(port-mp.start)/2] = true
+	mp.inUse++
+	return port, true
+}
+
+// giveBack quarantines an allocated port
+func (mp *MediaPool) giveBack(port int) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	defer mp.updateMetrics()
+	idx := (port - mp.start) / 2
+	if idx < 0 || idx >= len(mp.allocated) || !mp.allocated[idx] {
+		return false
+	}
+	mp.allocated[idx] = false
+	mp.inUse--
+	mp.waiting.push(quarantinedPort{port: port, until: time.Now().Add(mp.quarantine)})
+	return true
+}
+
+// updateMetrics - pool lock held
+func (mp *MediaPool) updateMetrics() {
+	if global.Prometrics == nil {
+		return
+	}
+	ip := mp.ip.String()
+	global.Prometrics.MediaPortsInUse.WithLabelValues(ip).Set(float64(mp.inUse))
+	global.Prometrics.MediaPortsFree.WithLabelValues(ip).Set(float64(mp.free.len()))
+	global.Prometrics.MediaPortsQuarantined.WithLabelValues(ip).Set(float64(mp.waiting.len()))
 }
@@ -0,0 +1,161 @@
+package sip
+
+import (
+	"fmt"
+	. "mrfgo/global"
+	"net"
+	"sort"
+	"strings"
+)
+
+// A media realm is a set of media bind addresses, with the addresses advertised for them in the SDP, serving calls
+// signalled from its source networks or routed to it. Realms keep media of separate networks (VLANs, public and
+// private sides) on their own interfaces. The default realm serves all other calls.
+
+const defaultMediaRealm = "default"
+
+type MediaRealm struct {
+	Name     string
+	Networks []*net.IPNet // source networks of the calls served, matched on the signalling source
+	*MediaPools
+}
+
+var MediaRealms []*MediaRealm // the default realm first
+
+// NewMediaRealms creates the default realm from the media bind and advertised addresses, then the configured realms,
+// each definition reading "bind=<ipv4,...> advertise=<ipv4,...> networks=<cidr,...>" with bind mandatory
+func NewMediaRealms() []*MediaRealm {
+	binds := MediaBindIPv4s
+	if len(binds) == 0 {
+		binds = []net.IP{ServerIPv4}
+	}
+	advertised := MediaAdvertisedIPv4s
+	if len(advertised) > 1 && len(advertised) != len(binds) {
+		LogWarning(LTConfiguration, fmt.Sprintf("Media advertised addresses ignored - %d for %d bind addresses", len(advertised), len(binds)))
+		advertised = nil
+	}
+	realms := []*MediaRealm{{Name: defaultMediaRealm, MediaPools: NewMediaPortPools(binds, advertised)}}
+	used := make(map[string]bool)
+	for _, ip := range binds {
+		used[ip.String()] = true
+	}
+
+	names := make([]string, 0, len(MediaRealmsConfig))
+	for name := range MediaRealmsConfig {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		realm, err := parseMediaRealm(name, MediaRealmsConfig[name], used)
+		if err != nil {
+			LogWarning(LTConfiguration, fmt.Sprintf("Media realm [%s] ignored - %v", name, err))
+			continue
+		}
+		realms = append(realms, realm)
+	}
+	return realms
+}
+
+func parseMediaRealm(name, definition string, used map[string]bool) (*MediaRealm, error) {
+	if strings.EqualFold(name, defaultMediaRealm) {
+		return nil, fmt.Errorf("reserved name")
+	}
+	var binds, advertised []net.IP
+	var networks []*net.IPNet
+	var err error
+	for _, field := range strings.Fields(definition) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "bind":
+			binds, err = ParseIPv4List(value)
+		case "advertise":
+			advertised, err = ParseIPv4List(value)
+		case "networks":
+			for _, cidr := range strings.Split(value, ",") {
+				var ipnet *net.IPNet
+				if _, ipnet, err = net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+					break
+				}
+				networks = append(networks, ipnet)
+			}
+		default:
+			err = fmt.Errorf("unknown field [%s]", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(binds) == 0 {
+		return nil, fmt.Errorf("no bind address")
+	}
+	if len(advertised) > 1 && len(advertised) != len(binds) {
+		return nil, fmt.Errorf("%d advertised addresses for %d bind addresses", len(advertised), len(binds))
+	}
+	// pools share the port range: a bind address may belong to a single realm
+	for _, ip := range binds {
+		if used[ip.String()] {
+			return nil, fmt.Errorf("bind address %s already in use by another realm", ip)
+		}
+	}
+	for _, ip := range binds {
+		used[ip.String()] = true
+	}
+	return &MediaRealm{Name: name, Networks: networks, MediaPools: NewMediaPortPools(binds, advertised)}, nil
+}
+
+func initMediaRealmRoutes() {
+	findRealm := func(name string) (*MediaRealm, error) {
+		if realm := getMediaRealm(strings.TrimSpace(name)); realm != nil {
+			return realm, nil
+		}
+		return nil, fmt.Errorf("realm [%s] not found", name)
+	}
+	initRoutePolicy("Media realm", "", MediaRealmRoutes, findRealm, nil,
+		func(repo *MRFRepo, realm *MediaRealm) error {
+			repo.mediaRealm = realm
+			return nil
+		})
+}
+
+func getMediaRealm(name string) *MediaRealm {
+	for _, realm := range MediaRealms {
+		if realm.Name == name {
+			return realm
+		}
+	}
+	return nil
+}
+
+func (realm *MediaRealm) String() string {
+	var sb strings.Builder
+	sb.WriteString(realm.Name)
+	if len(realm.Networks) != 0 {
+		nets := make([]string, len(realm.Networks))
+		for i, n := range realm.Networks {
+			nets[i] = n.String()
+		}
+		fmt.Fprintf(&sb, " (networks %s)", strings.Join(nets, ", "))
+	}
+	for _, mp := range realm.Pools() {
+		fmt.Fprintf(&sb, "\n  %s", mp)
+	}
+	return sb.String()
+}
+
+// mediaRealm selects the realm of the call: the one of its route, else the first one whose networks hold the
+// signalling source, else the default one
+func (ss *SipSession) mediaRealm() *MediaRealm {
+	if ss.MRFRepo != nil && ss.MRFRepo.mediaRealm != nil {
+		return ss.MRFRepo.mediaRealm
+	}
+	if ss.RemoteUDP != nil {
+		for _, realm := range MediaRealms[1:] {
+			for _, n := range realm.Networks {
+				if n.Contains(ss.RemoteUDP.IP) {
+					return realm
+				}
+			}
+		}
+	}
+	return MediaRealms[0]
+}
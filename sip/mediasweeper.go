@@ -0,0 +1,26 @@
+package sip
+
+import (
+	. "mrfgo/global"
+	"time"
+)
+
+// mediaSweeper visits every second the sessions with media, sending their RTCP reports every RTCPIntervalSec for the
+// life of the call, whether prompts are played or not, and releasing the calls without RTP
+func mediaSweeper() {
+	defer WtGrp.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	interval := time.Duration(RTCPIntervalSec) * time.Second
+	for now := range ticker.C {
+		for _, ss := range Sessions.Snapshot() {
+			if !ss.mediaActive.Load() {
+				continue
+			}
+			if now.Sub(ss.rtcpLastSent) >= interval {
+				ss.sendRTCPReport(now)
+			}
+			ss.checkMediaTimeout(now)
+		}
+	}
+}
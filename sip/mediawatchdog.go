@@ -0,0 +1,40 @@
+package sip
+
+import (
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/q850"
+	"time"
+)
+
+// touchMedia restarts the inactivity countdown, on received RTP, on each offer/answer and once the call is answered
+func (ss *SipSession) touchMedia() {
+	ss.rtpLastReceived.Store(time.Now().UnixNano())
+}
+
+// checkMediaTimeout releases the established call when no RTP was received for RTPTimeoutSec, or for RTPHoldTimeoutSec
+// while the remote is not expected to send any (held, recvonly or inactive) - zero disables the respective timeout.
+// Called every second by mediaSweeper.
+func (ss *SipSession) checkMediaTimeout(now time.Time) {
+	if !ss.IsEstablished() {
+		return
+	}
+	quiet := ss.IsCallHeld || ss.rtpNotExpected
+	limit := RTPTimeoutSec
+	if quiet {
+		limit = RTPHoldTimeoutSec
+	}
+	if limit == 0 {
+		return
+	}
+	idle := now.Sub(time.Unix(0, ss.rtpLastReceived.Load()))
+	if idle < time.Duration(limit)*time.Second {
+		return
+	}
+	details := "RTP timeout"
+	if quiet {
+		details = "RTP timeout while on hold"
+	}
+	LogWarning(LTMediaStack, fmt.Sprintf("Call-ID [%s] - no RTP received for %v - releasing", ss.CallID, idle.Truncate(time.Second)))
+	ss.ReleaseMeDetailed(q850.RecoveryOnTimerExpiry, details)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"mrfgo/global"
 	"mrfgo/numtype"
+	"net"
 	"slices"
 	"strings"
 )
@@ -31,6 +32,11 @@ type SipMessage struct {
 	RCURI string
 	RRURI string
 
+	SourceUDP   *net.UDPAddr // where the request came from
+	ResponseUDP *net.UDPAddr // where its responses go, from the topmost Via
+	WithRport   bool
+	ViaNATed    bool
+
 	MaxFwds       int
 	CSeqNum       uint32
 	CSeqMethod    global.Method
@@ -188,6 +194,17 @@ func (sipmsg *SipMessage) IsOptionSupported(o string) bool {
 	return hdr != "" && strings.Contains(hdr, o)
 }
 
+// RequiredOptions returns the option tags of the Require header, in lower case
+func (sipmsg *SipMessage) RequiredOptions() []string {
+	var opts []string
+	for _, o := range strings.Split(global.ASCIIToLower(sipmsg.Headers.ValueHeader(global.Require)), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			opts = append(opts, o)
+		}
+	}
+	return opts
+}
+
 func (sipmsg *SipMessage) IsOptionRequired(o string) bool {
 	hdr := sipmsg.Headers.ValueHeader(global.Require)
 	hdr = global.ASCIIToLower(hdr)
@@ -289,7 +306,7 @@ func (sipmsg *SipMessage) TranslateRM(ss *SipSession, tx *Transaction, nt numtyp
 	if NewNumber == "" {
 		return
 	}
-	localsocket := global.GetUDPAddrFromConn(ss.SIPUDPListenser)
+	localsocket := ss.localSIPAddr()
 	rep := fmt.Sprintf("${1}%s$2", NewNumber)
 
 	switch nt {
@@ -1,17 +1,21 @@
 package sip
 
 import (
+	"cmp"
 	"encoding/binary"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"math"
 	"mrfgo/dtmf"
 	. "mrfgo/global"
+	"mrfgo/ice"
 	"mrfgo/q850"
 	"mrfgo/rtp"
 	"mrfgo/sdp"
 	"mrfgo/sip/state"
 	"mrfgo/sip/status"
+	"mrfgo/udpio"
 	"net"
 	"slices"
 	"strings"
@@ -26,9 +30,12 @@ func (ss *SipSession) RouteRequestInternal(trans *Transaction, sipmsg1 *SipMessa
 	}()
 
 	upart := sipmsg1.StartLine.UserPart
+	if route, ok := registeredRoute(upart); ok {
+		upart = route
+	}
 
-	if !sipmsg1.Body.ContainsSDP() {
-		ss.RejectMe(trans, status.NotAcceptableHere, q850.BearerCapabilityNotImplemented, "Not supported SDP or delayed offer")
+	if !sipmsg1.Body.WithNoBody() && !sipmsg1.Body.ContainsSDP() {
+		ss.RejectMe(trans, status.NotAcceptableHere, q850.BearerCapabilityNotImplemented, "Not supported SDP")
 		return
 	}
 
@@ -40,6 +47,17 @@ func (ss *SipSession) RouteRequestInternal(trans *Transaction, sipmsg1 *SipMessa
 
 	ss.MRFRepo = repo
 
+	if sc := ss.matchReplaces(sipmsg1); sc != 0 {
+		ss.RejectMe(trans, sc, q850.NoRCProvided, "No dialogue to replace")
+		return
+	}
+
+	if _, _, minSE := ss.negotiateSessionTimer(sipmsg1); minSE != 0 {
+		ss.SetState(state.BeingFailed)
+		ss.SendResponseDetailed(trans, sessionIntervalTooSmall(minSE), EmptyBody())
+		return
+	}
+
 	ss.answerMRF(trans, sipmsg1)
 }
 
@@ -58,9 +76,41 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 	var conn *sdp.Connection = sdpses.Connection
 	var audioFormat *sdp.Format
 	var dtmfFormat *sdp.Format
+	var cnFormat *sdp.Format
+	var codec uint8
+	var rtcpMux bool
+	var crypto *sdesCrypto
+	var webOffer *webRTCMedia
+	var srtpSkipped bool
+	srtpPolicy := ss.srtpPolicy()
 	for i := 0; i < len(sdpses.Media); i++ {
 		media = sdpses.Media[i]
-		if media.Type != sdp.Audio || media.Port == 0 || media.Proto != sdp.RtpAvp || (conn == nil && len(media.Connection) == 0) { //|| media.Mode != sdp.SendRecv
+		if media.Type != sdp.Audio || media.Port == 0 || (conn == nil && len(media.Connection) == 0) { //|| media.Mode != sdp.SendRecv
+			continue
+		}
+		switch media.Proto {
+		case sdp.RtpAvp:
+			if srtpPolicy == SRTPMandatory {
+				srtpSkipped = true
+				continue
+			}
+		case sdp.RtpSavp:
+			if srtpPolicy == SRTPDisabled {
+				srtpSkipped = true
+				continue
+			}
+			if crypto = offeredCrypto(media); crypto == nil {
+				continue
+			}
+		case sdp.UdpTlsRtpSavpf, sdp.UdpTlsRtpSavp:
+			if srtpPolicy == SRTPDisabled {
+				srtpSkipped = true
+				continue
+			}
+			if webOffer = offeredWebRTC(sdpses, media); webOffer == nil {
+				continue
+			}
+		default:
 			continue
 		}
 		for j := 0; j < len(media.Connection); j++ {
@@ -71,24 +121,45 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 			conn = connection
 			break
 		}
+		policy := ss.codecPolicy()
+		bestRank := -1
 		for k := 0; k < len(media.Format); k++ {
 			frmt := media.Format[k]
-			if frmt.Channels != 1 || frmt.ClockRate != 8000 || !slices.Contains(sdp.SupportedCodecs, frmt.Payload) {
+			cdc, ok := resolveCodec(frmt)
+			if !ok || (rtp.IsOpus(cdc) && !opusAcceptable(frmt, media, sdpses)) {
+				continue
+			}
+			rank, ok := policy.Rank(cdc)
+			if !ok || (bestRank != -1 && rank >= bestRank) {
 				continue
 			}
 			audioFormat = frmt
-			break
+			codec = cdc
+			bestRank = rank
 		}
 		for k := 0; k < len(media.Format); k++ {
 			frmt := media.Format[k]
-			if frmt.Name == sdp.TelephoneEvents {
+			if frmt.Name == sdp.TelephoneEvents && (audioFormat == nil || frmt.ClockRate == codecClockRate(codec)) {
 				dtmfFormat = frmt
 				break
 			}
 		}
+		if audioFormat != nil && withGenericCN(codec) {
+			for k := 0; k < len(media.Format); k++ {
+				frmt := media.Format[k]
+				if (frmt.Name == "" && frmt.Payload == rtp.CN) || (strings.EqualFold(frmt.Name, sdp.ComfortNoise) && frmt.ClockRate == 8000) {
+					cnFormat = frmt
+					break
+				}
+			}
+		}
+		rtcpMux = media.Attributes.Has(sdp.RTCPMux)
 		media.Chosen = true
 		break
 	}
+	if media != nil && !media.Chosen {
+		media = nil
+	}
 
 	if conn == nil {
 		sipcode = status.NotAcceptableHere
@@ -101,6 +172,9 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		sipcode = status.NotAcceptableHere
 		q850code = q850.BearerCapabilityNotAvailable
 		warn = "No SDP audio offer found"
+		if srtpSkipped {
+			warn = fmt.Sprintf("No SDP audio offer found (SRTP %s)", srtpPolicy)
+		}
 		return
 	}
 
@@ -111,7 +185,8 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		return
 	}
 
-	if Str2Int[int](sdpses.GetEffectivePTime()) != PacketizationTime {
+	// Opus offers not accepting 20ms packets were skipped when choosing the codec, a larger ptime being a preference only
+	if !rtp.IsOpus(codec) && Str2Int[int](sdpses.GetEffectivePTime()) != PacketizationTime {
 		sipcode = status.NotAcceptableHere
 		q850code = q850.BearerCapabilityNotImplemented
 		warn = "Packetization other than 20ms not supported"
@@ -126,28 +201,126 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		return
 	}
 
+	latched, latchedRTCP := ss.RemoteMedia, ss.RemoteRTCP
 	ss.RemoteMedia = rmedia
+	ss.rtcpMux = rtcpMux
+	ss.RemoteRTCP = remoteRTCPAddr(media, rmedia, rtcpMux)
+	ss.srtpRequired = crypto != nil || webOffer != nil
 	ss.IsCallHeld = sdpses.IsCallHeld()
+	ss.rtpNotExpected = !sdpses.SendsMedia()
+	ss.touchMedia() // the inactivity countdown restarts with the new media state
 
 	// TODO need to handle CANCEL (put some delay before answering?)
-	if ss.MediaListener == nil {
-		ss.MediaListener = MediaPorts.ReserveSocket()
-	}
-	if ss.MediaListener == nil {
+	if !ss.reserveMedia() {
 		sipcode = status.NotAcceptableHere
 		q850code = q850.ResourceUnavailableUnspecified
 		warn = "Media pool depleted"
 		return
 	}
 
-	mySDP := &sdp.Session{
+	var cryptoAttr *sdp.Attr
+	if err = ss.setupWebRTC(webOffer); err == nil && webOffer == nil {
+		cryptoAttr, err = ss.setupSRTP(crypto)
+	}
+	if err != nil {
+		sipcode = status.NotAcceptableHere
+		q850code = q850.ResourceUnavailableUnspecified
+		warn = "SRTP setup failed"
+		return
+	}
+	// an ongoing ICE/DTLS association keeps its checked address
+	if ss.webrtc != nil && ss.webrtc.isConnected() {
+		ss.RemoteMedia, ss.RemoteRTCP = latched, latched
+	}
+	// symmetric RTP keeps the latched addresses as long as the signalled one is unchanged
+	if ss.mediaLatch.reset(ss.rtpLatching(), rmedia) {
+		ss.RemoteMedia, ss.RemoteRTCP = latched, latchedRTCP
+	}
+
+	mySDP := ss.newLocalSDP()
+
+	for i := 0; i < len(sdpses.Media); i++ {
+		media := sdpses.Media[i]
+		var newmedia *sdp.Media
+		if media.Chosen {
+			newmedia = &sdp.Media{
+				Chosen:     true,
+				Type:       "audio",
+				Port:       GetUDPortFromConn(ss.MediaListener),
+				Proto:      media.Proto,
+				Format:     []*sdp.Format{answerFormat(audioFormat, codec)},
+				Attributes: []*sdp.Attr{{Name: "ptime", Value: "20"}},
+				Mode:       sdp.NegotiateMode(sdp.SendRecv, sdpses.GetEffectiveMediaDirective())}
+			if dtmfFormat != nil {
+				newmedia.Format = append(newmedia.Format, dtmfFormat)
+			}
+			if cnFormat != nil {
+				newmedia.Format = append(newmedia.Format, cnFormat)
+			}
+			if rtcpMux {
+				newmedia.Attributes = append(newmedia.Attributes, sdp.NewAttrFlag(sdp.RTCPMux))
+			}
+			if cryptoAttr != nil {
+				newmedia.Attributes = append(newmedia.Attributes, cryptoAttr)
+			}
+			if ss.webrtc != nil {
+				newmedia.Attributes = append(newmedia.Attributes, ss.webrtc.webRTCAttributes(media, ss.mediaPool.Advertised(), newmedia.Port)...)
+				mySDP.Attributes = append(mySDP.Attributes, sdp.NewAttrFlag(sdp.ICELite))
+				if mid := media.Attributes.Get(sdp.MID); mid != "" && strings.HasPrefix(sdpses.Attributes.Get(sdp.Group), "BUNDLE ") {
+					mySDP.Attributes = append(mySDP.Attributes, sdp.NewAttr(sdp.Group, "BUNDLE "+mid))
+				}
+			}
+		} else {
+			newmedia = &sdp.Media{Type: media.Type, Port: 0, Proto: media.Proto}
+		}
+		mySDP.Media = append(mySDP.Media, newmedia)
+	}
+
+	if ss.LocalSDP != nil && !mySDP.Equals(ss.LocalSDP) {
+		ss.SDPSessionVersion += 1
+		mySDP.Origin.SessionVersion = ss.SDPSessionVersion
+	}
+
+	ss.LocalSDP = mySDP
+	ss.rtpPayloadType = audioFormat.Payload
+	ss.rtpCodec = codec
+	ss.WithTeleEvents = dtmfFormat != nil
+	if ss.WithTeleEvents {
+		ss.rtpDTMFPayload = dtmfFormat.Payload
+	}
+	ss.WithCN = cnFormat != nil
+	if ss.WithCN {
+		ss.rtpCNPayload = cnFormat.Payload
+	}
+
+	if !ss.WithTeleEvents {
+		ss.PCMSamples = make([]int16, 0, (DTMFPacketsCount+1)*rtp.SamplesPerPacket)
+	}
+
+	return
+}
+
+// reserveMedia reserves the media sockets of the session, in the realm of the call, unless already done
+func (ss *SipSession) reserveMedia() bool {
+	if ss.MediaListener == nil {
+		ss.mediaPool, ss.MediaListener, ss.RTCPListener = ss.mediaRealm().ReserveSockets()
+		if ss.MediaListener != nil {
+			ss.mediaIO = udpio.NewConn(ss.MediaListener)
+		}
+	}
+	return ss.MediaListener != nil
+}
+
+// newLocalSDP returns the session level part of the local SDP, with the advertised address of the media sockets
+func (ss *SipSession) newLocalSDP() *sdp.Session {
+	return &sdp.Session{
 		Origin: &sdp.Origin{
 			Username:       "mt",
 			SessionID:      ss.SDPSessionID,
 			SessionVersion: ss.SDPSessionVersion,
 			Network:        sdp.NetworkInternet,
 			Type:           sdp.TypeIPv4,
-			Address:        ServerIPv4.String(),
+			Address:        ss.mediaPool.Advertised().String(),
 		},
 		Name: "MRF",
 		// Information: "A Seminar on the session description protocol",
@@ -157,7 +330,7 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		Connection: &sdp.Connection{
 			Network: sdp.NetworkInternet,
 			Type:    sdp.TypeIPv4,
-			Address: ServerIPv4.String(),
+			Address: ss.mediaPool.Advertised().String(),
 			TTL:     0,
 		},
 		// Bandwidth: []*Bandwidth{
@@ -182,50 +355,105 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		// 	{Time: parseTime("1996-05-30 16:26:59 +0000 UTC"), Offset: 0},
 		// },
 	}
+}
 
-	for i := 0; i < len(sdpses.Media); i++ {
-		media := sdpses.Media[i]
-		var newmedia *sdp.Media
-		if media.Chosen {
-			newmedia = &sdp.Media{
-				Chosen:     true,
-				Type:       "audio",
-				Port:       GetUDPortFromConn(ss.MediaListener),
-				Proto:      "RTP/AVP",
-				Format:     []*sdp.Format{audioFormat},
-				Attributes: []*sdp.Attr{{Name: "ptime", Value: "20"}},
-				Mode:       sdp.NegotiateMode(sdp.SendRecv, sdpses.GetEffectiveMediaDirective())}
-			if dtmfFormat != nil {
-				newmedia.Format = append(newmedia.Format, dtmfFormat)
+// remoteRTCPAddr returns where RTCP is to be sent: the RTP address when multiplexed,
+// the a=rtcp attribute (RFC 3605) if present, otherwise the RTP port + 1
+func remoteRTCPAddr(media *sdp.Media, rmedia *net.UDPAddr, rtcpMux bool) *net.UDPAddr {
+	if rtcpMux {
+		return rmedia
+	}
+	raddr := &net.UDPAddr{IP: rmedia.IP, Port: rmedia.Port + 1}
+	if v := media.Attributes.Get(sdp.RTCP); v != "" {
+		flds := strings.Fields(v)
+		if port := Str2Int[int](flds[0]); port > 0 {
+			raddr.Port = port
+		}
+		if len(flds) == 4 {
+			if ip := net.ParseIP(flds[3]); ip != nil && ip.To4() != nil {
+				raddr.IP = ip
 			}
-		} else {
-			newmedia = &sdp.Media{Type: media.Type, Port: 0, Proto: media.Proto}
 		}
-		mySDP.Media = append(mySDP.Media, newmedia)
 	}
+	return raddr
+}
 
-	if ss.LocalSDP != nil && !mySDP.Equals(ss.LocalSDP) {
-		ss.SDPSessionVersion += 1
-		mySDP.Origin.SessionVersion = ss.SDPSessionVersion
+// resolveCodec maps an offered format to the internal codec to be used, if supported by this build
+func resolveCodec(frmt *sdp.Format) (uint8, bool) {
+	var codec uint8
+	switch {
+	case strings.EqualFold(frmt.Name, sdp.Opus):
+		if frmt.ClockRate != rtp.OpusClockRate {
+			return 0, false
+		}
+		codec = rtp.OPUS
+		if v, ok := frmt.Param("useinbandfec"); ok && v == "1" {
+			codec = rtp.OPUSFEC
+		}
+	case slices.Contains(sdp.SupportedCodecs, frmt.Payload):
+		// static payload types may be offered without rtpmap
+		if frmt.Name != "" && (frmt.Channels != 1 || frmt.ClockRate != 8000) {
+			return 0, false
+		}
+		codec = frmt.Payload
+		if codec == rtp.G729 && frmt.IsAnnexBEnabled() {
+			codec = rtp.G729B
+		}
+	default:
+		return 0, false
 	}
+	return codec, rtp.IsCodecAvailable(codec)
+}
 
-	ss.LocalSDP = mySDP
-	ss.rtpPayloadType = audioFormat.Payload
-	ss.WithTeleEvents = dtmfFormat != nil
-
-	if !ss.WithTeleEvents {
-		ss.PCMBytes = make([]byte, 0, DTMFPacketsCount*PayloadSize)
+// opusAcceptable checks an Opus offer against what is sent (RFC 7587 §6.1): 20 ms packets of narrowband mono audio,
+// which suit any stereo preference and the lowest maxplaybackrate allowed, but not a ptime or maxptime below 20 ms
+func opusAcceptable(frmt *sdp.Format, media *sdp.Media, sdpses *sdp.Session) bool {
+	if v, ok := frmt.Param("maxplaybackrate"); ok && Str2Int[int](v) < 8000 {
+		return false
+	}
+	for _, name := range []string{"ptime", "maxptime"} {
+		v := cmp.Or(media.Attributes.Get(name), sdpses.Attributes.Get(name))
+		if v != "" && Str2Int[int](v) < PacketizationTime {
+			return false
+		}
 	}
+	return true
+}
 
-	return
+// withGenericCN reports whether RFC 3389 comfort noise can be used with the codec.
+// G.729 Annex B has its own SID frames and Opus has its own DTX, CN payload type 13 is 8 kHz only.
+func withGenericCN(codec uint8) bool {
+	return codec == rtp.PCMU || codec == rtp.PCMA || codec == rtp.G722
 }
 
-func (ss *SipSession) answerMRF(trans *Transaction, sipmsg *SipMessage) {
-	if sc, qc, wr := ss.buildSDPAnswer(sipmsg); sc != 0 {
-		ss.RejectMe(trans, sc, qc, wr)
-		return
+func codecClockRate(codec uint8) int {
+	if rtp.IsOpus(codec) {
+		return rtp.OpusClockRate
 	}
+	return 8000
+}
 
+// answerFormat builds the answered format. For Opus, the fmtp receive parameters are what mrfgo decodes (narrowband
+// mono, for inband DTMF) and the sprop ones what it sends, whatever the offer: narrowband mono prompts, as accepted by
+// opusAcceptable, with inband FEC when the offerer asked for it.
+func answerFormat(offer *sdp.Format, codec uint8) *sdp.Format {
+	if !rtp.IsOpus(codec) {
+		return offer
+	}
+	fec := 0
+	if codec == rtp.OPUSFEC {
+		fec = 1
+	}
+	return &sdp.Format{
+		Payload:   offer.Payload,
+		Name:      sdp.Opus,
+		ClockRate: rtp.OpusClockRate,
+		Channels:  2,
+		Params:    []string{fmt.Sprintf("maxplaybackrate=8000;sprop-maxcapturerate=8000;stereo=0;sprop-stereo=0;useinbandfec=%d", fec)},
+	}
+}
+
+func (ss *SipSession) answerMRF(trans *Transaction, sipmsg *SipMessage) {
 	// initializations
 	ss.rtpSSRC = RandomNum(2000, 9000000)
 	ss.rtpSequenceNum = uint16(RandomNum(1000, 2000))
@@ -233,7 +461,37 @@ func (ss *SipSession) answerMRF(trans *Transaction, sipmsg *SipMessage) {
 	ss.SDPSessionID = int64(RandomNum(1000, 9000))
 	ss.SDPSessionVersion = 1
 
-	ss.SendResponse(trans, status.Ringing, EmptyBody())
+	var sc, qc int
+	var wr string
+	if ss.IsDelayedOfferCall {
+		sc, qc, wr = ss.buildSDPOffer()
+	} else {
+		sc, qc, wr = ss.buildSDPAnswer(sipmsg)
+	}
+	if sc != 0 {
+		ss.RejectMe(trans, sc, qc, wr)
+		return
+	}
+
+	// announcement before answer, only when the answer can be sent in the 183
+	if em := ss.earlyMedia(); em != nil && !ss.IsDelayedOfferCall {
+		go ss.playEarlyMedia(trans, em)
+		return
+	}
+
+	// an offer goes in a reliable 183 when possible, its answer then comes in the PRACK
+	if ss.IsDelayedOfferCall && ss.IsPRACKSupported {
+		ss.SendResponseDetailed(trans, ResponsePack{StatusCode: status.SessionProgress, PRACKRequested: true}, NewMessageSDPBody(ss.LocalSDP.Bytes()))
+		go ss.sendAnswerAfterPRACK(trans)
+		return
+	}
+
+	// a reliable 180 is the first reliable response to the offer, so it carries the answer (RFC 3262 5)
+	body := EmptyBody()
+	if ss.IsPRACKSupported {
+		body = NewMessageSDPBody(ss.LocalSDP.Bytes())
+	}
+	ss.SendResponseDetailed(trans, ResponsePack{StatusCode: status.Ringing, PRACKRequested: ss.IsPRACKSupported}, body)
 
 	<-time.After(AnswerDelay * time.Millisecond)
 
@@ -241,20 +499,26 @@ func (ss *SipSession) answerMRF(trans *Transaction, sipmsg *SipMessage) {
 		return
 	}
 
+	if ss.IsPRACKSupported {
+		go ss.sendAnswerAfterPRACK(trans) // the SIP worker is not held while waiting for the PRACK
+		return
+	}
 	ss.SendResponse(trans, status.OK, NewMessageSDPBody(ss.LocalSDP.Bytes()))
 }
 
 func (ss *SipSession) mediaReceiver() {
-	for {
-		if ss.MediaListener == nil {
-			return
+	if ss.mediaIO == nil {
+		return
+	}
+	rdr := udpio.NewReader(ss.mediaIO)
+	defer func() {
+		if ss.rxDecoder != nil {
+			ss.rxDecoder.Close()
 		}
-		buf := RTPRXBufferPool.Get().(*[]byte)
-		n, addr, err := ss.MediaListener.ReadFromUDP(*buf)
+	}()
+	for {
+		bytes, addr, err := rdr.Read()
 		if err != nil {
-			if buf != nil {
-				RTPRXBufferPool.Put(buf)
-			}
 			if opErr, ok := err.(*net.OpError); ok {
 				_ = opErr
 				return
@@ -262,55 +526,193 @@ func (ss *SipSession) mediaReceiver() {
 			fmt.Println(err)
 			continue
 		}
-		bytes := (*buf)[:n]
+		ss.processMedia(bytes, addr)
+	}
+}
 
-		if !AreUAddrsEqual(addr, ss.RemoteMedia) {
-			fmt.Println("Received RTP from unknown remote connection")
-			continue
+// processMedia handles a datagram received on the media socket
+func (ss *SipSession) processMedia(bytes []byte, addr *net.UDPAddr) {
+	n := len(bytes)
+
+	// ICE connectivity checks and DTLS share the media socket with RTP/RTCP (RFC 7983)
+	if wm := ss.webrtc; wm != nil && n > 0 {
+		switch {
+		case ice.IsSTUN(bytes):
+			ss.processSTUN(wm, bytes, addr)
+			return
+		case bytes[0] >= 20 && bytes[0] <= 63:
+			if AreUAddrsEqual(addr, ss.RemoteMedia) {
+				wm.processDTLS(bytes, addr)
+			}
+			return
 		}
-		if ss.WithTeleEvents {
-			if n == 16 { // TODO check if no RFC 4733 is negotiated - transcode InBand DTMF into teleEvents
-				ts := binary.BigEndian.Uint32(bytes[4:8]) //TODO check how to use IsSystemBigEndian
-				if ss.rtpRFC4733TS != ts {
-					ss.rtpRFC4733TS = ts
-					dtmf := DicDTMFEvent[bytes[12]]
-					ss.processDTMF(dtmf, "Inband - RTP Telephone Event (RFC 4733) - Received: ")
-					// switch dtmf {
-					// case "DTMF #":
-					// 	// ss.stopRTPStreaming() // TODO use this if audiofile can be interrupted by any DTMF or a specific DTMF or not at all
-					// case "DTMF *":
-
-					// }
-				}
+	}
+
+	fromCurrent := AreUAddrsEqual(addr, ss.RemoteMedia)
+	if !fromCurrent && !ss.mediaLatch.isOpen() {
+		fmt.Println("Received RTP from unknown remote connection")
+		return
+	}
+	if n < RTPHeadersSize {
+		return
+	}
+	if ss.rtcpMux && rtp.IsRTCP(bytes) {
+		if fromCurrent {
+			ss.processRTCP(bytes)
+		}
+		return
+	}
+	// a latching candidate has to look like the negotiated stream
+	if !fromCurrent && (bytes[0]>>6 != 2 || !ss.isNegotiatedPayload(bytes[1]&0x7F)) {
+		return
+	}
+	if srtpRx := ss.srtpRx.Load(); srtpRx != nil || ss.srtpRequired {
+		if srtpRx == nil {
+			return
+		}
+		var err error
+		if bytes, err = srtpRx.UnprotectRTP(bytes); err != nil {
+			return
+		}
+		n = len(bytes)
+	}
+	if accept, latch := ss.mediaLatch.check(addr, fromCurrent, binary.BigEndian.Uint32(bytes[8:12]), binary.BigEndian.Uint16(bytes[2:4])); !accept {
+		return
+	} else if latch {
+		ss.latchMedia(addr)
+	}
+	ss.touchMedia()
+	ss.mediaStats.OnReceived(binary.BigEndian.Uint32(bytes[8:12]), binary.BigEndian.Uint16(bytes[2:4]), binary.BigEndian.Uint32(bytes[4:8]),
+		n-RTPHeadersSize, codecClockRate(ss.rtpCodec), time.Now())
+	// comfort noise (RFC 3389) carries no audio nor DTMF - a partially collected inband tone is discarded
+	if pt := bytes[1] & 0x7F; ss.WithCN && pt == ss.rtpCNPayload {
+		ss.NewDTMF = false
+		ss.PCMSamples = ss.PCMSamples[:0]
+		return
+	}
+	if ss.WithTeleEvents {
+		if n == 16 { // TODO check if no RFC 4733 is negotiated - transcode InBand DTMF into teleEvents
+			ts := binary.BigEndian.Uint32(bytes[4:8]) //TODO check how to use IsSystemBigEndian
+			if ss.rtpRFC4733TS != ts {
+				ss.rtpRFC4733TS = ts
+				dtmf := DicDTMFEvent[bytes[12]]
+				ss.processDTMF(dtmf, "Inband - RTP Telephone Event (RFC 4733) - Received: ")
+				// switch dtmf {
+				// case "DTMF #":
+				// 	// ss.stopRTPStreaming() // TODO use this if audiofile can be interrupted by any DTMF or a specific DTMF or not at all
+				// case "DTMF *":
+
+				// }
 			}
-		} else {
-			if n == RTPHeadersSize+PayloadSize {
-				b1 := bytes[1]
-				if b1 >= 128 {
-					ss.NewDTMF = true
-					ss.PCMBytes = ss.PCMBytes[:0]
-				} else if ss.NewDTMF {
-					payload := bytes[12:]
-					if len(ss.PCMBytes) == DTMFPacketsCount*len(payload) {
-						ss.PCMBytes = append(ss.PCMBytes, payload...)
-						ss.NewDTMF = false
-						pcm := rtp.DecodeToPCM(ss.PCMBytes, ss.rtpPayloadType)
-						signal := dtmf.DetectDTMF(pcm)
-						if signal != "" {
-							dtmf := DicDTMFEvent[DicDTMFSignal[signal]]
-							frmt := ss.LocalSDP.GetChosenMedia().FormatByPayload(ss.rtpPayloadType)
-							ss.processDTMF(dtmf, fmt.Sprintf("Inband - RTP Audio Tone (%s) - Received: ", frmt.Name))
-						}
-					} else {
-						ss.PCMBytes = append(ss.PCMBytes, payload...)
+		}
+	} else {
+		if n > RTPHeadersSize {
+			if bytes[1] >= 128 { // marker - start of a talkspurt
+				ss.NewDTMF = true
+				ss.PCMSamples = ss.PCMSamples[:0]
+				ss.dtmfPackets = 0
+			} else if ss.NewDTMF {
+				// decoded packet by packet, the Opus ones having no fixed size
+				if ss.rxDecoder == nil || ss.rxDecoder.Codec() != ss.rtpCodec {
+					if ss.rxDecoder != nil {
+						ss.rxDecoder.Close()
+					}
+					ss.rxDecoder = rtp.NewDecoder(ss.rtpCodec)
+				}
+				ss.PCMSamples = append(ss.PCMSamples, ss.rxDecoder.Decode(bytes[RTPHeadersSize:])...)
+				if ss.dtmfPackets++; ss.dtmfPackets > DTMFPacketsCount {
+					ss.NewDTMF = false
+					signal := dtmf.DetectDTMF(ss.PCMSamples)
+					if signal != "" {
+						dtmf := DicDTMFEvent[DicDTMFSignal[signal]]
+						frmt := ss.LocalSDP.GetChosenMedia().FormatByPayload(ss.rtpPayloadType)
+						ss.processDTMF(dtmf, fmt.Sprintf("Inband - RTP Audio Tone (%s) - Received: ", frmt.Name))
 					}
 				}
 			}
 		}
+	}
+}
+
+func (ss *SipSession) rtcpReceiver() {
+	for {
+		if ss.RTCPListener == nil {
+			return
+		}
+		buf := RTPRXBufferPool.Get().(*[]byte)
+		n, addr, err := ss.RTCPListener.ReadFromUDP(*buf)
+		if err != nil {
+			RTPRXBufferPool.Put(buf)
+			if _, ok := err.(*net.OpError); ok {
+				return
+			}
+			fmt.Println(err)
+			continue
+		}
+		if ss.RemoteMedia != nil && addr.IP.Equal(ss.RemoteMedia.IP) {
+			// symmetric RTCP follows the latched RTP source
+			if ss.processRTCP((*buf)[:n]) && ss.mediaLatch.isLatched() && !AreUAddrsEqual(addr, ss.RemoteRTCP) {
+				ss.RemoteRTCP = addr
+			}
+		}
 		RTPRXBufferPool.Put(buf)
 	}
 }
 
+// processRTCP accounts a received RTCP compound packet, reporting whether it was valid
+func (ss *SipSession) processRTCP(pkt []byte) bool {
+	if srtpRx := ss.srtpRx.Load(); srtpRx != nil || ss.srtpRequired {
+		if srtpRx == nil {
+			return false
+		}
+		var err error
+		if pkt, err = srtpRx.UnprotectRTCP(pkt); err != nil {
+			LogWarning(LTMediaStack, fmt.Sprintf("Call-ID [%s] - %v", ss.CallID, err))
+			return false
+		}
+	}
+	rpt, err := rtp.ParseRTCP(pkt)
+	if err != nil {
+		LogWarning(LTMediaStack, fmt.Sprintf("Call-ID [%s] - %v", ss.CallID, err))
+		return false
+	}
+	ss.mediaStats.OnRTCP(rpt, ss.rtpSSRC, time.Now())
+	return true
+}
+
+// sendRTCPReport sends a Sender Report with the reception report of the remote stream, or a Receiver Report when no
+// RTP was sent since the previous report
+func (ss *SipSession) sendRTCPReport(now time.Time) {
+	ss.rtcpLastSent = now
+	conn := ss.RTCPListener
+	if ss.rtcpMux {
+		conn = ss.MediaListener
+	}
+	if conn == nil || ss.RemoteRTCP == nil {
+		return
+	}
+	cname := fmt.Sprintf("mrf@%s", ServerIPv4)
+	var pkt []byte
+	if pkts, octets, ts, sending := ss.mediaStats.SenderInfo(now, codecClockRate(ss.rtpCodec)); sending {
+		pkt = rtp.BuildSR(ss.rtpSSRC, now, ts, pkts, octets, ss.mediaStats.ReportBlock(now), cname)
+	} else {
+		pkt = rtp.BuildRR(ss.rtpSSRC, ss.mediaStats.ReportBlock(now), cname)
+	}
+	if srtpTx := ss.srtpTx.Load(); srtpTx != nil || ss.srtpRequired {
+		if srtpTx == nil {
+			return
+		}
+		var err error
+		if pkt, err = srtpTx.ProtectRTCP(pkt); err != nil {
+			LogWarning(LTMediaStack, fmt.Sprintf("Call-ID [%s] - %v", ss.CallID, err))
+			return
+		}
+	}
+	if _, err := conn.WriteToUDP(pkt, ss.RemoteRTCP); err != nil && !errors.Is(err, net.ErrClosed) { // released meanwhile
+		LogWarning(LTMediaStack, fmt.Sprintf("Call-ID [%s] - failed to send RTCP: %v", ss.CallID, err))
+	}
+}
+
 func (ss *SipSession) parseDTMF(bytes []byte, m Method, bt BodyType) {
 	strng := string(bytes)
 	var mtch []string
@@ -334,6 +736,9 @@ func (ss *SipSession) parseDTMF(bytes []byte, m Method, bt BodyType) {
 
 func (ss *SipSession) processDTMF(dtmf, details string) {
 	ss.lastDTMF = dtmf
+	if ss.origination != nil {
+		ss.origination.collectDigit(dtmf)
+	}
 	if ss.bargeEnabled && ss.stopRTPStreaming() {
 		LogInfo(LTMediaCapability, "Audio streaming has been interrupted")
 	}
@@ -432,7 +837,7 @@ func (ss *SipSession) startRTPStreaming(audiokey string, resetflag, loopflag, dr
 	ss.isrtpstreaming = true
 	ss.rtpmutex.Unlock()
 
-	origPayload := ss.rtpPayloadType
+	origCodec := ss.rtpCodec
 
 	// TODO see if i can support more codecs
 	// pcm, ok := ss.MRFRepo.Get(afname) // TODO build repos and manage them from UI
@@ -451,91 +856,102 @@ func (ss *SipSession) startRTPStreaming(audiokey string, resetflag, loopflag, dr
 	// }
 
 	isFinished := true // to know that streaming has reached its end
+	completed := false // the prompt was played to its end
 
 	{
-		data, silence, ok := ss.MRFRepo.GetTx(audiokey, origPayload)
-		if !ok {
+		data, ok := ss.MRFRepo.GetTx(audiokey, origCodec)
+		if !ok || len(data) == 0 {
 			goto finish1
 		}
 
-		tckr := time.NewTicker(20 * time.Millisecond)
-		defer tckr.Stop()
-
 		Marker := true
 
-		if resetflag {
+		var cnLevels []byte
+		if ss.WithCN {
+			cnLevels, _ = ss.MRFRepo.GetCN(audiokey)
+		}
+		silentCount := 0 // packets replaced by comfort noise since the last audio packet
+
+		if resetflag || ss.rtpIndex >= len(data) {
 			ss.rtpIndex = 0
 		}
 
-		for {
-			select {
-			case <-ss.rtpChan:
-				isFinished = false
-				goto finish2
-			case <-tckr.C:
-			}
+		codecChanged, failed := false, false
 
-			if origPayload != ss.rtpPayloadType {
-				defer ss.startRTPStreaming(audiokey, false, loopflag, dropCallflag)
-				goto finish1
+		// frame is called by the shared pacer on each 20 ms boundary of the stream, it returns false once done
+		frame := func(out *udpio.Batch) bool {
+			if origCodec != ss.rtpCodec {
+				codecChanged = true
+				return false
 			}
 
 			// TODO uncomment below to allow pausing streaming when call is held
 			// if ss.IsCallHeld {
-			// 	goto finish1
+			// 	return false
 			// }
 
-			ss.rtpTimeStmp += uint32(RTPPayloadSize)
-			if ss.rtpSequenceNum == math.MaxUint16 {
-				ss.rtpSequenceNum = 0
-			} else {
-				ss.rtpSequenceNum++
-			}
+			ss.rtpTimeStmp += rtp.ClockTicksPerPacket(origCodec)
 
-			delta := len(data) - ss.rtpIndex
-			var payload []byte
-			if RTPPayloadSize <= delta {
-				payload = (data)[ss.rtpIndex : ss.rtpIndex+RTPPayloadSize]
-				ss.rtpIndex += RTPPayloadSize
-				isFinished = false
-			} else {
-				payload = (data)[ss.rtpIndex : ss.rtpIndex+delta]
-				for n := delta; n < RTPPayloadSize; n++ {
-					payload = append(payload, silence)
-				}
-				ss.rtpIndex += delta
-				isFinished = true
+			payload := data[ss.rtpIndex]
+			var cnLevel byte
+			if ss.rtpIndex < len(cnLevels) && ss.WithCN {
+				cnLevel = cnLevels[ss.rtpIndex]
 			}
-
-			if !ss.IsCallHeld {
-				pktptr := RTPTXBufferPool.Get().(*[]byte)
-				pkt := (*pktptr)[:0]
-				pkt = append(pkt, 128)
-				pkt = append(pkt, bool2byte(Marker)*128+ss.rtpPayloadType)
-				pkt = append(pkt, uint16ToBytes(ss.rtpSequenceNum)...)
-				pkt = append(pkt, uint32ToBytes(ss.rtpTimeStmp)...)
-				pkt = append(pkt, uint32ToBytes(ss.rtpSSRC)...)
-				pkt = append(pkt, payload...)
-				_, err := ss.MediaListener.WriteToUDP(pkt, ss.RemoteMedia)
-				if err != nil {
-					goto finish1
+			ss.rtpIndex++
+			isFinished = ss.rtpIndex == len(data)
+
+			switch {
+			case cnLevel != 0:
+				// silence is sent as comfort noise (RFC 3389) when it begins then periodically
+				if silentCount%rtp.CNUpdatePackets == 0 {
+					if err := ss.sendRTP(out, ss.rtpCNPayload, false, []byte{cnLevel}); err != nil {
+						failed = true
+						return false
+					}
+				}
+				silentCount++
+				Marker = true
+			case len(payload) == 0:
+				// empty payload is a discontinuous transmission period (G.729 Annex B) - nothing is sent
+				Marker = true
+			default:
+				silentCount = 0
+				if err := ss.sendRTP(out, ss.rtpPayloadType, Marker, payload); err != nil {
+					failed = true
+					return false
 				}
-				RTPTXBufferPool.Put(pktptr)
+				Marker = false
 			}
 
-			Marker = false
-
 			if isFinished {
+				ss.rtpIndex = 0
 				if loopflag {
-					ss.rtpIndex = 0
 					isFinished = false
 					Marker = true
-					continue
+					return true
 				}
-				ss.rtpIndex = 0
-				break
+				return false
 			}
+			return true
+		}
+
+		stream := RTPPacer.Start(frame)
+		select {
+		case <-ss.rtpChan:
+			stream.Stop()
+			isFinished = false
+			goto finish2
+		case <-stream.Done():
+		}
+
+		if codecChanged {
+			defer ss.startRTPStreaming(audiokey, false, loopflag, dropCallflag)
+			goto finish1
+		}
+		if failed {
+			goto finish1
 		}
+		completed = true
 	}
 
 finish1:
@@ -545,6 +961,12 @@ finish1:
 	}
 
 finish2:
+	// the silence after a prompt played to its end is signalled with comfort noise
+	if completed && ss.WithCN && !dropCallflag && !ss.IsDisposed {
+		ss.rtpTimeStmp += rtp.ClockTicksPerPacket(ss.rtpCodec)
+		_ = ss.sendRTP(nil, ss.rtpCNPayload, false, []byte{rtp.CNDefaultLevel})
+	}
+
 	ss.rtpmutex.Lock()
 	ss.isrtpstreaming = false
 	ss.rtpmutex.Unlock()
@@ -556,25 +978,46 @@ finish2:
 	return !isFinished
 }
 
-// =========================================================================================================================
-
-func bool2byte(b bool) byte {
-	if b {
-		return 1
+// sendRTP sends the payload with the next sequence number and the current timestamp - nothing is sent while the call is held.
+// With a batch, the packet is built in it and sent when the batch is flushed.
+func (ss *SipSession) sendRTP(out *udpio.Batch, pt uint8, marker bool, payload []byte) error {
+	if ss.rtpSequenceNum == math.MaxUint16 {
+		ss.rtpSequenceNum = 0
+	} else {
+		ss.rtpSequenceNum++
 	}
-	return 0
-}
 
-func uint16ToBytes(num uint16) []byte {
-	bytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(bytes, num)
-	return bytes
-}
+	srtpTx := ss.srtpTx.Load()
+	if ss.IsCallHeld || (ss.srtpRequired && srtpTx == nil) {
+		return nil
+	}
 
-func uint32ToBytes(num uint32) []byte {
-	bytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(bytes, num)
-	return bytes
+	var pkt []byte
+	if out != nil {
+		pkt = out.Buffer()
+	} else {
+		pktptr := RTPTXBufferPool.Get().(*[]byte)
+		defer RTPTXBufferPool.Put(pktptr)
+		pkt = (*pktptr)[:0]
+	}
+	pkt = rtp.AppendHeader(pkt, marker, pt, ss.rtpSequenceNum, ss.rtpTimeStmp, ss.rtpSSRC)
+	pkt = append(pkt, payload...)
+	if srtpTx != nil {
+		var err error
+		if pkt, err = srtpTx.ProtectRTP(pkt); err != nil {
+			return err
+		}
+	}
+	if out != nil {
+		out.Add(ss.mediaIO, pkt, ss.RemoteMedia)
+		ss.mediaStats.OnSent(len(payload), ss.rtpTimeStmp)
+		return nil
+	}
+	_, err := ss.MediaListener.WriteToUDP(pkt, ss.RemoteMedia)
+	if err == nil {
+		ss.mediaStats.OnSent(len(payload), ss.rtpTimeStmp)
+	}
+	return err
 }
 
 // ============================================================================
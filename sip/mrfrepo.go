@@ -23,7 +23,16 @@ type MRFRepo struct {
 	name    string
 	mu      sync.RWMutex
 	pcmdata map[string][]int16
-	txdata  map[string]map[uint8][]byte
+	txdata  map[string]map[uint8][][]byte
+	cndata  map[string][]byte
+
+	codecPolicy *CodecPreference // nil to apply DefaultCodecPreference
+	srtpPolicy  *SRTPPolicy      // nil to apply DefaultSRTPPolicy
+	rtpLatching *bool            // nil to apply DefaultRTPLatching
+	mediaRealm  *MediaRealm      // nil to select the realm from the source network
+	earlyMedia  *EarlyMedia      // nil to apply DefaultEarlyMedia
+
+	sessionTimer *SessionTimer // nil to apply DefaultSessionTimer
 }
 
 type MRFRepoCollection struct {
@@ -55,7 +64,7 @@ func getExtension(fn string) string {
 
 func loadMedia(rn string) map[string]*MRFRepo {
 	mrfrepos := make(map[string]*MRFRepo)
-	mrfrepo := MRFRepo{name: rn, pcmdata: make(map[string][]int16), txdata: make(map[string]map[uint8][]byte)}
+	mrfrepo := MRFRepo{name: rn, pcmdata: make(map[string][]int16), txdata: make(map[string]map[uint8][][]byte), cndata: make(map[string][]byte)}
 	mrfrepos[rn] = &mrfrepo
 
 	dentries, err := os.ReadDir(global.MediaPath)
@@ -101,7 +110,7 @@ func loadMedia(rn string) map[string]*MRFRepo {
 		fmt.Printf("Filename: %s%s, Duration: %s\n", filename, comment, formattedTime(duration))
 
 		mrfrepo.pcmdata[filenameonly] = pcmBytes
-		mrfrepo.txdata[filenameonly] = make(map[uint8][]byte)
+		mrfrepo.txdata[filenameonly] = make(map[uint8][][]byte)
 	}
 
 	return mrfrepos
@@ -155,20 +164,39 @@ func (mrfrp *MRFRepo) AudioFileExists(key string) bool {
 	return false
 }
 
-func (mrfrp *MRFRepo) GetTx(key string, codec uint8) ([]byte, byte, bool) {
+// returns the audio file pre-encoded into 20 ms RTP payloads - encoding happens once per codec
+func (mrfrp *MRFRepo) GetTx(key string, codec uint8) ([][]byte, bool) {
 	mrfrp.mu.Lock()
 	defer mrfrp.mu.Unlock()
-	silence := rtp.GetSilence(codec)
 	txdata, ok := mrfrp.txdata[key]
 	if !ok {
-		return nil, 0, false
+		return nil, false
+	}
+	txpkts, ok := txdata[codec]
+	if !ok {
+		txpkts = rtp.EncodePackets(mrfrp.pcmdata[key], codec)
+		if txpkts == nil {
+			return nil, false
+		}
+		txdata[codec] = txpkts
+	}
+	return txpkts, true
+}
+
+// returns per 20 ms RTP payload the comfort noise level to be sent instead, 0 for audio - computed once
+func (mrfrp *MRFRepo) GetCN(key string) ([]byte, bool) {
+	mrfrp.mu.Lock()
+	defer mrfrp.mu.Unlock()
+	pcm, ok := mrfrp.pcmdata[key]
+	if !ok {
+		return nil, false
 	}
-	txbytes, ok := txdata[codec]
+	levels, ok := mrfrp.cndata[key]
 	if !ok {
-		txbytes = rtp.EncodePCM(mrfrp.pcmdata[key], codec)
-		txdata[codec] = txbytes
+		levels = rtp.ComfortNoiseLevels(pcm)
+		mrfrp.cndata[key] = levels
 	}
-	return txbytes, silence, true
+	return levels, true
 }
 
 func (mrfrp *MRFRepo) FilesCount() int {
@@ -182,3 +210,30 @@ func (mrfrp *MRFRepo) FilesCount() int {
 // 	defer mrfr.mu.Unlock()
 // 	mrfr.repos[upart][key] = bytes
 // }
+
+// initRoutePolicy parses the global policy text, given to setDefault, then the policy of each route (MRF repository),
+// given to apply - name is used in the warnings of the policies ignored. Routes have no global policy when setDefault
+// is nil, and apply rejects a policy not usable with its repository by returning an error.
+func initRoutePolicy[T any](name, text string, routes map[string]string, parse func(string) (T, error), setDefault func(T), apply func(*MRFRepo, T) error) {
+	if text != "" && setDefault != nil {
+		if p, err := parse(text); err != nil {
+			global.LogWarning(global.LTConfiguration, fmt.Sprintf("%s of all routes ignored - %v", name, err))
+		} else {
+			setDefault(p)
+		}
+	}
+	for route, text := range routes {
+		repo, ok := MRFRepos.GetMRFRepo(route)
+		if !ok {
+			global.LogWarning(global.LTConfiguration, fmt.Sprintf("%s ignored - MRF Repository [%s] not found", name, route))
+			continue
+		}
+		p, err := parse(text)
+		if err == nil {
+			err = apply(repo, p)
+		}
+		if err != nil {
+			global.LogWarning(global.LTConfiguration, fmt.Sprintf("%s of MRF Repository [%s] ignored - %v", name, route, err))
+		}
+	}
+}
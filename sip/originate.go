@@ -0,0 +1,502 @@
+package sip
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/guid"
+	"mrfgo/q850"
+	"mrfgo/sip/mode"
+	"mrfgo/sip/state"
+	"mrfgo/sip/status"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbound calls: mrfgo sends an INVITE with an SDP offer to a peer, and once answered plays prompts from a route
+// (MRF repository), optionally collecting DTMF digits, then releases the call. Progress is reported to a callback URL
+// and to an in-process handler. The INVITE is cancelled when not answered within the ring timeout, answers a digest
+// challenge (401/407) once per nonce when credentials are given, and follows up to maxRedirections 3xx.
+
+const (
+	defaultRingTimeoutSec  = 60
+	defaultDigitTimeoutSec = 10
+	maxRedirections        = 3
+	originationRetention   = 15 * time.Minute // ended outbound calls stay visible through the API that long
+)
+
+// OriginationRequest describes an outbound call
+type OriginationRequest struct {
+	To           string   // user part, or user@host[:port], of the Request-URI
+	Peer         string   // host[:port] the INVITE is sent to, the Request-URI host when empty
+	From         string   // user part of the From header
+	Route        string   // MRF repository of the prompts
+	Prompts      []string // played in order once answered
+	Repeat       int      // times the prompts are played, once when 0
+	Digits       int      // DTMF digits collected after the prompts (barge-in enabled), none when 0
+	DigitTimeout int      // seconds to wait for the digits
+	RingTimeout  int      // seconds before the INVITE is cancelled
+	CallbackURL  string   // progress events are POSTed there as JSON
+	Username     string   // digest credentials toward the peer, optional
+	Password     string
+}
+
+// OriginationEvent reports the progress of an outbound call: trying, ringing, answered then ended
+type OriginationEvent struct {
+	CallID   string
+	Event    string
+	Status   int    // last final SIP status received, 0 when none
+	Reason   string // reason phrase of that status, or why the call ended
+	State    string // final session state, with ended
+	Digits   string // DTMF digits collected
+	Answered bool
+	Duration int // seconds answered, with ended
+	Time     time.Time
+}
+
+// Origination is an outbound call in progress
+type Origination struct {
+	OriginationRequest
+
+	onEvent    func(OriginationEvent)
+	ss         *SipSession
+	ruriUser   string
+	ruriHost   string
+	redirected int
+	nonces     map[string]bool // challenges already answered
+	authHeader HeaderEnum
+	authValue  string
+	ringTimer  *time.Timer
+	lastRSeq   uint32
+
+	mu         sync.Mutex
+	status     int
+	reason     string
+	ringing    bool
+	answeredAt time.Time
+	endedAt    time.Time
+	digits     string
+	digitsDone chan struct{} // closed once the requested digits are collected
+	last       OriginationEvent
+}
+
+var (
+	originations   = make(map[string]*Origination)
+	originationsMu sync.Mutex
+)
+
+// Originate validates the request and sends the INVITE - onEvent, optional, is called for each event and must not block
+func Originate(req OriginationRequest, onEvent func(OriginationEvent)) (*Origination, error) {
+	if serverConn == nil {
+		return nil, errors.New("SIP stack not started")
+	}
+	repo, ok := MRFRepos.GetMRFRepo(req.Route)
+	if !ok {
+		return nil, fmt.Errorf("MRF Repository [%s] not found", req.Route)
+	}
+	if len(req.Prompts) == 0 {
+		return nil, errors.New("no prompt")
+	}
+	for _, prompt := range req.Prompts {
+		if !repo.AudioFileExists(prompt) {
+			return nil, fmt.Errorf("prompt [%s] not found in MRF Repository [%s]", prompt, req.Route)
+		}
+	}
+	if req.Repeat < 0 || req.Digits < 0 || req.DigitTimeout < 0 || req.RingTimeout < 0 {
+		return nil, errors.New("negative value")
+	}
+	oc := &Origination{OriginationRequest: req, onEvent: onEvent, nonces: make(map[string]bool), digitsDone: make(chan struct{})}
+	oc.Repeat = max(oc.Repeat, 1)
+	oc.RingTimeout = cmp.Or(oc.RingTimeout, defaultRingTimeoutSec)
+	oc.DigitTimeout = cmp.Or(oc.DigitTimeout, defaultDigitTimeoutSec)
+	oc.From = cmp.Or(oc.From, "mrfgo")
+	var err error
+	if oc.ruriUser, oc.ruriHost, err = parseTarget(req.To); err != nil {
+		return nil, err
+	}
+	peer := resolvePeer(oc.Peer, oc.ruriHost)
+	if peer == nil {
+		return nil, fmt.Errorf("cannot resolve peer [%s]", cmp.Or(oc.Peer, oc.ruriHost))
+	}
+
+	ss := NewSS(OUTBOUND)
+	ss.CallID = guid.NewCallID()
+	ss.Mode = mode.Multimedia
+	ss.SIPUDPListenser = serverConn
+	ss.RemoteUDP = peer
+	ss.MRFRepo = repo
+	ss.IsPRACKSupported = true
+	oc.ss = ss
+
+	ss.rtpSSRC = RandomNum(2000, 9000000)
+	ss.rtpSequenceNum = uint16(RandomNum(1000, 2000))
+	ss.SDPSessionID = int64(RandomNum(1000, 9000))
+	ss.SDPSessionVersion = 1
+	if sc, _, wr := ss.buildSDPOffer(); sc != 0 {
+		ss.DropMe()
+		return nil, errors.New(wr)
+	}
+	ss.origination = oc
+
+	originationsMu.Lock()
+	pruneOriginations()
+	originations[ss.CallID] = oc
+	originationsMu.Unlock()
+	oc.notify("trying")
+
+	oc.ringTimer = time.AfterFunc(time.Duration(oc.RingTimeout)*time.Second, func() {
+		if ss.CancelMe(q850.NoAnswerFromUser, "Ring timeout") {
+			oc.setReason("Ring timeout")
+		}
+	})
+	ss.SetState(state.BeingEstablished)
+	ss.AddMe()
+	oc.sendInvite()
+	return oc, nil
+}
+
+// GetOrigination returns an outbound call in progress or recently ended
+func GetOrigination(callID string) (*Origination, bool) {
+	originationsMu.Lock()
+	defer originationsMu.Unlock()
+	oc, ok := originations[callID]
+	return oc, ok
+}
+
+// pruneOriginations - originationsMu held
+func pruneOriginations() {
+	for callID, oc := range originations {
+		if ended, at := oc.endTime(); ended && time.Since(at) > originationRetention {
+			delete(originations, callID)
+		}
+	}
+}
+
+// parseTarget returns the user and host parts (empty when absent) of a user part or a SIP URI
+func parseTarget(to string) (string, string, error) {
+	uri := strings.TrimSpace(to)
+	if i := strings.IndexByte(uri, '<'); i >= 0 {
+		uri = uri[i+1:]
+	}
+	uri = strings.TrimPrefix(strings.TrimPrefix(uri, "sips:"), "sip:")
+	uri, _, _ = strings.Cut(uri, ";")
+	uri, _, _ = strings.Cut(uri, ">")
+	user, host, _ := strings.Cut(uri, "@")
+	if user == "" {
+		return "", "", fmt.Errorf("invalid destination [%s]", to)
+	}
+	return user, host, nil
+}
+
+// resolvePeer resolves where the INVITE goes: the peer, or the Request-URI host - port 5060 by default
+func resolvePeer(peer, host string) *net.UDPAddr {
+	hostport := cmp.Or(peer, host)
+	if hostport == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "5060")
+	}
+	addr, err := net.ResolveUDPAddr("udp4", hostport)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+// sendInvite sends the INVITE with the SDP offer, with the Authorization answering the last challenge if any
+func (oc *Origination) sendInvite() {
+	ss := oc.ss
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(Supported, supportedHeader())
+	if policy := ss.sessionTimerPolicy(); policy.enabled {
+		hdrs.AddHeader(Session_Expires, fmt.Sprintf("%d", max(policy.interval, ss.sessionExpires)))
+		hdrs.AddHeader(Min_SE, fmt.Sprintf("%d", policy.minSE))
+	}
+	trans := ss.CreateSARequest(RequestPack{Method: INVITE, Max70: true, CustomHeaders: hdrs, RUriUP: oc.ruriUser, RUriHost: oc.ruriHost, FromUP: oc.From}, NewMessageSDPBody(ss.LocalSDP.Bytes()))
+	if oc.authValue != "" {
+		trans.RequestMessage.Headers.AddHeader(oc.authHeader, oc.authValue)
+	}
+	ss.SendSTMessage(trans)
+}
+
+// processInviteResponse handles the responses to our INVITE
+func (ss *SipSession) processInviteResponse(trans *Transaction, sipmsg *SipMessage) {
+	oc := ss.origination
+	sc := sipmsg.StartLine.StatusCode
+	switch {
+	case sc == status.Trying:
+	case IsProvisional(sc):
+		ss.acknowledgeReliable18x(sipmsg)
+		if ss.sdpAnswerPending && sipmsg.Body.ContainsSDP() && !ss.acceptInviteAnswer(sipmsg) {
+			return
+		}
+		oc.mu.Lock()
+		first := !oc.ringing
+		oc.ringing = true
+		oc.mu.Unlock()
+		if first {
+			oc.notify("ringing")
+		}
+	case IsPositive(sc):
+		oc.stopRinging()
+		oc.setStatus(sc, sipmsg.StartLine.ReasonPhrase)
+		ss.SendRequest(ACK, trans, EmptyBody())
+		if !ss.IsBeingEstablished() { // cancelled meanwhile
+			ss.SetState(state.Established)
+			ss.ReleaseMe("Call cancelled")
+			return
+		}
+		ss.FinalizeState()
+		if ss.sdpAnswerPending && !ss.acceptInviteAnswer(sipmsg) {
+			return
+		}
+		if se, refresher, ok := sipmsg.sessionExpires(); ok {
+			ss.sessionExpires = se
+			ss.sessionRefresher = refresher != "uas"
+			ss.sessionRefresh = ss.sessionTimerPolicy().method
+			ss.startSessionTimer()
+		}
+		oc.mu.Lock()
+		oc.answeredAt = time.Now()
+		oc.mu.Unlock()
+		oc.notify("answered")
+		ss.StartMaxCallDuration()
+		if ss.sessionExpires == 0 {
+			ss.StartInDialogueProbing()
+		}
+		ss.touchMedia()
+		ss.startMediaReceivers()
+		go oc.play()
+	default:
+		oc.setStatus(sc, sipmsg.StartLine.ReasonPhrase)
+		if ss.IsBeingEstablished() && oc.retryInvite(trans, sipmsg) {
+			return
+		}
+		oc.stopRinging()
+		switch {
+		case ss.GetState() == state.BeingCancelled:
+			ss.Ack3xxTo6xxFinalize()
+		case IsRedirection(sc):
+			ss.Ack3xxTo6xx(state.Redirected)
+		default:
+			ss.Ack3xxTo6xx(state.Rejected)
+		}
+	}
+}
+
+// acknowledgeReliable18x sends a PRACK for each new reliable provisional response (RFC 3262)
+func (ss *SipSession) acknowledgeReliable18x(sipmsg *SipMessage) {
+	oc := ss.origination
+	rseq, ok := Str2IntCheck[int64](strings.TrimSpace(sipmsg.Headers.ValueHeader(RSeq)))
+	if !ok || !sipmsg.IsOptionRequired("100rel") || uint32(rseq) <= oc.lastRSeq {
+		return
+	}
+	oc.lastRSeq = uint32(rseq)
+	ss.SendRequest(PRACK, ss.GenerateOutgoingPRACKST(sipmsg), EmptyBody())
+}
+
+// acceptInviteAnswer applies the SDP answer to our offer, or releases the call when missing or unacceptable
+func (ss *SipSession) acceptInviteAnswer(sipmsg *SipMessage) bool {
+	sc, qc, wr := ss.applySDPAnswer(sipmsg)
+	if sc == 0 {
+		return true
+	}
+	LogWarning(LTSDPStack, fmt.Sprintf("Call-ID [%s] - SDP answer to outbound INVITE rejected (%d) - %s", ss.CallID, sc, wr))
+	ss.origination.setReason(wr)
+	if ss.IsBeingEstablished() {
+		ss.CancelMe(qc, wr)
+	} else {
+		ss.ReleaseMeDetailed(qc, wr)
+	}
+	return false
+}
+
+// retryInvite resends the INVITE after a digest challenge, a redirection or a too small session interval
+func (oc *Origination) retryInvite(trans *Transaction, sipmsg *SipMessage) bool {
+	ss := oc.ss
+	var retry func()
+	switch sc := sipmsg.StartLine.StatusCode; {
+	case sc == status.Unauthorized || sc == status.ProxyAuthenticationRequired:
+		ch, hdr, ok := sipmsg.digestChallenge()
+		if !ok || oc.Username == "" || oc.nonces[ch.Nonce] {
+			return false
+		}
+		oc.nonces[ch.Nonce] = true
+		retry = func() {
+			oc.authHeader = hdr
+			oc.authValue = ch.Authorization(INVITE, fmt.Sprintf("sip:%s@%s", oc.ruriUser, cmp.Or(oc.ruriHost, ss.RemoteUDP.String())), oc.Username, oc.Password)
+		}
+	case IsRedirection(sc):
+		user, host, err := parseTarget(sipmsg.RCURI)
+		if oc.redirected >= maxRedirections || sipmsg.RCURI == "" || err != nil {
+			return false
+		}
+		addr := resolvePeer("", host)
+		if addr == nil {
+			return false
+		}
+		retry = func() {
+			oc.redirected++
+			oc.ruriUser, oc.ruriHost, oc.Peer = user, host, ""
+			oc.authValue = ""
+			ss.RemoteUDP = addr
+			LogInfo(LTSIPStack, fmt.Sprintf("Call-ID [%s] - outbound call redirected to [%s]", ss.CallID, sipmsg.RCURI))
+		}
+	case sc == status.SessionIntervalTooSmall:
+		minSE := sipmsg.minSE()
+		if minSE <= ss.sessionExpires || minSE <= ss.sessionTimerPolicy().interval {
+			return false
+		}
+		retry = func() { ss.sessionExpires = minSE }
+	default:
+		return false
+	}
+	ss.SendRequest(ACK, trans, EmptyBody())
+	retry()
+	// the new INVITE starts a new dialogue
+	ss.ToTag = ""
+	ss.RemoteContactURI, ss.RemoteContactUDP = "", nil
+	ss.RecordRouteURI, ss.RecordRouteUDP = "", nil
+	oc.lastRSeq = 0
+	oc.sendInvite()
+	return true
+}
+
+// play streams the prompts, collects the digits if requested, then releases the call
+func (oc *Origination) play() {
+	defer func() {
+		if r := recover(); r != nil {
+			LogCallStack(r)
+		}
+	}()
+	ss := oc.ss
+	ss.bargeEnabled = oc.Digits > 0
+prompts:
+	for i := 0; i < oc.Repeat; i++ {
+		for _, prompt := range oc.Prompts {
+			if !ss.IsEstablished() {
+				return
+			}
+			if ss.startRTPStreaming(prompt, true, false, false) { // interrupted by a digit
+				break prompts
+			}
+		}
+	}
+	if oc.Digits > 0 {
+		timer := time.NewTimer(time.Duration(oc.DigitTimeout) * time.Second)
+		select {
+		case <-oc.digitsDone:
+		case <-timer.C:
+			oc.setReason("Digit timeout")
+		case <-ss.maxDprobDoneChan:
+		}
+		timer.Stop()
+	}
+	ss.ReleaseMeDetailed(q850.NormalCallClearing, "Outbound call completed")
+}
+
+// collectDigit records a DTMF digit received while digits are expected
+func (oc *Origination) collectDigit(dtmf string) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if oc.Digits == 0 || oc.answeredAt.IsZero() || len(oc.digits) >= oc.Digits {
+		return
+	}
+	oc.digits += dtmf
+	if len(oc.digits) == oc.Digits || dtmf == "#" {
+		close(oc.digitsDone)
+		oc.Digits = len(oc.digits)
+	}
+}
+
+// Hangup cancels the outbound call, or releases it once answered
+func (oc *Origination) Hangup() bool {
+	oc.setReason("Hung up through the API")
+	if oc.ss.CancelMe(q850.NormalCallClearing, "Hung up") {
+		return true
+	}
+	return oc.ss.ReleaseMeDetailed(q850.NormalCallClearing, "Hung up")
+}
+
+// ended reports the end of the call, from DropMe - multiUseMutex held
+func (oc *Origination) ended() {
+	oc.stopRinging()
+	oc.mu.Lock()
+	oc.endedAt = time.Now()
+	oc.mu.Unlock()
+	oc.notify("ended")
+}
+
+func (oc *Origination) stopRinging() {
+	if oc.ringTimer != nil {
+		oc.ringTimer.Stop()
+	}
+}
+
+func (oc *Origination) setStatus(sc int, reason string) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	oc.status, oc.reason = sc, reason
+}
+
+func (oc *Origination) setReason(reason string) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	oc.reason = reason
+}
+
+func (oc *Origination) endTime() (bool, time.Time) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	return !oc.endedAt.IsZero(), oc.endedAt
+}
+
+// Status returns the last event of the call
+func (oc *Origination) Status() OriginationEvent {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	return oc.last
+}
+
+// notify records the event and reports it to the handler and the callback URL
+func (oc *Origination) notify(event string) {
+	oc.mu.Lock()
+	ev := OriginationEvent{CallID: oc.ss.CallID, Event: event, Status: oc.status, Reason: oc.reason, Digits: oc.digits, Answered: !oc.answeredAt.IsZero(), Time: time.Now()}
+	if event == "ended" {
+		ev.State = oc.ss.GetState().String()
+		if !oc.answeredAt.IsZero() {
+			ev.Duration = int(oc.endedAt.Sub(oc.answeredAt).Seconds())
+		}
+	}
+	oc.last = ev
+	oc.mu.Unlock()
+
+	if oc.onEvent != nil {
+		oc.onEvent(ev)
+	}
+	if oc.CallbackURL != "" {
+		go postOriginationEvent(oc.CallbackURL, ev)
+	}
+}
+
+var callbackClient = &http.Client{Timeout: 5 * time.Second}
+
+func postOriginationEvent(url string, ev OriginationEvent) {
+	body, _ := json.Marshal(ev)
+	resp, err := callbackClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		LogWarning(LTWebserver, fmt.Sprintf("Call-ID [%s] - callback [%s] failed - %v", ev.CallID, url, err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		LogWarning(LTWebserver, fmt.Sprintf("Call-ID [%s] - callback [%s] answered %s", ev.CallID, url, resp.Status))
+	}
+}
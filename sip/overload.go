@@ -0,0 +1,157 @@
+package sip
+
+import (
+	"fmt"
+	"mrfgo/cl"
+	. "mrfgo/global"
+	"mrfgo/q850"
+	"mrfgo/sip/status"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OverloadControl admits new inbound INVITEs, others being rejected with 503 and Retry-After: a token bucket limits the
+// call rate of all sources together and another one that of each source IP, the concurrent inbound calls are capped,
+// and calls are refused while the SIP packet queue backlog or the CPU usage of mrfgo is above its threshold.
+//
+// Syntax: "[cps=<calls/s>] [burst=<calls>] [source_cps=<calls/s>] [source_burst=<calls>] [calls=<concurrent calls>]
+// [queue=<% of the packet queue>] [cpu=<% of the CPUs>] [retry_after=<seconds>]", no limit when 0, bursts defaulting
+// to the rates.
+type OverloadControl struct {
+	cps         int
+	burst       int
+	sourceCPS   int
+	sourceBurst int
+	calls       int
+	queue       int
+	cpu         int
+	retryAfter  int
+
+	globalBucket *cl.TokenBucket
+	sourceBucket *cl.SourceLimiter
+}
+
+const defaultRetryAfter = 5
+
+var (
+	Overload = &OverloadControl{retryAfter: defaultRetryAfter}
+
+	inboundCalls atomic.Int64
+	cpuUsage     atomic.Int64 // percent of the CPUs used by mrfgo in the last second
+)
+
+func NewOverloadControl(text string) (*OverloadControl, error) {
+	oc := &OverloadControl{retryAfter: defaultRetryAfter}
+	for _, field := range strings.Fields(text) {
+		key, value, _ := strings.Cut(field, "=")
+		limit, ok := Str2IntCheck[int](value)
+		if !ok || limit < 0 {
+			return nil, fmt.Errorf("invalid %s [%s]", key, value)
+		}
+		switch strings.ToLower(key) {
+		case "cps":
+			oc.cps = limit
+		case "burst":
+			oc.burst = limit
+		case "source_cps":
+			oc.sourceCPS = limit
+		case "source_burst":
+			oc.sourceBurst = limit
+		case "calls":
+			oc.calls = limit
+		case "queue", "cpu":
+			if limit > 100 {
+				return nil, fmt.Errorf("invalid %s [%s]", key, value)
+			}
+			if strings.EqualFold(key, "queue") {
+				oc.queue = limit
+			} else {
+				oc.cpu = limit
+			}
+		case "retry_after":
+			oc.retryAfter = limit
+		default:
+			return nil, fmt.Errorf("unknown field [%s]", key)
+		}
+	}
+	return oc, nil
+}
+
+func (oc *OverloadControl) String() string {
+	return fmt.Sprintf("cps %d (burst %d), source cps %d (burst %d), calls %d, queue %d%%, cpu %d%%, retry after %d s",
+		oc.cps, max(oc.burst, oc.cps), oc.sourceCPS, max(oc.sourceBurst, oc.sourceCPS), oc.calls, oc.queue, oc.cpu, oc.retryAfter)
+}
+
+func initOverloadControl() {
+	if OverloadGlobal != "" {
+		if oc, err := NewOverloadControl(OverloadGlobal); err != nil {
+			LogWarning(LTConfiguration, fmt.Sprintf("Overload control ignored - %v", err))
+		} else {
+			Overload = oc
+		}
+	}
+	if Overload.cps > 0 {
+		Overload.globalBucket = cl.NewTokenBucket(float64(Overload.cps), max(Overload.burst, Overload.cps))
+	}
+	if Overload.sourceCPS > 0 {
+		Overload.sourceBucket = cl.NewSourceLimiter(float64(Overload.sourceCPS), max(Overload.sourceBurst, Overload.sourceCPS), &WtGrp)
+	}
+	for limit, value := range map[string]int{"cps": Overload.cps, "source_cps": Overload.sourceCPS, "calls": Overload.calls,
+		"queue": Overload.queue, "cpu": Overload.cpu, "retry_after": Overload.retryAfter} {
+		Prometrics.OverloadLimits.WithLabelValues(limit).Set(float64(value))
+	}
+	WtGrp.Add(1)
+	go monitorLoad()
+}
+
+// monitorLoad measures every second the CPU usage and the packet queue backlog
+func monitorLoad() {
+	defer WtGrp.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastCPU, ok := processCPUTime()
+	lastTime := time.Now()
+	for now := range ticker.C {
+		if cpuTime, measured := processCPUTime(); ok && measured {
+			usage := 100 * (cpuTime - lastCPU).Seconds() / now.Sub(lastTime).Seconds() / float64(runtime.NumCPU())
+			cpuUsage.Store(int64(usage))
+			Prometrics.CPUUsage.Set(usage)
+			lastCPU, lastTime = cpuTime, now
+		}
+		Prometrics.PacketQueueDepth.Set(float64(len(packetQueue)))
+		Prometrics.InboundCalls.Set(float64(inboundCalls.Load()))
+	}
+}
+
+// admitCall checks the overload control for a new INVITE from src, once admitted by the access control, else sets
+// the 503 rejecting it
+func (ss *SipSession) admitCall(sipmsg *SipMessage, src *net.UDPAddr) NewSessionType {
+	oc := Overload
+	reject := func(sesType NewSessionType, reason, details string) NewSessionType {
+		ss.rejection = ResponsePack{StatusCode: status.ServiceUnavailable,
+			CustomHeaders: NewSHQ850OrSIP(q850.SwitchingEquipmentCongestion, details, strconv.Itoa(oc.retryAfter))}
+		Prometrics.OverloadRejections.WithLabelValues(reason).Inc()
+		LogWarning(LTSIPStack, fmt.Sprintf("Call-ID [%s] - INVITE from %s rejected - %s", sipmsg.CallID, src, details))
+		return sesType
+	}
+	switch {
+	case oc.queue > 0 && len(packetQueue)*100 >= cap(packetQueue)*oc.queue:
+		return reject(Overloaded, "queue", "Server overloaded")
+	case oc.cpu > 0 && cpuUsage.Load() >= int64(oc.cpu):
+		return reject(Overloaded, "cpu", "Server overloaded")
+	case oc.sourceBucket != nil && !oc.sourceBucket.AcceptNewCall(src.IP.String()):
+		return reject(ExceededCallRate, "source_cps", "Source call rate exceeded")
+	case oc.globalBucket != nil && !oc.globalBucket.AcceptNewCall():
+		return reject(ExceededCallRate, "cps", "Call rate exceeded")
+	}
+	if n := inboundCalls.Add(1); oc.calls > 0 && n > int64(oc.calls) {
+		inboundCalls.Add(-1)
+		return reject(Overloaded, "calls", "Concurrent calls exceeded")
+	}
+	ss.isInboundCall = true
+	return ValidRequest
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package sip
+
+import "time"
+
+// processCPUTime is not measured, CPU based overload detection being unavailable
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
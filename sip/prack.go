@@ -0,0 +1,91 @@
+package sip
+
+import (
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/q850"
+	"mrfgo/sip/status"
+	"time"
+)
+
+// Reliable provisional responses (RFC 3262): 18x responses to an INVITE from a caller supporting or requiring 100rel
+// carry RSeq and Require: 100rel, and are retransmitted by the INVITE transaction timer (T1, doubling) until PRACKed.
+// The 2xx is only sent once the last reliable provisional response is PRACKed, and the INVITE is rejected with 504
+// when no PRACK comes within 64*T1. A PRACK may carry the answer to an offer sent in a reliable 18x, or a new offer
+// answered in its 200.
+
+// expectPRACK records that a reliable provisional response is sent - TransLock held
+func (session *SipSession) expectPRACK() {
+	session.prackPending = make(chan struct{})
+}
+
+// prackReceived releases what waits for the PRACK - TransLock held
+func (session *SipSession) prackReceived() {
+	if session.prackPending != nil {
+		close(session.prackPending)
+		session.prackPending = nil
+	}
+}
+
+// waitPRACK waits until the last reliable provisional response is PRACKed, it returns false on timeout or drop
+func (ss *SipSession) waitPRACK() bool {
+	ss.TransLock.RLock()
+	pending := ss.prackPending
+	ss.TransLock.RUnlock()
+	if pending == nil {
+		return true
+	}
+	timer := time.NewTimer(64 * time.Duration(T1Timer) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-pending:
+		return true
+	case <-timer.C:
+	case <-ss.maxDprobDoneChan: // closed when the session is dropped
+	}
+	return false
+}
+
+// sendAnswerAfterPRACK sends the 2xx to the INVITE once the reliable provisional responses are PRACKed
+func (ss *SipSession) sendAnswerAfterPRACK(trans *Transaction) {
+	if !ss.waitPRACK() || !ss.IsBeingEstablished() {
+		return
+	}
+	if ss.sdpAnswerPending { // offer sent in the reliable 18x, the PRACK came without answer
+		ss.sdpAnswerPending = false
+		ss.RejectMe(trans, status.NotAcceptableHere, q850.MandatoryInformationElementIsMissing, "No SDP answer in PRACK")
+		return
+	}
+	ss.SendResponse(trans, status.OK, NewMessageSDPBody(ss.LocalSDP.Bytes()))
+}
+
+// processPRACK answers a PRACK, applying the SDP answer or answering the SDP offer it carries
+func (ss *SipSession) processPRACK(trans *Transaction, sipmsg *SipMessage) {
+	switch trans.PrackStatus {
+	case PRACKUnexpected:
+		ss.SendResponseDetailed(trans, NewResponsePackWarning(status.CallTransactionDoesNotExist, "No matching reliable provisional response"), EmptyBody())
+		return
+	case PRACKMissingBadRAck:
+		ss.SendResponseDetailed(trans, NewResponsePackWarning(status.BadRequest, "Missing or malformed RAck"), EmptyBody())
+		return
+	}
+	switch {
+	case !sipmsg.Body.ContainsSDP():
+		ss.SendResponse(trans, status.OK, EmptyBody())
+	case ss.sdpAnswerPending:
+		// the PRACK itself succeeds, an unacceptable answer fails the INVITE
+		sc, qc, wr := ss.applySDPAnswer(sipmsg)
+		ss.SendResponse(trans, status.OK, EmptyBody())
+		if sc != 0 {
+			LogWarning(LTSDPStack, fmt.Sprintf("Call-ID [%s] - SDP answer in PRACK rejected (%d) - %s", ss.CallID, sc, wr))
+			ss.RejectMe(nil, sc, qc, wr)
+		}
+	default:
+		sc, qc, wr := ss.buildSDPAnswer(sipmsg)
+		if sc != 0 {
+			ss.SendResponseDetailed(trans, NewResponsePackSIPQ850Details(sc, qc, wr), EmptyBody())
+			return
+		}
+		ss.SendResponse(trans, status.OK, NewMessageSDPBody(ss.LocalSDP.Bytes()))
+	}
+}
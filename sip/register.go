@@ -0,0 +1,289 @@
+package sip
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	. "mrfgo/global"
+	"mrfgo/guid"
+	"mrfgo/sip/mode"
+	"mrfgo/sip/state"
+	"mrfgo/sip/status"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registration registers an account with a registrar (RFC 3261 §10), for PBXs routing only to registered endpoints.
+// The Contact is the AOR user at the SIP address of mrfgo, and INVITEs to it are routed to the route of the account.
+// The binding is refreshed before it expires; after a failure, REGISTER is retried with an exponential backoff.
+//
+// Syntax: "aor=sip:<user>@<domain> [user=<auth user>] [password=<password>] [expires=<seconds>] [proxy=<host[:port]>]
+// [route=<MRF repository>]", the REGISTER being sent to the outbound proxy, or the AOR domain - port 5060 by default.
+type Registration struct {
+	Name     string
+	aorUser  string
+	aorHost  string
+	authUser string
+	password string
+	proxy    string
+	route    string
+
+	registrar *net.UDPAddr // resolved once, the SIP worker reading it from the session
+	ss        *SipSession  // created by the first send, from initRegistrations
+
+	// the SIP worker handling the responses and the retry timer both use them
+	mu         sync.Mutex
+	expires    int
+	challenge  *DigestChallenge // kept for the refreshes, its nonce count increasing
+	authHeader HeaderEnum
+	nonces     map[string]bool // challenges already answered since the last success
+	registered bool
+	expiresAt  time.Time
+	failures   int
+	lastStatus int
+	lastReason string
+	timer      *time.Timer
+}
+
+const (
+	defaultRegisterExpires = 3600
+	minRegisterExpires     = 60
+	registerRetryMin       = 30 * time.Second
+	registerRetryMax       = 30 * time.Minute
+)
+
+var Registrations []*Registration
+
+func NewRegistration(name, text string) (*Registration, error) {
+	reg := &Registration{Name: name, expires: defaultRegisterExpires, nonces: make(map[string]bool)}
+	for _, field := range strings.Fields(text) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "aor":
+			user, host, err := parseTarget(value)
+			if err != nil || host == "" {
+				return nil, fmt.Errorf("invalid AOR [%s]", value)
+			}
+			reg.aorUser, reg.aorHost = user, host
+		case "user":
+			reg.authUser = value
+		case "password":
+			reg.password = value
+		case "expires":
+			sec, ok := Str2IntCheck[int](value)
+			if !ok || sec < minRegisterExpires {
+				return nil, fmt.Errorf("invalid expires [%s]", value)
+			}
+			reg.expires = sec
+		case "proxy":
+			reg.proxy = value
+		case "route":
+			reg.route = value
+		default:
+			return nil, fmt.Errorf("unknown field [%s]", key)
+		}
+	}
+	if reg.aorUser == "" {
+		return nil, fmt.Errorf("no AOR")
+	}
+	reg.authUser = cmp.Or(reg.authUser, reg.aorUser)
+	reg.route = cmp.Or(reg.route, reg.aorUser)
+	if reg.registrar = resolvePeer(reg.proxy, reg.aorHost); reg.registrar == nil {
+		return nil, fmt.Errorf("cannot resolve registrar [%s]", cmp.Or(reg.proxy, reg.aorHost))
+	}
+	return reg, nil
+}
+
+func (reg *Registration) String() string {
+	return fmt.Sprintf("%s (sip:%s@%s via %s, route %s)", reg.Name, reg.aorUser, reg.aorHost, cmp.Or(reg.proxy, reg.aorHost), reg.route)
+}
+
+func initRegistrations() {
+	for _, name := range slices.Sorted(maps.Keys(RegisterAccounts)) {
+		reg, err := NewRegistration(name, RegisterAccounts[name])
+		if err != nil {
+			LogWarning(LTConfiguration, fmt.Sprintf("Registration [%s] ignored - %v", name, err))
+			continue
+		}
+		if _, ok := MRFRepos.GetMRFRepo(reg.route); !ok {
+			LogWarning(LTConfiguration, fmt.Sprintf("Registration [%s] - MRF Repository [%s] not found", name, reg.route))
+		}
+		Registrations = append(Registrations, reg)
+		reg.send()
+	}
+}
+
+// registeredRoute returns the route of the account whose Contact is the Request-URI user
+func registeredRoute(user string) (string, bool) {
+	for _, reg := range Registrations {
+		if reg.aorUser == user {
+			return reg.route, true
+		}
+	}
+	return "", false
+}
+
+// send sends a REGISTER, with the credentials answering the last challenge if any
+func (reg *Registration) send() {
+	if reg.ss == nil {
+		ss := NewSS(OUTBOUND)
+		ss.CallID = guid.NewCallID() // kept for the refreshes (RFC 3261 §10.2.4)
+		ss.Mode = mode.Registration
+		ss.SIPUDPListenser = serverConn
+		ss.registration = reg
+		ss.RemoteUDP = reg.registrar
+		ss.SetState(state.Unregistered)
+		ss.AddMe()
+		reg.ss = ss
+	}
+	ss := reg.ss
+
+	reg.mu.Lock()
+	expires, authHeader := reg.expires, reg.authHeader
+	var auth string
+	if reg.challenge != nil {
+		auth = reg.challenge.Authorization(REGISTER, "sip:"+reg.aorHost, reg.authUser, reg.password)
+	}
+	reg.mu.Unlock()
+
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(Expires, strconv.Itoa(expires))
+	trans := ss.CreateSARequest(RequestPack{Method: REGISTER, Max70: true, CustomHeaders: hdrs, RUriHost: reg.aorHost, FromUP: reg.aorUser}, EmptyBody())
+	if auth != "" {
+		trans.RequestMessage.Headers.AddHeader(authHeader, auth)
+	}
+	ss.SendSTMessage(trans)
+}
+
+// ended drops a REGISTER transaction answered or timed out, once its retransmitted responses are no longer expected -
+// the session lives as long as mrfgo
+func (reg *Registration) ended(trans *Transaction) {
+	ss := reg.ss
+	time.AfterFunc(64*time.Duration(T1Timer)*time.Millisecond, func() { ss.DropTransaction(trans) })
+}
+
+// processResponse handles the final response to our REGISTER
+func (reg *Registration) processResponse(sipmsg *SipMessage) {
+	sc := sipmsg.StartLine.StatusCode
+	switch {
+	case IsPositive(sc):
+		granted := reg.grantedExpires(sipmsg)
+		reg.mu.Lock()
+		clear(reg.nonces)
+		reg.registered, reg.failures = true, 0
+		reg.lastStatus, reg.lastReason = sc, sipmsg.StartLine.ReasonPhrase
+		reg.expiresAt = time.Now().Add(time.Duration(granted) * time.Second)
+		reg.mu.Unlock()
+		reg.ss.SetState(state.Registered)
+		LogInfo(LTSIPStack, fmt.Sprintf("Registration [%s] - registered for %d s", reg.Name, granted))
+		// refreshed before expiry, leaving time for a challenge and retransmissions
+		reg.schedule(time.Duration(granted-min(granted/2, 60)) * time.Second)
+	case sc == status.Unauthorized || sc == status.ProxyAuthenticationRequired:
+		ch, hdr, ok := sipmsg.digestChallenge()
+		reg.mu.Lock()
+		if ok = ok && reg.password != "" && !reg.nonces[ch.Nonce]; ok {
+			reg.nonces[ch.Nonce] = true
+			reg.challenge, reg.authHeader = ch, hdr
+		}
+		reg.mu.Unlock()
+		if !ok {
+			reg.failed(sc, "Authentication failed")
+			return
+		}
+		reg.send()
+	case sc == status.IntervalTooBrief:
+		minExpires, ok := Str2IntCheck[int](strings.TrimSpace(sipmsg.Headers.ValueHeader(Min_Expires)))
+		reg.mu.Lock()
+		if ok = ok && minExpires > reg.expires; ok {
+			reg.expires = minExpires
+		}
+		reg.mu.Unlock()
+		if !ok {
+			reg.failed(sc, sipmsg.StartLine.ReasonPhrase)
+			return
+		}
+		reg.send()
+	default:
+		reg.failed(sc, sipmsg.StartLine.ReasonPhrase)
+	}
+}
+
+// grantedExpires returns the expiry of our binding in a 2xx: the expires parameter of our Contact, else the Expires
+// header, else the one requested
+func (reg *Registration) grantedExpires(sipmsg *SipMessage) int {
+	ours := fmt.Sprintf("%s@%s", reg.aorUser, reg.ss.localSIPAddr())
+	_, contacts := sipmsg.Headers.ValuesHeader(Contact)
+	for _, value := range contacts {
+		for _, contact := range strings.Split(value, ",") {
+			var mtch []string
+			if strings.Contains(contact, ours) && RMatch(contact, ExpiresParameter, &mtch) {
+				if sec, ok := Str2IntCheck[int](mtch[1]); ok && sec > 0 {
+					return sec
+				}
+			}
+		}
+	}
+	if sec, ok := Str2IntCheck[int](strings.TrimSpace(sipmsg.Headers.ValueHeader(Expires))); ok && sec > 0 {
+		return sec
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.expires
+}
+
+// failed records a failure and schedules a new attempt, after 30 s doubled at each consecutive failure up to 30 min
+func (reg *Registration) failed(sc int, reason string) {
+	reg.mu.Lock()
+	reg.failures++
+	reg.lastStatus, reg.lastReason = sc, reason
+	if reg.registered && time.Now().After(reg.expiresAt) {
+		reg.registered = false
+	}
+	delay := min(registerRetryMin<<min(reg.failures-1, 10), registerRetryMax)
+	registered := reg.registered
+	clear(reg.nonces)
+	reg.challenge = nil
+	reg.mu.Unlock()
+	if !registered {
+		reg.ss.SetState(state.Unregistered)
+	}
+	LogWarning(LTSIPStack, fmt.Sprintf("Registration [%s] failed (%d) - %s - retry in %s", reg.Name, sc, reason, delay))
+	reg.schedule(delay)
+}
+
+func (reg *Registration) schedule(delay time.Duration) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.timer != nil {
+		reg.timer.Stop()
+	}
+	reg.timer = time.AfterFunc(delay, reg.send)
+}
+
+// RegistrationStatus reports the state of an account
+type RegistrationStatus struct {
+	Name       string
+	AOR        string
+	Registrar  string
+	Route      string
+	State      string
+	Expires    int // seconds left, when registered
+	Failures   int // consecutive
+	LastStatus int
+	LastReason string
+}
+
+func (reg *Registration) Status() RegistrationStatus {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	st := RegistrationStatus{Name: reg.Name, AOR: fmt.Sprintf("sip:%s@%s", reg.aorUser, reg.aorHost), Registrar: cmp.Or(reg.proxy, reg.aorHost), Route: reg.route,
+		State: state.Unregistered.String(), Failures: reg.failures, LastStatus: reg.lastStatus, LastReason: reg.lastReason}
+	if left := time.Until(reg.expiresAt); reg.registered && left > 0 {
+		st.State, st.Expires = state.Registered.String(), int(left.Seconds())
+	}
+	return st
+}
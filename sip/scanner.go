@@ -0,0 +1,247 @@
+package sip
+
+import (
+	"cmp"
+	"fmt"
+	"mrfgo/cl"
+	. "mrfgo/global"
+	"mrfgo/guid"
+	"mrfgo/q850"
+	"mrfgo/sip/status"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScannerProtection screens the requests creating a session (new Call-ID) before the session is created: a source whose
+// User-Agent is blocklisted, or sending such requests faster than allowed, is banned for a while. Requests from a banned
+// source are rejected with 403, or silently dropped. Trusted peers are never banned.
+//
+// Syntax: "off" or "[user_agents=<substring>[,...]] [rate=<requests/s>] [burst=<requests>] [ban=<seconds>] [drop=on|off]",
+// User-Agents being matched case-insensitively, and the rate limit per source IP being off when 0.
+type ScannerProtection struct {
+	enabled    bool
+	userAgents []string // lower case
+	rate       int
+	burst      int
+	ban        time.Duration
+	drop       bool
+
+	limiter *cl.SourceLimiter
+}
+
+// Ban is a source whose requests are refused until it expires
+type Ban struct {
+	Source    string
+	Reason    string
+	UserAgent string
+	Since     time.Time
+	Until     time.Time
+	Requests  int // refused since the ban
+}
+
+const defaultBanSec = 3600
+
+var (
+	defaultScannerUserAgents = []string{"friendly-scanner", "sipvicious", "sipcli", "sip-scan", "sundayddr", "iwar", "vaxsipuseragent"}
+
+	Scanner = &ScannerProtection{enabled: true, userAgents: defaultScannerUserAgents, ban: defaultBanSec * time.Second}
+
+	bans   = make(map[string]*Ban)
+	bansMu sync.Mutex
+)
+
+func NewScannerProtection(text string) (*ScannerProtection, error) {
+	sp := &ScannerProtection{userAgents: defaultScannerUserAgents, ban: defaultBanSec * time.Second}
+	if strings.EqualFold(strings.TrimSpace(text), "off") {
+		return sp, nil
+	}
+	sp.enabled = true
+	for _, field := range strings.Fields(text) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "user_agents":
+			sp.userAgents = nil
+			for _, ua := range strings.Split(value, ",") {
+				if ua = strings.ToLower(strings.TrimSpace(ua)); ua != "" {
+					sp.userAgents = append(sp.userAgents, ua)
+				}
+			}
+		case "rate", "burst", "ban":
+			n, ok := Str2IntCheck[int](value)
+			if !ok || n < 0 || (n == 0 && strings.EqualFold(key, "ban")) {
+				return nil, fmt.Errorf("invalid %s [%s]", key, value)
+			}
+			switch strings.ToLower(key) {
+			case "rate":
+				sp.rate = n
+			case "burst":
+				sp.burst = n
+			default:
+				sp.ban = time.Duration(n) * time.Second
+			}
+		case "drop":
+			switch strings.ToLower(value) {
+			case "on":
+				sp.drop = true
+			case "off":
+				sp.drop = false
+			default:
+				return nil, fmt.Errorf("invalid drop [%s]", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown field [%s]", key)
+		}
+	}
+	return sp, nil
+}
+
+func (sp *ScannerProtection) String() string {
+	if !sp.enabled {
+		return "off"
+	}
+	action := "reject"
+	if sp.drop {
+		action = "drop"
+	}
+	return fmt.Sprintf("user agents [%s], rate %d/s (burst %d), ban %s, %s", strings.Join(sp.userAgents, ", "), sp.rate, max(sp.burst, sp.rate), sp.ban, action)
+}
+
+func initScannerProtection() {
+	if ScannerProtect != "" {
+		if sp, err := NewScannerProtection(ScannerProtect); err != nil {
+			LogWarning(LTConfiguration, fmt.Sprintf("Scanner protection ignored - %v", err))
+		} else {
+			Scanner = sp
+		}
+	}
+	if Scanner.enabled && Scanner.rate > 0 {
+		Scanner.limiter = cl.NewSourceLimiter(float64(Scanner.rate), max(Scanner.burst, Scanner.rate), &WtGrp)
+	}
+}
+
+// screenRequest returns whether a request creating a session from src is refused, banning its source when it is a
+// scanner or a flood
+func screenRequest(sipmsg *SipMessage, src *net.UDPAddr) bool {
+	sp := Scanner
+	if !sp.enabled || trustedPeer(src.IP) != nil {
+		return false
+	}
+	source := src.IP.String()
+	now := time.Now()
+
+	bansMu.Lock()
+	if ban, ok := bans[source]; ok {
+		if now.Before(ban.Until) {
+			ban.Requests++
+			bansMu.Unlock()
+			return true
+		}
+		delete(bans, source)
+		Prometrics.BannedSources.Set(float64(len(bans)))
+	}
+	bansMu.Unlock()
+
+	// the ACK or CANCEL of a refused INVITE, and the requests of a dialogue, do not start a call: only new requests
+	// count against the rate
+	newRequest := sipmsg.ToTag == "" && sipmsg.GetMethod() != ACK && sipmsg.GetMethod() != CANCEL
+	ua := sipmsg.Headers.ValueHeader(User_Agent)
+	lua := strings.ToLower(ua)
+	switch {
+	case slices.ContainsFunc(sp.userAgents, func(s string) bool { return strings.Contains(lua, s) }):
+		banSource(source, "user_agent", ua, now)
+	case newRequest && sp.limiter != nil && !sp.limiter.AcceptNewCall(source):
+		banSource(source, "rate", ua, now)
+	default:
+		return false
+	}
+	return true
+}
+
+// refuseRequest answers a request from a banned source with 403 statelessly, no session being created for it, or
+// drops it
+func refuseRequest(sipmsg *SipMessage, src *net.UDPAddr, conn *net.UDPConn) {
+	if Scanner.drop || sipmsg.GetMethod() == ACK {
+		Prometrics.ScreenedRequests.WithLabelValues("dropped").Inc()
+		return
+	}
+	Prometrics.ScreenedRequests.WithLabelValues("rejected").Inc()
+	sipmsg.stampVia(src)
+
+	rspnspk := NewResponsePackSIPQ850Details(status.Forbidden, q850.CallRejected, "Source banned")
+	hdrs := NewSHsPointer(true)
+	for k, vs := range rspnspk.CustomHeaders.InternalMap() {
+		hdrs.AddHeaderValues(k, vs)
+	}
+	if _, vias := sipmsg.Headers.ValuesHeader(Via); len(vias) > 0 {
+		hdrs.AddHeaderValues(Via.String(), vias)
+	}
+	hdrs.AddHeader(From, sipmsg.Headers.ValueHeader(From))
+	hdrs.AddHeader(To, sipmsg.Headers.ValueHeader(To))
+	if !hdrs.ContainsToTag() {
+		hdrs.SetHeader(To, fmt.Sprintf("%s;tag=%s", hdrs.ValueHeader(To), guid.NewTag()))
+	}
+	hdrs.AddHeader(Call_ID, sipmsg.CallID)
+	hdrs.AddHeader(CSeq, sipmsg.Headers.ValueHeader(CSeq))
+
+	rsp := NewResponseMessage(rspnspk.StatusCode, "")
+	rsp.Headers = hdrs
+	body := EmptyBody()
+	rsp.Body = &body
+	rsp.PrepareMessageBytes(nil)
+	if _, err := conn.WriteToUDP(rsp.Body.MessageBytes, cmp.Or(sipmsg.ResponseUDP, src)); err != nil {
+		LogError(LTSIPStack, fmt.Sprintf("Failed to refuse request from %s - %v", src, err))
+	}
+}
+
+func banSource(source, reason, ua string, now time.Time) {
+	sp := Scanner
+	bansMu.Lock()
+	for s, ban := range bans {
+		if now.After(ban.Until) {
+			delete(bans, s)
+		}
+	}
+	bans[source] = &Ban{Source: source, Reason: reason, UserAgent: ua, Since: now, Until: now.Add(sp.ban), Requests: 1}
+	Prometrics.BannedSources.Set(float64(len(bans)))
+	bansMu.Unlock()
+	Prometrics.ScannerBans.WithLabelValues(reason).Inc()
+	LogWarning(LTSecurity, fmt.Sprintf("Source %s banned for %s - %s - User-Agent [%s]", source, sp.ban, reason, ua))
+}
+
+// Bans returns the sources currently banned, oldest first
+func Bans() []Ban {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+	now := time.Now()
+	lst := make([]Ban, 0, len(bans))
+	for _, ban := range bans {
+		if now.Before(ban.Until) {
+			lst = append(lst, *ban)
+		}
+	}
+	slices.SortFunc(lst, func(a, b Ban) int { return a.Since.Compare(b.Since) })
+	return lst
+}
+
+// Unban lifts the ban of a source, returning false when it is not banned
+func Unban(source string) bool {
+	if ip := net.ParseIP(source); ip != nil {
+		source = ip.String()
+	}
+	if Scanner.limiter != nil {
+		Scanner.limiter.Reset(source)
+	}
+	bansMu.Lock()
+	defer bansMu.Unlock()
+	ban, ok := bans[source]
+	if !ok || time.Now().After(ban.Until) {
+		return false
+	}
+	delete(bans, source)
+	Prometrics.BannedSources.Set(float64(len(bans)))
+	LogInfo(LTSecurity, fmt.Sprintf("Source %s unbanned", source))
+	return true
+}
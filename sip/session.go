@@ -6,12 +6,19 @@ import (
 	"log"
 	. "mrfgo/global"
 	"mrfgo/guid"
+	"mrfgo/q850"
+	"mrfgo/rtp"
 	"mrfgo/sdp"
 	"mrfgo/sip/mode"
 	"mrfgo/sip/state"
+	"mrfgo/sip/status"
+	"mrfgo/srtp"
+	"mrfgo/udpio"
 	"net"
 	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -40,6 +47,7 @@ type SipSession struct {
 
 	IsPRACKSupported   bool
 	IsDelayedOfferCall bool
+	sdpAnswerPending   bool // our last 2xx to an INVITE carried an offer, the answer comes in the ACK
 
 	ReferSubscription bool
 	Relayed18xNotify  []int
@@ -48,31 +56,74 @@ type SipSession struct {
 	RemoteContactUDP *net.UDPAddr
 	RecordRouteUDP   *net.UDPAddr
 	SIPUDPListenser  *net.UDPConn
-	RemoteUserAgent  *SipUdpUserAgent
-
-	RemoteMedia    *net.UDPAddr
-	MediaListener  *net.UDPConn
-	LocalSDP       *sdp.Session
-	WithTeleEvents bool
-	NewDTMF        bool
-	PCMBytes       []byte
-	IsCallHeld     bool
-	rtpChan        chan bool
-	rtpRFC4733TS   uint32
-	rtpSequenceNum uint16
-	rtpTimeStmp    uint32
-	rtpSSRC        uint32
-	rtpIndex       int
-	rtpPayloadType uint8
-	rtpmutex       sync.Mutex
-	isrtpstreaming bool
-	bargeEnabled   bool
-	lastDTMF       string
+
+	symmetricSignalling bool // in-dialogue requests and responses go where the requests come from (RFC 3581)
+	RemoteUserAgent     *SipUdpUserAgent
+
+	RemoteMedia     *net.UDPAddr
+	MediaListener   *net.UDPConn
+	mediaIO         *udpio.Conn // MediaListener with batched I/O
+	mediaPool       *MediaPool  // where MediaListener and RTCPListener ports are returned
+	mediaRxOnce     sync.Once   // starts mediaReceiver and rtcpReceiver, in the early dialogue or at ACK
+	RemoteRTCP      *net.UDPAddr
+	RTCPListener    *net.UDPConn
+	rtcpMux         bool
+	rtcpLastSent    time.Time   // mediaSweeper only
+	mediaActive     atomic.Bool // the media receivers run and the sockets are open
+	mediaStats      *rtp.Stats
+	srtpTx          atomic.Pointer[srtp.Context] // published by the DTLS handshake while the media runs
+	srtpRx          atomic.Pointer[srtp.Context]
+	srtpSuite       string
+	srtpLocalKey    string
+	srtpRemoteKey   string
+	srtpRequired    bool // nothing is sent nor accepted in clear, even before the SRTP keys are known
+	webrtc          *webRTCMedia
+	mediaLatch      mediaLatch
+	LocalSDP        *sdp.Session
+	WithTeleEvents  bool
+	WithCN          bool
+	NewDTMF         bool
+	PCMSamples      []int16 // inband DTMF collected after a marker bit
+	dtmfPackets     int
+	rxDecoder       *rtp.Decoder // decoder of the received stream, used by mediaReceiver only
+	IsCallHeld      bool
+	rtpNotExpected  bool // the remote sends no RTP (recvonly, inactive or null address), the hold timeout applying
+	rtpChan         chan bool
+	rtpRFC4733TS    uint32
+	rtpSequenceNum  uint16
+	rtpTimeStmp     uint32
+	rtpSSRC         uint32
+	rtpLastReceived atomic.Int64 // unix nanoseconds of the last received RTP, for the inactivity watchdog
+	rtpIndex        int
+	rtpPayloadType  uint8
+	rtpCodec        uint8
+	rtpCNPayload    uint8
+	rtpDTMFPayload  uint8
+	rtpmutex        sync.Mutex
+	isrtpstreaming  bool
+	bargeEnabled    bool
+	lastDTMF        string
 
 	FwdCSeq uint32
 	BwdCSeq uint32
 	RSeq    uint32
 
+	prackPending chan struct{} // closed once the last reliable provisional response is PRACKed - TransLock
+
+	sessionExpires   int         // negotiated session interval in seconds, 0 without session timer (RFC 4028)
+	sessionRefresher bool        // we send the session refreshes
+	sessionRefresh   Method      // UPDATE, or ReINVITE when the peer does not allow UPDATE
+	sessionTimer     *time.Timer // refresh or expiry - multiUseMutex
+
+	replacedSession *SipSession // dialogue released once this one is confirmed (RFC 3891)
+
+	origination  *Origination  // outbound call initiated through the API
+	registration *Registration // account registered by this session
+
+	trustedPeer   *TrustedPeer // peer the call came from, holding one of its concurrent calls
+	rejection     ResponsePack // response to an INVITE refused by the access or overload control
+	isInboundCall bool         // counted in the concurrent inbound calls
+
 	SDPSessionID      int64
 	SDPSessionVersion int64
 
@@ -92,6 +143,7 @@ func NewSS(dir Direction) *SipSession {
 		Direction:        dir,
 		maxDprobDoneChan: make(chan bool),
 		rtpChan:          make(chan bool),
+		mediaStats:       rtp.NewStats(),
 	}
 	return ss
 }
@@ -205,6 +257,8 @@ func (session *SipSession) AddIncomingRequest(requestMsg *SipMessage, lt *Transa
 			if prackST == nil {
 				prackST = NewSIPTransaction_RP(0, PRACKUnexpected)
 				LogError(LTSIPStack, fmt.Sprintf("Cannot find unPRACKed 1xx response for the incoming PRACK – Call-ID [%s]", requestMsg.CallID))
+			} else if prackST.RequestMessage == nil && rSeq == session.RSeq {
+				session.prackReceived()
 			}
 		} else {
 			prackST = NewSIPTransaction_RP(0, PRACKMissingBadRAck)
@@ -281,6 +335,15 @@ func (session *SipSession) AddTransaction(tx *Transaction) {
 	session.Transactions = append(session.Transactions, tx)
 }
 
+// DropTransaction removes a finished transaction, for sessions living long enough to accumulate them
+func (session *SipSession) DropTransaction(tx *Transaction) {
+	session.TransLock.Lock()
+	defer session.TransLock.Unlock()
+	if i := slices.Index(session.Transactions, tx); i != -1 {
+		session.Transactions = slices.Delete(session.Transactions, i, i+1)
+	}
+}
+
 func (session *SipSession) GetReOrInviteTransaction(cSeqNum uint32, isFinalized bool) *Transaction {
 	return Find(session.Transactions, func(tx *Transaction) bool {
 		return tx.Direction == INBOUND &&
@@ -366,7 +429,11 @@ func (session *SipSession) CreateSARequest(rqstpk RequestPack, body MessageBody)
 		session.Mode = mode.Multimedia
 		fallthrough
 	default: // Any other
-		session.FwdCSeq = uint32(RandomNum(1, 500))
+		if session.FwdCSeq == 0 {
+			session.FwdCSeq = uint32(RandomNum(1, 500))
+		} else {
+			session.FwdCSeq++ // resent after a challenge or a redirection
+		}
 	}
 	st := NewSIPTransaction_CRL(session.FwdCSeq, rqstpk.Method, nil)
 	session.PrepareSARequestHeaders(st, rqstpk, body)
@@ -385,32 +452,42 @@ func (session *SipSession) PrepareSARequestHeaders(st *Transaction, rqstpk Reque
 }
 
 func (session *SipSession) BuildSARequestHeaders(st *Transaction, rqstpk RequestPack, sipmsg *SipMessage) {
-	localsocket := GetUDPAddrFromConn(session.SIPUDPListenser)
+	localsocket := session.localSIPAddr()
 	localIP := localsocket.IP
-	remoteIP := session.RemoteUDP.IP
+	remoteHost := cmp.Or(rqstpk.RUriHost, session.RemoteUDP.IP.String())
 
 	// Set Start line
 	sl := sipmsg.StartLine
-	sl.HostPart = session.RemoteUDP.String()
+	sl.HostPart = cmp.Or(rqstpk.RUriHost, session.RemoteUDP.String())
 	sl.UserPart = rqstpk.RUriUP
 	switch rqstpk.Method {
 	case INVITE:
 		sl.UriParameters = &map[string]string{"user": "phone"}
 	}
 	sl.Ruri = fmt.Sprintf("%v:%v%v@%v%v", sl.UriScheme, sl.UserPart, GenerateParameters(sl.UserParameters), sl.HostPart, GenerateParameters(sl.UriParameters))
+	if rqstpk.Method == REGISTER { // registrar URI, From and To being the address-of-record
+		sl.Ruri = fmt.Sprintf("%v:%v", sl.UriScheme, sl.HostPart)
+	}
 
 	hdrs := NewSHsPointer(true)
 
-	// Set Call-ID
-	session.CallID = guid.NewCallID()
+	// Set Call-ID - kept when the request is resent
+	if session.CallID == "" {
+		session.CallID = guid.NewCallID()
+	}
 	hdrs.AddHeader(Call_ID, session.CallID)
 
 	// Set Via and Branch
-	hdrs.AddHeader(Via, fmt.Sprintf("%s;branch=%s", GenerateViaWithoutBranch(session.SIPUDPListenser), st.ViaBranch))
+	hdrs.AddHeader(Via, fmt.Sprintf("%s;branch=%s", GenerateViaWithoutBranch(session.localSIPAddr()), st.ViaBranch))
 
 	// Set From Header with tag
-	session.FromTag = guid.NewTag()
+	if session.FromTag == "" {
+		session.FromTag = guid.NewTag()
+	}
 	session.FromHeader = fmt.Sprintf("<sip:%s@%s;user=phone>;tag=%s", rqstpk.FromUP, localIP, session.FromTag)
+	if rqstpk.Method == REGISTER {
+		session.FromHeader = fmt.Sprintf("<sip:%s@%s>;tag=%s", rqstpk.FromUP, remoteHost, session.FromTag)
+	}
 	st.From = session.FromHeader
 	hdrs.AddHeader(From, session.FromHeader)
 
@@ -424,10 +501,22 @@ func (session *SipSession) BuildSARequestHeaders(st *Transaction, rqstpk Request
 	}
 
 	// Set To
-	session.ToHeader = fmt.Sprintf("<sip:%s@%s;user=phone>", rqstpk.RUriUP, remoteIP)
+	session.ToHeader = fmt.Sprintf("<sip:%s@%s;user=phone>", rqstpk.RUriUP, remoteHost)
+	if rqstpk.Method == REGISTER {
+		session.ToHeader = fmt.Sprintf("<sip:%s@%s>", rqstpk.FromUP, remoteHost)
+	}
 	st.To = session.ToHeader
 	hdrs.SetHeader(To, session.ToHeader)
 
+	// Set Max-Forwards and Contact
+	sipmsg.MaxFwds = 70
+	hdrs.AddHeader(Max_Forwards, "70")
+	if rqstpk.Method == REGISTER {
+		hdrs.AddHeader(Contact, fmt.Sprintf("<sip:%s@%s;transport=udp>", rqstpk.FromUP, localsocket))
+	} else {
+		hdrs.AddHeader(Contact, GenerateContact(localsocket))
+	}
+
 	// Set CSeq
 	st.CSeq = session.FwdCSeq
 	hdrs.AddHeader(CSeq, fmt.Sprintf("%d %s", session.FwdCSeq, rqstpk.Method.String()))
@@ -466,7 +555,7 @@ func (session *SipSession) CreateHeadersForResponse(trans *Transaction, rspnspk
 
 	// Add Contact header
 	if rspnspk.ContactHeader == "" {
-		localsocket := GetUDPAddrFromConn(session.SIPUDPListenser)
+		localsocket := session.localSIPAddr()
 		hdrs.AddHeader(Contact, GenerateContact(localsocket))
 	} else {
 		hdrs.AddHeader(Contact, rspnspk.ContactHeader)
@@ -492,7 +581,9 @@ func (session *SipSession) CreateHeadersForResponse(trans *Transaction, rspnspk
 	}
 
 	// Add mandatory headers
-	hdrs.AddHeader(Via, sipmsg.Headers.ValueHeader(Via))
+	if _, vias := sipmsg.Headers.ValuesHeader(Via); len(vias) > 0 {
+		hdrs.AddHeaderValues(Via.String(), vias)
+	}
 	hdrs.AddHeader(From, sipmsg.Headers.ValueHeader(From))
 	hdrs.AddHeader(To, sipmsg.Headers.ValueHeader(To))
 	hdrs.AddHeader(CSeq, sipmsg.Headers.ValueHeader(CSeq))
@@ -521,6 +612,17 @@ func (session *SipSession) CreateHeadersForResponse(trans *Transaction, rspnspk
 		}
 		hdrs.AddHeader(Record_Route, sipmsg.Headers.ValueHeader(Record_Route))
 
+		// Add capabilities, and session timer headers for session refresh requests, to 2xx
+		if IsPositive(sc) && trans.Direction == INBOUND {
+			switch trans.Method {
+			case INVITE, ReINVITE, UPDATE:
+				addCapabilityHeaders(hdrs, trans.Method)
+				session.addSessionTimerHeaders(trans, hdrs)
+			case OPTIONS:
+				addCapabilityHeaders(hdrs, trans.Method)
+			}
+		}
+
 		// remoteses := session.LinkedSession
 		// prackRequested := remoteses != nil && remoteses.AreTherePendingOutgoingPRACK()
 		prackRequested := rspnspk.PRACKRequested || rspnspk.LinkedPRACKST != nil
@@ -552,6 +654,7 @@ func (session *SipSession) GenerateRSeqCreatePRACKSTSYNC(linkedPRACKST *Transact
 		session.RSeq++
 	}
 	pst := NewSIPTransaction_RP(session.RSeq, PRACKExpected)
+	session.expectPRACK()
 	if linkedPRACKST != nil {
 		pst.LinkedTransaction = linkedPRACKST
 		linkedPRACKST.LinkedTransaction = pst
@@ -705,7 +808,7 @@ func (session *SipSession) PrepareRequestHeaders(trans *Transaction, rqstpk Requ
 	hdrs := NewSHsPointer(true)
 	sipmsg.Headers = hdrs
 
-	localsocket := GetUDPAddrFromConn(session.SIPUDPListenser)
+	localsocket := session.localSIPAddr()
 
 	sl := sipmsg.StartLine
 	sl.Ruri = session.RemoteContactURI
@@ -719,6 +822,15 @@ func (session *SipSession) PrepareRequestHeaders(trans *Transaction, rqstpk Requ
 		hdrs.SetHeader(From, session.ToHeader)
 	}
 
+	// CANCEL and ACK to a non-2xx belong to the INVITE transaction: same Request-URI, and To for CANCEL (RFC 3261 §9.1, §17.1.1.3)
+	if session.isFirstHopRequest(trans) && trans.LinkedTransaction.RequestMessage != nil {
+		invite := trans.LinkedTransaction.RequestMessage
+		sl.Ruri = invite.StartLine.Ruri
+		if rqstpk.Method == CANCEL {
+			hdrs.SetHeader(To, invite.Headers.ValueHeader(To))
+		}
+	}
+
 	// Add RAck header if the request type is PRACK
 	if rqstpk.Method == PRACK {
 		hdrs.SetHeader(RAck, trans.RAck)
@@ -748,7 +860,7 @@ func (session *SipSession) PrepareRequestHeaders(trans *Transaction, rqstpk Requ
 	// Add Contact, Call-ID, and Via headers
 	hdrs.SetHeader(Contact, GenerateContact(localsocket))
 	hdrs.SetHeader(Call_ID, session.CallID)
-	hdrs.AddHeader(Via, fmt.Sprintf("%s;branch=%s", GenerateViaWithoutBranch(session.SIPUDPListenser), trans.ViaBranch))
+	hdrs.AddHeader(Via, fmt.Sprintf("%s;branch=%s", GenerateViaWithoutBranch(session.localSIPAddr()), trans.ViaBranch))
 }
 
 func (session *SipSession) ProcessRequestHeaders(trans *Transaction, sipmsg *SipMessage, rqstpk RequestPack, msgBody MessageBody) {
@@ -921,14 +1033,14 @@ func (session *SipSession) Send(tx *Transaction) {
 	if len(tx.SentMessage.Body.MessageBytes) == 0 {
 		tx.SentMessage.PrepareMessageBytes(session)
 	}
-	if tx.SentMessage.IsRequest() && session.RemoteContactUDP != nil {
-		_, err := session.SIPUDPListenser.WriteToUDP(tx.SentMessage.Body.MessageBytes, session.RemoteContactUDP)
-		if err != nil {
-			LogError(LTSystem, "Failed to send message: "+err.Error())
-		}
-		return
+	dest := session.requestDestination()
+	switch {
+	case !tx.SentMessage.IsRequest():
+		dest = session.responseDestination(tx)
+	case tx.Method == INVITE || tx.Method == REGISTER || session.isFirstHopRequest(tx):
+		dest = session.RemoteUDP
 	}
-	_, err := session.SIPUDPListenser.WriteToUDP(tx.SentMessage.Body.MessageBytes, session.RemoteUDP)
+	_, err := session.SIPUDPListenser.WriteToUDP(tx.SentMessage.Body.MessageBytes, dest)
 	if err != nil {
 		LogError(LTSystem, "Failed to send message: "+err.Error())
 	}
@@ -947,6 +1059,11 @@ func CheckPendingTransaction(ss *SipSession, tx *Transaction) {
 			ss.ReleaseMe("Probing timed-out")
 		}
 	case INVITE:
+		if tx.Direction == INBOUND && !tx.IsFinalized && ss.IsBeingEstablished() {
+			// reliable provisional response never PRACKed (RFC 3262 §3) - the transaction lock is held
+			go ss.RejectMe(tx, status.ServerTimeout, q850.RecoveryOnTimerExpiry, "Reliable provisional response not PRACKed")
+			return
+		}
 		if ss.IsPending() {
 			ss.SetState(state.TimedOut)
 			ss.DropMe()
@@ -957,6 +1074,11 @@ func CheckPendingTransaction(ss *SipSession, tx *Transaction) {
 	case PRACK:
 		ss.SetState(state.Failed)
 		ss.DropMe()
+	case REGISTER:
+		if ss.registration != nil {
+			ss.registration.ended(tx)
+			ss.registration.failed(0, "No response from registrar")
+		}
 	default:
 		ss.ReleaseMe(fmt.Sprintf("In-dialogue %s timed-out", tx.Method.String()))
 	}
@@ -1070,9 +1192,14 @@ func (session *SipSession) IsPending() bool {
 // ==============================================================================
 
 func (ss *SipSession) ReleaseMe(details string) bool {
+	return ss.ReleaseMeDetailed(0, details)
+}
+
+// Release established session with a Reason header, or a Warning header when q850 is zero
+func (ss *SipSession) ReleaseMeDetailed(q850 int, details string) bool {
 	if ss.IsEstablished() {
 		ss.SetState(state.BeingCleared)
-		ss.SendRequestDetailed(RequestPack{Method: BYE, Max70: true, CustomHeaders: NewSHQ850OrSIP(0, details, "")}, nil, EmptyBody())
+		ss.SendRequestDetailed(RequestPack{Method: BYE, Max70: true, CustomHeaders: NewSHQ850OrSIP(q850, details, "")}, nil, EmptyBody())
 		return true
 	}
 	return false
@@ -1144,11 +1271,37 @@ func (session *SipSession) DropMe() {
 		return
 	}
 	fmt.Println("Session:", session.CallID, "State:", session.state.String())
+	if session.LocalSDP != nil {
+		LogInfo(LTMediaStack, fmt.Sprintf("Call-ID [%s] media summary - %s", session.CallID, session.MediaStats()))
+	}
+	session.addCallRecord()
 	session.IsDisposed = true
-	MediaPorts.ReleaseSocket(session.MediaListener)
+	session.mediaActive.Store(false)
+	if session.sessionTimer != nil {
+		session.sessionTimer.Stop()
+	}
+	if session.mediaPool != nil {
+		session.mediaPool.ReleaseSockets(session.MediaListener, session.RTCPListener)
+	}
+	if session.webrtc != nil {
+		session.webrtc.close()
+	}
 	close(session.maxDprobDoneChan)
 	close(session.rtpChan)
 	Sessions.Delete(session.CallID)
+	if session.trustedPeer != nil {
+		session.trustedPeer.release()
+	}
+	if session.isInboundCall {
+		inboundCalls.Add(-1)
+	}
+	if session.origination != nil {
+		session.origination.ended()
+	}
+}
+
+func (session *SipSession) MediaStats() rtp.StatsReport {
+	return session.mediaStats.Report(codecClockRate(session.rtpCodec))
 }
 
 func (ss *SipSession) DropMeTimed() {
@@ -0,0 +1,273 @@
+package sip
+
+import (
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/q850"
+	"mrfgo/sip/status"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SessionTimer is the session timer policy of a route (RFC 4028). Session-Expires received in an INVITE, re-INVITE or
+// UPDATE is always honoured: 422 with Min-SE when too small, lowered to the policy interval when larger. When enabled,
+// the timer is also used with callers not asking for it, mrfgo then refreshing the session itself.
+// The refresher sends a refresh (UPDATE, or re-INVITE when the peer does not allow UPDATE) at half the interval;
+// the other side releases the call with BYE when no refresh comes before the interval ends. In-dialogue OPTIONS probing
+// is not used for dialogues having a session timer.
+//
+// Syntax: "off" or "[interval=<seconds>] [min_se=<seconds>] [refresher=uac|uas] [method=update|reinvite]", refresher
+// being the one chosen when the caller leaves the choice.
+type SessionTimer struct {
+	text      string
+	enabled   bool
+	interval  int
+	minSE     int
+	refresher string
+	method    Method
+}
+
+const (
+	defaultSessionInterval = 1800
+	minSessionInterval     = 90 // lowest Min-SE allowed by RFC 4028
+)
+
+var DefaultSessionTimer = &SessionTimer{text: "off", interval: defaultSessionInterval, minSE: minSessionInterval, refresher: "uac", method: UPDATE}
+
+func NewSessionTimer(text string) (*SessionTimer, error) {
+	st := &SessionTimer{text: text, interval: defaultSessionInterval, minSE: minSessionInterval, refresher: "uac", method: UPDATE}
+	if strings.EqualFold(strings.TrimSpace(text), "off") {
+		return st, nil
+	}
+	st.enabled = true
+	for _, field := range strings.Fields(text) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "interval", "min_se":
+			sec, ok := Str2IntCheck[int](value)
+			if !ok || sec < minSessionInterval {
+				return nil, fmt.Errorf("invalid %s [%s]", key, value)
+			}
+			if strings.EqualFold(key, "interval") {
+				st.interval = sec
+			} else {
+				st.minSE = sec
+			}
+		case "refresher":
+			switch strings.ToLower(value) {
+			case "uac", "uas":
+				st.refresher = strings.ToLower(value)
+			default:
+				return nil, fmt.Errorf("invalid refresher [%s]", value)
+			}
+		case "method":
+			switch strings.ToLower(value) {
+			case "update":
+				st.method = UPDATE
+			case "reinvite":
+				st.method = ReINVITE
+			default:
+				return nil, fmt.Errorf("invalid refresh method [%s]", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown field [%s]", key)
+		}
+	}
+	if st.interval < st.minSE {
+		return nil, fmt.Errorf("interval [%d] below min_se [%d]", st.interval, st.minSE)
+	}
+	return st, nil
+}
+
+func (st *SessionTimer) String() string {
+	return st.text
+}
+
+func initSessionTimerPolicies() {
+	initRoutePolicy("Session timer", SessionTimerGlobal, SessionTimerRoutes, NewSessionTimer,
+		func(st *SessionTimer) { DefaultSessionTimer = st },
+		func(repo *MRFRepo, st *SessionTimer) error {
+			repo.sessionTimer = st
+			return nil
+		})
+}
+
+func (ss *SipSession) sessionTimerPolicy() *SessionTimer {
+	if ss.MRFRepo != nil && ss.MRFRepo.sessionTimer != nil {
+		return ss.MRFRepo.sessionTimer
+	}
+	return DefaultSessionTimer
+}
+
+// sessionExpires returns the interval and the refresher parameter (empty when absent) of the Session-Expires header
+func (sipmsg *SipMessage) sessionExpires() (int, string, bool) {
+	delta, params, _ := strings.Cut(sipmsg.Headers.ValueHeader(Session_Expires), ";")
+	se, ok := Str2IntCheck[int](strings.TrimSpace(delta))
+	if !ok || se <= 0 {
+		return 0, "", false
+	}
+	var refresher string
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(strings.TrimSpace(key), "refresher") {
+			refresher = ASCIIToLower(strings.TrimSpace(value))
+		}
+	}
+	if refresher != "uac" && refresher != "uas" {
+		refresher = ""
+	}
+	return se, refresher, true
+}
+
+// minSE returns the Min-SE of the message, 0 when absent
+func (sipmsg *SipMessage) minSE() int {
+	delta, _, _ := strings.Cut(sipmsg.Headers.ValueHeader(Min_SE), ";")
+	se, _ := Str2IntCheck[int](strings.TrimSpace(delta))
+	return se
+}
+
+// negotiateSessionTimer returns the session interval (0 without session timer) and whether we are the refresher, from an
+// INVITE, re-INVITE or UPDATE received (RFC 4028 §9), or the Min-SE to reject it with 422 when its interval is too small.
+// The session is left as is, the outcome being kept only when the 2xx is sent (addSessionTimerHeaders).
+func (ss *SipSession) negotiateSessionTimer(sipmsg *SipMessage) (int, bool, int) {
+	policy := ss.sessionTimerPolicy()
+	se, refresher, withSE := sipmsg.sessionExpires()
+	switch {
+	case withSE && se < policy.minSE:
+		return 0, false, policy.minSE
+	case withSE && se > policy.interval:
+		se = max(policy.interval, sipmsg.minSE())
+	case !withSE && ss.sessionExpires != 0:
+		se = ss.sessionExpires
+	case !withSE && policy.enabled:
+		se = policy.interval
+	case !withSE:
+		return 0, false, 0
+	}
+	switch {
+	case !sipmsg.IsOptionSupportedOrRequired("timer"):
+		refresher = "uas" // the caller cannot refresh
+	case refresher == "":
+		refresher = policy.refresher
+	}
+	return se, refresher == "uas", 0
+}
+
+// sessionIntervalTooSmall is the 422 response to a request whose Session-Expires is below minSE
+func sessionIntervalTooSmall(minSE int) ResponsePack {
+	pack := ResponsePack{StatusCode: status.SessionIntervalTooSmall, CustomHeaders: NewSipHeaders()}
+	pack.CustomHeaders.AddHeader(Min_SE, strconv.Itoa(minSE))
+	return pack
+}
+
+// addSessionTimerHeaders adds the Session-Expires negotiated from the request to its 2xx, keeps it in the session and
+// restarts the session timer
+func (ss *SipSession) addSessionTimerHeaders(trans *Transaction, hdrs *SipHeaders) {
+	se, weRefresh, minSE := ss.negotiateSessionTimer(trans.RequestMessage)
+	if se == 0 || minSE != 0 {
+		return
+	}
+	ss.sessionExpires = se
+	ss.sessionRefresher = weRefresh
+	if ss.sessionRefresh == UNKNOWN {
+		ss.sessionRefresh = ss.sessionTimerPolicy().method
+	}
+	refresher := "uas"
+	if !ss.sessionRefresher {
+		refresher = "uac"
+		hdrs.AddHeader(Require, "timer")
+	}
+	hdrs.AddHeader(Session_Expires, fmt.Sprintf("%d;refresher=%s", ss.sessionExpires, refresher))
+	ss.startSessionTimer()
+}
+
+// startSessionTimer (re)starts the session timer: refresh at half the interval when we are the refresher,
+// release at the interval less a third (at most 32 s) otherwise
+func (ss *SipSession) startSessionTimer() {
+	ss.multiUseMutex.Lock()
+	defer ss.multiUseMutex.Unlock()
+	if ss.sessionTimer != nil {
+		ss.sessionTimer.Stop()
+		ss.sessionTimer = nil
+	}
+	if ss.IsDisposed || ss.sessionExpires == 0 {
+		return
+	}
+	interval := time.Duration(ss.sessionExpires) * time.Second
+	var tmr *time.Timer
+	if ss.sessionRefresher {
+		tmr = time.AfterFunc(interval/2, func() {
+			if ss.isSessionTimer(tmr) {
+				ss.sendSessionRefresh()
+			}
+		})
+	} else {
+		tmr = time.AfterFunc(interval-min(32*time.Second, interval/3), func() {
+			if ss.isSessionTimer(tmr) {
+				LogWarning(LTSIPStack, fmt.Sprintf("Call-ID [%s] - session not refreshed within %d s", ss.CallID, ss.sessionExpires))
+				ss.ReleaseMeDetailed(q850.RecoveryOnTimerExpiry, "Session timer expired")
+			}
+		})
+	}
+	ss.sessionTimer = tmr
+}
+
+func (ss *SipSession) isSessionTimer(tmr *time.Timer) bool {
+	ss.multiUseMutex.Lock()
+	defer ss.multiUseMutex.Unlock()
+	return tmr != nil && ss.sessionTimer == tmr
+}
+
+// sendSessionRefresh sends an UPDATE without SDP, or a re-INVITE with the current SDP, as session refresh
+func (ss *SipSession) sendSessionRefresh() {
+	if !ss.IsEstablished() {
+		return
+	}
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(Session_Expires, fmt.Sprintf("%d;refresher=uac", ss.sessionExpires))
+	hdrs.AddHeader(Min_SE, strconv.Itoa(ss.sessionTimerPolicy().minSE))
+	hdrs.AddHeader(Supported, supportedHeader())
+	if ss.sessionRefresh != ReINVITE {
+		ss.SendRequestDetailed(RequestPack{Method: UPDATE, Max70: true, CustomHeaders: hdrs}, nil, EmptyBody())
+		return
+	}
+	if !ss.ChecknSetDialogueChanging(true) {
+		return // the re-INVITE in progress refreshes the session
+	}
+	ss.SendRequestDetailed(RequestPack{Method: ReINVITE, Max70: true, CustomHeaders: hdrs}, nil, NewMessageSDPBody(ss.LocalSDP.Bytes()))
+}
+
+// processRefreshResponse handles the final response to our session refresh
+func (ss *SipSession) processRefreshResponse(trans *Transaction, sipmsg *SipMessage) {
+	sc := sipmsg.StartLine.StatusCode
+	if trans.Method == ReINVITE {
+		ss.SendRequest(ACK, trans, EmptyBody())
+		ss.ChecknSetDialogueChanging(false)
+	}
+	switch {
+	case IsPositive(sc):
+		if trans.Method == ReINVITE && sipmsg.Body.ContainsSDP() {
+			if code, qc, wr := ss.applySDPAnswer(sipmsg); code != 0 {
+				LogWarning(LTSDPStack, fmt.Sprintf("Call-ID [%s] - SDP answer to session refresh rejected (%d) - %s", ss.CallID, code, wr))
+				ss.ReleaseMeDetailed(qc, wr)
+				return
+			}
+		}
+		if se, refresher, ok := sipmsg.sessionExpires(); ok {
+			ss.sessionExpires = se
+			ss.sessionRefresher = refresher != "uas"
+		}
+		ss.startSessionTimer()
+	case sc == status.SessionIntervalTooSmall && sipmsg.minSE() > ss.sessionExpires:
+		ss.sessionExpires = sipmsg.minSE()
+		ss.sendSessionRefresh()
+	case (sc == status.MethodNotAllowed || sc == status.NotImplemented) && trans.Method == UPDATE:
+		ss.sessionRefresh = ReINVITE
+		ss.sendSessionRefresh()
+	case sc == status.CallTransactionDoesNotExist || sc == status.RequestTimeout:
+		ss.ReleaseMe(fmt.Sprintf("Session refresh rejected (%d)", sc))
+	default:
+		ss.startSessionTimer() // tried again at the next half interval
+	}
+}
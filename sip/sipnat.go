@@ -0,0 +1,162 @@
+package sip
+
+import (
+	"fmt"
+	. "mrfgo/global"
+	"net"
+	"strings"
+)
+
+// SIPNATPolicy tells where responses and in-dialogue requests are sent for peers behind NAT (RFC 3261 §18.2.2, RFC 3581)
+type SIPNATPolicy int
+
+const (
+	SIPNATAuto      SIPNATPolicy = iota // symmetric for dialogues whose initial request shows a NAT, RFC otherwise
+	SIPNATSymmetric                     // always send to where the requests come from
+	SIPNATRFC                           // responses to the Via received/rport, in-dialogue requests to the Contact
+)
+
+var (
+	sipNATPolicies = [...]string{"auto", "symmetric", "rfc"}
+
+	DefaultSIPNATPolicy = SIPNATAuto
+)
+
+func (p SIPNATPolicy) String() string {
+	return sipNATPolicies[p]
+}
+
+func ParseSIPNATPolicy(s string) (SIPNATPolicy, error) {
+	for i, nm := range sipNATPolicies {
+		if strings.EqualFold(strings.TrimSpace(s), nm) {
+			return SIPNATPolicy(i), nil
+		}
+	}
+	return SIPNATAuto, fmt.Errorf("invalid SIP NAT policy [%s]", s)
+}
+
+func initSIPNATPolicy() {
+	if SIPNATPolicyGlobal == "" {
+		return
+	}
+	if p, err := ParseSIPNATPolicy(SIPNATPolicyGlobal); err != nil {
+		LogWarning(LTConfiguration, fmt.Sprintf("SIP NAT policy ignored - %v", err))
+	} else {
+		DefaultSIPNATPolicy = p
+	}
+}
+
+// stampVia adds received and rport to the topmost Via of a request received from src, and sets where its responses go:
+// the source port when rport is requested or the policy is symmetric, the sent-by port otherwise
+func (sipmsg *SipMessage) stampVia(src *net.UDPAddr) {
+	ok, vias := sipmsg.Headers.ValuesHeader(Via)
+	if !ok || src == nil {
+		return
+	}
+	top, others, multi := strings.Cut(vias[0], ",")
+	sentByPort := 5060
+	var sentByIP net.IP
+	if mtch := DicFieldRegEx[ViaIPv4Socket].FindStringSubmatch(top); mtch != nil {
+		sentByIP = net.ParseIP(mtch[2])
+		if mtch[3] != "" {
+			sentByPort = Str2Int[int](mtch[3][1:])
+		}
+	}
+	rport := DicFieldRegEx[ViaRport].FindStringIndex(top)
+	if rport != nil {
+		top = fmt.Sprintf("%s;rport=%d%s", top[:rport[0]], src.Port, top[rport[1]:])
+	}
+	sipmsg.WithRport = rport != nil
+	sipmsg.ViaNATed = sentByIP != nil && !src.IP.Equal(sentByIP)
+	if sipmsg.WithRport || sentByIP == nil || sipmsg.ViaNATed {
+		top = DicFieldRegEx[ViaReceived].ReplaceAllString(top, "")
+		top = fmt.Sprintf("%s;received=%s", strings.TrimRight(top, " \t"), src.IP)
+	}
+	if multi {
+		top += "," + others
+	}
+	vias[0] = top
+
+	sipmsg.SourceUDP = src
+	if sipmsg.WithRport || DefaultSIPNATPolicy == SIPNATSymmetric {
+		sipmsg.ResponseUDP = src
+	} else {
+		sipmsg.ResponseUDP = &net.UDPAddr{IP: src.IP, Port: sentByPort}
+	}
+}
+
+// behindNAT tells whether the request went through a NAT: Via sent-by or Contact host differing from the source
+func (sipmsg *SipMessage) behindNAT() bool {
+	if sipmsg.WithRport || sipmsg.ViaNATed {
+		return true
+	}
+	var mtch []string
+	if sipmsg.SourceUDP == nil || !RMatch(sipmsg.RCURI, FQDNPort, &mtch) {
+		return false
+	}
+	ip := net.ParseIP(mtch[1])
+	return ip != nil && !ip.Equal(sipmsg.SourceUDP.IP)
+}
+
+// updateSignallingSource records the source of a received request: the first one sets the dialogue policy,
+// later ones move the dialogue when the NAT binding of a symmetric peer changes. Responses never move it.
+func (ss *SipSession) updateSignallingSource(sipmsg *SipMessage, src *net.UDPAddr) {
+	if sipmsg.IsResponse() {
+		if ss.RemoteUDP == nil {
+			ss.RemoteUDP = src
+		}
+		return
+	}
+	sipmsg.stampVia(src)
+	if ss.RemoteUDP == nil {
+		ss.RemoteUDP = src
+		switch DefaultSIPNATPolicy {
+		case SIPNATSymmetric:
+			ss.symmetricSignalling = true
+		case SIPNATAuto:
+			ss.symmetricSignalling = sipmsg.behindNAT()
+		}
+		return
+	}
+	if ss.symmetricSignalling && !AreUAddrsEqual(ss.RemoteUDP, src) {
+		LogInfo(LTNAT, fmt.Sprintf("Call-ID [%s] - signalling source moved from %s to %s", ss.CallID, ss.RemoteUDP, src))
+		ss.RemoteUDP = src
+	}
+}
+
+// requestDestination is where in-dialogue requests are sent: the signalling source for symmetric dialogues,
+// the remote target (Contact) otherwise
+func (ss *SipSession) requestDestination() *net.UDPAddr {
+	if ss.symmetricSignalling || ss.RemoteContactUDP == nil {
+		return ss.RemoteUDP
+	}
+	return ss.RemoteContactUDP
+}
+
+// responseDestination is where responses to the request are sent, as set from its topmost Via
+func (ss *SipSession) responseDestination(tx *Transaction) *net.UDPAddr {
+	if !ss.symmetricSignalling && tx.RequestMessage != nil && tx.RequestMessage.ResponseUDP != nil {
+		return tx.RequestMessage.ResponseUDP
+	}
+	if tx.RequestMessage != nil && tx.RequestMessage.SourceUDP != nil {
+		return tx.RequestMessage.SourceUDP
+	}
+	return ss.RemoteUDP
+}
+
+// isFirstHopRequest tells whether the request is a CANCEL or an ACK to a non-2xx of our initial INVITE: it goes where the INVITE went
+func (ss *SipSession) isFirstHopRequest(tx *Transaction) bool {
+	if ss.Direction != OUTBOUND || tx.LinkedTransaction == nil || tx.LinkedTransaction.Method != INVITE {
+		return false
+	}
+	return tx.Method == CANCEL || (tx.Method == ACK && tx.LinkedTransaction.RequireSameViaBranch())
+}
+
+// localSIPAddr is the address put in Via, Contact and From: the listening socket, with the advertised address if any
+func (ss *SipSession) localSIPAddr() *net.UDPAddr {
+	local := GetUDPAddrFromConn(ss.SIPUDPListenser)
+	if SIPAdvertisedIPv4 == nil {
+		return local
+	}
+	return &net.UDPAddr{IP: SIPAdvertisedIPv4, Port: local.Port}
+}
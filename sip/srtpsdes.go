@@ -0,0 +1,133 @@
+package sip
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/sdp"
+	"mrfgo/srtp"
+	"strings"
+)
+
+// SRTPPolicy tells whether RTP/SAVP (SDES) and RTP/AVP offers are accepted
+type SRTPPolicy int
+
+const (
+	SRTPOptional  SRTPPolicy = iota // SRTP when offered, RTP otherwise
+	SRTPMandatory                   // only SRTP
+	SRTPDisabled                    // only RTP
+)
+
+var (
+	srtpPolicies = [...]string{"optional", "mandatory", "disabled"}
+
+	DefaultSRTPPolicy = SRTPOptional
+)
+
+func (p SRTPPolicy) String() string {
+	return srtpPolicies[p]
+}
+
+func ParseSRTPPolicy(s string) (SRTPPolicy, error) {
+	for i, nm := range srtpPolicies {
+		if strings.EqualFold(strings.TrimSpace(s), nm) {
+			return SRTPPolicy(i), nil
+		}
+	}
+	return SRTPOptional, fmt.Errorf("invalid SRTP policy [%s]", s)
+}
+
+func initSRTPPolicies() {
+	initRoutePolicy("SRTP policy", SRTPPolicyGlobal, SRTPPolicyRoutes, ParseSRTPPolicy,
+		func(p SRTPPolicy) { DefaultSRTPPolicy = p },
+		func(repo *MRFRepo, p SRTPPolicy) error {
+			repo.srtpPolicy = &p
+			return nil
+		})
+}
+
+func (ss *SipSession) srtpPolicy() SRTPPolicy {
+	if ss.MRFRepo != nil && ss.MRFRepo.srtpPolicy != nil {
+		return *ss.MRFRepo.srtpPolicy
+	}
+	return DefaultSRTPPolicy
+}
+
+// =========================================================================================================================
+// SDES (RFC 4568)
+
+type sdesCrypto struct {
+	tag     string
+	suite   string
+	keySalt []byte
+	inline  string
+}
+
+// parseCrypto parses an a=crypto attribute value, keeping only what can be used: supported suite, single key without MKI
+// and no session parameters
+func parseCrypto(value string) (*sdesCrypto, bool) {
+	flds := strings.Fields(value)
+	if len(flds) != 3 || !srtp.IsSupported(flds[1]) {
+		return nil, false
+	}
+	keyparams, ok := strings.CutPrefix(flds[2], "inline:")
+	if !ok || strings.Contains(keyparams, ";") {
+		return nil, false
+	}
+	inline, lifetimeMKI, _ := strings.Cut(keyparams, "|")
+	if strings.Contains(lifetimeMKI, ":") {
+		return nil, false
+	}
+	keySalt, err := base64.StdEncoding.DecodeString(inline)
+	if err != nil || len(keySalt) != srtp.MasterKeyLen+srtp.MasterSaltLen {
+		return nil, false
+	}
+	return &sdesCrypto{tag: flds[0], suite: flds[1], keySalt: keySalt, inline: inline}, true
+}
+
+// offeredCrypto returns the first usable a=crypto attribute of the media
+func offeredCrypto(media *sdp.Media) *sdesCrypto {
+	for _, attr := range media.Attributes {
+		if attr.Name != sdp.Crypto {
+			continue
+		}
+		if crypto, ok := parseCrypto(attr.Value); ok {
+			return crypto
+		}
+	}
+	return nil
+}
+
+// setupSRTP creates the SRTP contexts for the negotiated crypto and returns the a=crypto answer, nil crypto disables SRTP.
+// Keys are kept across re-INVITEs unless changed by the remote, or unless the suite is changed.
+func (ss *SipSession) setupSRTP(crypto *sdesCrypto) (*sdp.Attr, error) {
+	if crypto == nil {
+		ss.srtpTx.Store(nil)
+		ss.srtpRx.Store(nil)
+		ss.srtpSuite, ss.srtpLocalKey, ss.srtpRemoteKey = "", "", ""
+		return nil, nil
+	}
+	if ss.srtpTx.Load() == nil || ss.srtpSuite != crypto.suite {
+		keySalt := make([]byte, srtp.MasterKeyLen+srtp.MasterSaltLen)
+		if _, err := rand.Read(keySalt); err != nil {
+			return nil, err
+		}
+		tx, err := srtp.NewContext(crypto.suite, keySalt)
+		if err != nil {
+			return nil, err
+		}
+		ss.srtpTx.Store(tx)
+		ss.srtpLocalKey = base64.StdEncoding.EncodeToString(keySalt)
+	}
+	if ss.srtpRx.Load() == nil || ss.srtpSuite != crypto.suite || ss.srtpRemoteKey != crypto.inline {
+		rx, err := srtp.NewContext(crypto.suite, crypto.keySalt)
+		if err != nil {
+			return nil, err
+		}
+		ss.srtpRx.Store(rx)
+		ss.srtpRemoteKey = crypto.inline
+	}
+	ss.srtpSuite = crypto.suite
+	return sdp.NewAttr(sdp.Crypto, fmt.Sprintf("%s %s inline:%s", crypto.tag, crypto.suite, ss.srtpLocalKey)), nil
+}
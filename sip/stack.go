@@ -8,6 +8,7 @@ import (
 	"mrfgo/sip/mode"
 	"mrfgo/sip/state"
 	"mrfgo/sip/status"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -285,7 +286,7 @@ func processPDU(payload []byte) (*SipMessage, []byte, error) {
 	return sipmsg, payload, nil
 }
 
-func sessionGetter(sipmsg *SipMessage) (*SipSession, NewSessionType) {
+func sessionGetter(sipmsg *SipMessage, src *net.UDPAddr) (*SipSession, NewSessionType) {
 	defer func() {
 		if r := recover(); r != nil {
 			LogCallStack(r)
@@ -304,30 +305,38 @@ func sessionGetter(sipmsg *SipMessage) (*SipSession, NewSessionType) {
 		if sipmsg.IsResponse() {
 			return nil, Response
 		}
+		if screenRequest(sipmsg, src) {
+			return nil, Banned // refused statelessly by processPacket
+		}
 		sipses := NewSIPSession(sipmsg)
-		clok := Sessions.Store(callID, sipses)
+		Sessions.Store(callID, sipses)
 		if sipmsg.ToTag == "" {
 			switch sipmsg.GetMethod() {
 			case INVITE:
 				sipses.Mode = mode.Multimedia
-				sipses.IsPRACKSupported = sipmsg.IsOptionSupported("100rel")
+				sipses.IsPRACKSupported = sipmsg.IsOptionSupportedOrRequired("100rel")
 				sipses.IsDelayedOfferCall = !sipmsg.Body.ContainsSDP()
 				sipses.SetState(state.BeingEstablished)
+				CallLimiter.AcceptNewCall() // counted for the call attempts per second
+				// trusted peers and authentication first, so that refused sources do not take from the call rates
+				if !sipses.checkAccess(sipmsg, src) {
+					return sipses, AccessDenied
+				}
+				if admission := sipses.admitCall(sipmsg, src); admission != ValidRequest {
+					return sipses, admission
+				}
 				if !sipmsg.IsKnownRURIScheme() {
 					return sipses, UnsupportedURIScheme
 				}
 				if sipmsg.Body.WithUnknownBodyPart() {
 					return sipses, UnsupportedBody
 				}
-				if sipmsg.Headers.HeaderExists("Require") {
+				if len(sipmsg.unsupportedExtensions()) > 0 {
 					return sipses, WithRequireHeader
 				}
 				if sipmsg.MaxFwds <= MinMaxFwds {
 					return sipses, TooLowMaxForwards
 				}
-				if !clok {
-					return sipses, ExceededCallRate
-				}
 				return sipses, ValidRequest
 			case MESSAGE:
 				sipses.Mode = mode.Messaging
@@ -383,11 +392,19 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 	case UnExpectedMessage:
 		ss.DropMe()
 		return
+	case AccessDenied, ExceededCallRate, Overloaded: // answered statelessly, a retry comes as a new session
+		ss.SetState(state.BeingFailed)
+		ss.SendResponseDetailed(trans, ss.rejection, EmptyBody())
+		trans.StopTransTimer(true)
+		ss.SetState(state.Denied)
+		ss.DropMe()
+		return
 	case TooLowMaxForwards:
 		ss.RejectMe(trans, status.TooManyHops, q850.NoRCProvided, "INVITE with too low MF")
 		return
 	case WithRequireHeader:
-		ss.RejectMe(trans, status.BadExtension, q850.NoRCProvided, "INVITE with Require header")
+		ss.SetState(state.BeingFailed)
+		ss.SendResponseDetailed(trans, badExtension(sipmsg.unsupportedExtensions()), EmptyBody())
 		return
 	case UnsupportedURIScheme:
 		ss.RejectMe(trans, status.UnsupportedURIScheme, q850.NoRCProvided, "URI scheme unsupported")
@@ -395,9 +412,6 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 	case UnsupportedBody:
 		ss.RejectMe(trans, status.UnsupportedMediaType, q850.NoRCProvided, "Message body unsupported")
 		return
-	case ExceededCallRate:
-		ss.RejectMe(trans, status.ServiceUnavailable, q850.NoCircuitChannelAvailable, "Call rate exceeded")
-		return
 	case InvalidRequest:
 		ss.SetState(state.BeingFailed)
 		ss.SendResponse(trans, 503, EmptyBody())
@@ -417,19 +431,32 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 			ss.SendResponse(trans, status.UnsupportedMediaType, EmptyBody())
 			return
 		}
+		if unsupported := sipmsg.unsupportedExtensions(); len(unsupported) > 0 && sipmsg.GetMethod() != ACK && sipmsg.GetMethod() != CANCEL {
+			ss.SendResponseDetailed(trans, badExtension(unsupported), EmptyBody())
+			return
+		}
 		switch method := sipmsg.GetMethod(); method {
 		case INVITE:
 			ss.SendResponse(trans, status.Trying, EmptyBody())
 			ss.RouteRequestInternal(trans, sipmsg)
 		case ReINVITE:
 			ss.SendResponse(trans, 100, EmptyBody())
+			if _, _, minSE := ss.negotiateSessionTimer(sipmsg); minSE != 0 {
+				ss.SendResponseDetailed(trans, sessionIntervalTooSmall(minSE), EmptyBody())
+				return
+			}
 			if !ss.ChecknSetDialogueChanging(true) {
 				ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.RequestPending, "", "Competing ReINVITE rejected"), EmptyBody())
 				return
 			}
 			switch {
 			case sipmsg.Body.WithNoBody():
-				ss.SendResponseDetailed(trans, NewResponsePackSIPQ850Details(status.NotAcceptableHere, q850.BearerCapabilityNotImplemented, "Not supported delayed offer"), EmptyBody())
+				sc, qc, wr := ss.buildSDPOffer()
+				if sc != 0 {
+					ss.SendResponseDetailed(trans, NewResponsePackSIPQ850Details(sc, qc, wr), EmptyBody())
+					return
+				}
+				ss.SendResponse(trans, status.OK, NewMessageSDPBody(ss.LocalSDP.Bytes()))
 			case sipmsg.Body.ContainsSDP():
 				sc, qc, wr := ss.buildSDPAnswer(sipmsg)
 				if sc != 0 {
@@ -447,13 +474,25 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 					ss.DropMe()
 					return
 				}
+				if ss.sdpAnswerPending && !ss.acceptSDPAnswer(sipmsg) {
+					return
+				}
+				if ss.replacedSession != nil {
+					ss.replacedSession.ReleaseMe("Dialogue replaced")
+				}
 				ss.StartMaxCallDuration()
-				ss.StartInDialogueProbing()
-				go ss.mediaReceiver()
+				if ss.sessionExpires == 0 { // the session timer replaces probing
+					ss.StartInDialogueProbing()
+				}
+				ss.touchMedia()
+				ss.startMediaReceivers()
 				go ss.startRTPStreaming("MaythekeshAleha", false, false, false)
 			} else { //ReINVITE
 				if trans.IsFinalResponsePositiveSYNC() {
 					ss.ChecknSetDialogueChanging(false)
+					if ss.sdpAnswerPending && !ss.acceptSDPAnswer(sipmsg) {
+						return
+					}
 					// go ss.startRTPStreaming("ErsemAlb", false, true, true)
 				}
 			}
@@ -482,6 +521,10 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 			}
 			ss.SendResponse(trans, 200, EmptyBody())
 		case UPDATE:
+			if _, _, minSE := ss.negotiateSessionTimer(sipmsg); minSE != 0 {
+				ss.SendResponseDetailed(trans, sessionIntervalTooSmall(minSE), EmptyBody())
+				return
+			}
 			switch {
 			case sipmsg.Body.WithNoBody():
 				ss.SendResponse(trans, 200, EmptyBody())
@@ -496,7 +539,7 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 				ss.SendResponseDetailed(trans, NewResponsePackSIPQ850Details(status.ServiceUnavailable, q850.InterworkingUnspecified, "Not supported action"), EmptyBody())
 			}
 		case PRACK:
-			ss.SendResponse(trans, status.OK, EmptyBody())
+			ss.processPRACK(trans, sipmsg)
 		case INFO:
 			if sipmsg.Body.WithNoBody() {
 				ss.SendResponse(trans, status.OK, EmptyBody())
@@ -525,6 +568,19 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 		if stsCode <= 199 && trans.Method != INVITE {
 			return
 		}
+		if trans.Method == UPDATE || trans.Method == ReINVITE { // only sent as session refresh
+			ss.processRefreshResponse(trans, sipmsg)
+			return
+		}
+		if trans.Method == REGISTER && ss.registration != nil {
+			ss.registration.ended(trans)
+			ss.registration.processResponse(sipmsg)
+			return
+		}
+		if trans.Method == INVITE && ss.origination != nil {
+			ss.processInviteResponse(trans, sipmsg)
+			return
+		}
 		switch {
 		case 180 <= stsCode && stsCode <= 189:
 		case stsCode <= 199:
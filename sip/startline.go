@@ -24,6 +24,7 @@ type SipStartLine struct {
 type RequestPack struct {
 	global.Method
 	RUriUP        string
+	RUriHost      string // Request-URI and To host of out-of-dialogue requests, the remote address when empty
 	FromUP        string
 	Max70         bool
 	CustomHeaders SipHeaders
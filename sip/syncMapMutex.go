@@ -14,16 +14,11 @@ func NewConcurrentMapMutex() ConcurrentMapMutex {
 	return ConcurrentMapMutex{_map: make(map[string]*SipSession)}
 }
 
-func (c *ConcurrentMapMutex) Store(ky string, ss *SipSession) (ok bool) {
+func (c *ConcurrentMapMutex) Store(ky string, ss *SipSession) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	ok = true
-	if ss.Direction == global.INBOUND && !global.CallLimiter.AcceptNewCall() {
-		ok = false
-	}
 	c._map[ky] = ss
 	global.Prometrics.ConSessions.Inc()
-	return
 }
 
 func (c *ConcurrentMapMutex) Delete(ky string) {
@@ -46,6 +41,17 @@ func (c *ConcurrentMapMutex) Range() map[string]*SipSession {
 	return c._map
 }
 
+// Snapshot returns the sessions stored, for iterating without holding the lock
+func (c *ConcurrentMapMutex) Snapshot() []*SipSession {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	lst := make([]*SipSession, 0, len(c._map))
+	for _, ss := range c._map {
+		lst = append(lst, ss)
+	}
+	return lst
+}
+
 func (c *ConcurrentMapMutex) IsEmpty() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -185,36 +185,39 @@ func (transaction *Transaction) StartTransTimer(sipSes *SipSession) {
 			DoneCh: make(chan bool),
 			Tmr:    time.NewTimer(transaction.TransTimeOut),
 		}
-		go transaction.TransTimerHandler(sipSes)
+		go transaction.TransTimerHandler(sipSes, transaction.Timer)
 	}
 }
 
 func (transaction *Transaction) restartTransTimer(sipSes *SipSession) {
 	transaction.Timer.Tmr.Reset(transaction.TransTimeOut)
-	go transaction.TransTimerHandler(sipSes)
+	go transaction.TransTimerHandler(sipSes, transaction.Timer)
 }
 
+// StopTransTimer stops retransmitting - a timer can be started again right away, e.g. for the 2xx following a PRACKed 18x
 func (transaction *Transaction) StopTransTimer(useLock bool) {
 	if useLock {
 		transaction.Lock.Lock()
 		defer transaction.Lock.Unlock()
 	}
-	if transaction.Timer != nil && transaction.Timer.Tmr.Stop() {
-		close(transaction.Timer.DoneCh)
+	if tmr := transaction.Timer; tmr != nil {
+		tmr.Tmr.Stop()
+		close(tmr.DoneCh)
+		transaction.Timer = nil
 	}
 }
 
-func (transaction *Transaction) TransTimerHandler(sipSes *SipSession) {
+func (transaction *Transaction) TransTimerHandler(sipSes *SipSession, tmr *global.SipTimer) {
 	select {
-	case <-transaction.Timer.DoneCh:
-		transaction.Lock.Lock()
-		defer transaction.Lock.Unlock()
-		transaction.Timer = nil
+	case <-tmr.DoneCh:
 		return
-	case <-transaction.Timer.Tmr.C:
+	case <-tmr.Tmr.C:
 	}
 	transaction.Lock.Lock()
 	defer transaction.Lock.Unlock()
+	if transaction.Timer != tmr { // stopped while firing
+		return
+	}
 	if transaction.ReTXCount >= global.ReTXCount {
 		close(transaction.Timer.DoneCh)
 		transaction.Timer = nil
@@ -0,0 +1,402 @@
+package sip
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	. "mrfgo/global"
+	"mrfgo/ice"
+	"mrfgo/sdp"
+	"mrfgo/srtp"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/crypto/selfsign"
+)
+
+// WebRTC media (UDP/TLS/RTP/SAVPF): ICE-lite, DTLS-SRTP (RFC 5763, RFC 5764) and rtcp-mux on a single media socket
+
+const (
+	dtlsHandshakeTimeout = 10 * time.Second
+	dtlsSRTPLabel        = "EXTRACTOR-dtls_srtp"
+	dtlsQueueSize        = 32
+
+	setupActive  = "active"
+	setupPassive = "passive"
+	setupActPass = "actpass"
+)
+
+var (
+	dtlsCertOnce sync.Once
+	dtlsCert     tls.Certificate
+	dtlsCertFP   string // sha-256 fingerprint advertised in a=fingerprint
+	dtlsCertErr  error
+
+	fingerprintHashes = map[string]crypto.Hash{"sha-1": crypto.SHA1, "sha-256": crypto.SHA256, "sha-384": crypto.SHA384, "sha-512": crypto.SHA512}
+
+	errFingerprint = errors.New("DTLS certificate does not match the SDP fingerprint")
+)
+
+type webRTCMedia struct {
+	localUfrag  string
+	localPwd    string
+	remoteUfrag string
+	fpHash      string // hash function of the remote fingerprint
+	fingerprint string // remote fingerprint, upper case hex with colons
+	isClient    bool   // DTLS role, the client is a=setup:active
+
+	mu        sync.Mutex
+	conn      *mediaPacketConn
+	dtlsConn  *dtls.Conn
+	started   bool
+	connected bool
+	closed    bool // replaced by a re-INVITE, or the call ended
+}
+
+// initDTLSCertificate generates the self-signed certificate used for all DTLS handshakes
+func initDTLSCertificate() error {
+	dtlsCertOnce.Do(func() {
+		dtlsCert, dtlsCertErr = selfsign.GenerateSelfSigned()
+		if dtlsCertErr == nil {
+			dtlsCertFP = certFingerprint("sha-256", dtlsCert.Certificate[0])
+		}
+	})
+	return dtlsCertErr
+}
+
+func formatFingerprint(sum []byte) string {
+	var sb strings.Builder
+	for i, b := range sum {
+		if i > 0 {
+			sb.WriteByte(':')
+		}
+		sb.WriteString(fmt.Sprintf("%02X", b))
+	}
+	return sb.String()
+}
+
+func certFingerprint(hash string, der []byte) string {
+	switch hash {
+	case "sha-1":
+		sum := sha1.Sum(der)
+		return formatFingerprint(sum[:])
+	case "sha-384":
+		sum := sha512.Sum384(der)
+		return formatFingerprint(sum[:])
+	case "sha-512":
+		sum := sha512.Sum512(der)
+		return formatFingerprint(sum[:])
+	default:
+		sum := sha256.Sum256(der)
+		return formatFingerprint(sum[:])
+	}
+}
+
+// offeredWebRTC returns the ICE and DTLS parameters of a UDP/TLS/RTP/SAVPF offer, nil if unusable
+func offeredWebRTC(ses *sdp.Session, media *sdp.Media) *webRTCMedia {
+	get := func(name string) string {
+		if v := media.Attributes.Get(name); v != "" {
+			return v
+		}
+		return ses.Attributes.Get(name)
+	}
+	ufrag, pwd := get(sdp.ICEUfrag), get(sdp.ICEPwd)
+	hash, fp, _ := strings.Cut(get(sdp.Fingerprint), " ")
+	hash = ASCIIToLower(hash)
+	if ufrag == "" || pwd == "" || fp == "" || !media.Attributes.Has(sdp.RTCPMux) {
+		return nil
+	}
+	if _, ok := fingerprintHashes[hash]; !ok {
+		return nil
+	}
+	wm := &webRTCMedia{remoteUfrag: ufrag, fpHash: hash, fingerprint: strings.ToUpper(strings.TrimSpace(fp))}
+	switch get(sdp.Setup) {
+	case setupPassive, setupActPass: // the answerer takes the active role when offered the choice (RFC 5763 5)
+		wm.isClient = true
+	case setupActive, "":
+		wm.isClient = false
+	default:
+		return nil
+	}
+	return wm
+}
+
+// setupWebRTC keeps the current ICE/DTLS association if the remote did not change it (re-INVITE), otherwise starts a new one
+func (ss *SipSession) setupWebRTC(offer *webRTCMedia) error {
+	if offer == nil {
+		if ss.webrtc != nil {
+			ss.webrtc.close()
+			ss.webrtc = nil
+			ss.srtpTx.Store(nil)
+			ss.srtpRx.Store(nil)
+		}
+		return nil
+	}
+	if cur := ss.webrtc; cur != nil && cur.remoteUfrag == offer.remoteUfrag && cur.fingerprint == offer.fingerprint && cur.isClient == offer.isClient {
+		return nil
+	}
+	if err := initDTLSCertificate(); err != nil {
+		return err
+	}
+	var err error
+	if offer.localUfrag, offer.localPwd, err = ice.NewCredentials(); err != nil {
+		return err
+	}
+	if ss.webrtc != nil {
+		ss.webrtc.close()
+	}
+	ss.srtpTx.Store(nil)
+	ss.srtpRx.Store(nil)
+	ss.srtpSuite, ss.srtpLocalKey, ss.srtpRemoteKey = "", "", ""
+	ss.webrtc = offer
+	return nil
+}
+
+// webRTCAttributes returns the media attributes of the answer
+func (wm *webRTCMedia) webRTCAttributes(media *sdp.Media, ip net.IP, port int) []*sdp.Attr {
+	setup := setupPassive
+	if wm.isClient {
+		setup = setupActive
+	}
+	attrs := []*sdp.Attr{
+		sdp.NewAttr(sdp.ICEUfrag, wm.localUfrag),
+		sdp.NewAttr(sdp.ICEPwd, wm.localPwd),
+		sdp.NewAttr(sdp.Fingerprint, "sha-256 "+dtlsCertFP),
+		sdp.NewAttr(sdp.Setup, setup),
+		sdp.NewAttr(sdp.Candidate, fmt.Sprintf("1 1 udp 2130706431 %s %d typ host", ip, port)),
+		sdp.NewAttrFlag(sdp.EndOfCandidates),
+	}
+	if mid := media.Attributes.Get(sdp.MID); mid != "" {
+		attrs = append(attrs, sdp.NewAttr(sdp.MID, mid))
+	}
+	return attrs
+}
+
+// processSTUN answers the connectivity checks of the remote full ICE agent and latches the media destination onto the checked address
+func (ss *SipSession) processSTUN(wm *webRTCMedia, pkt []byte, addr *net.UDPAddr) {
+	req, err := ice.ParseBindingRequest(pkt, wm.localUfrag, wm.localPwd)
+	if err != nil {
+		return
+	}
+	if _, err := ss.MediaListener.WriteToUDP(ice.BindingSuccess(req.TransactionID, addr, wm.localPwd), addr); err != nil {
+		return
+	}
+	if req.UseCandidate || !AreUAddrsEqual(ss.RemoteMedia, addr) && !wm.isConnected() {
+		ss.RemoteMedia = addr
+		ss.RemoteRTCP = addr
+	}
+	wm.start(ss)
+}
+
+func (wm *webRTCMedia) isConnected() bool {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	return wm.connected
+}
+
+// processDTLS passes a DTLS record received on the media socket to the handshake
+func (wm *webRTCMedia) processDTLS(pkt []byte, addr *net.UDPAddr) {
+	wm.mu.Lock()
+	conn := wm.conn
+	wm.mu.Unlock()
+	if conn != nil {
+		conn.push(pkt, addr)
+	}
+}
+
+// start runs the DTLS handshake once ICE connectivity is checked, as server unless a=setup:active is to be played
+func (wm *webRTCMedia) start(ss *SipSession) {
+	wm.mu.Lock()
+	if wm.started {
+		wm.mu.Unlock()
+		return
+	}
+	wm.started = true
+	wm.conn = newMediaPacketConn(ss.MediaListener, func() *net.UDPAddr { return ss.RemoteMedia })
+	wm.mu.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				LogCallStack(r)
+			}
+		}()
+		if err := wm.handshake(ss); err != nil {
+			LogWarning(LTMediaStack, fmt.Sprintf("Call-ID [%s] - DTLS handshake failed: %v", ss.CallID, err))
+			ss.ReleaseMe("DTLS handshake failed")
+		}
+	}()
+}
+
+func (wm *webRTCMedia) handshake(ss *SipSession) error {
+	verify := func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 || certFingerprint(wm.fpHash, rawCerts[0]) != wm.fingerprint {
+			return errFingerprint
+		}
+		return nil
+	}
+	opts := []dtls.Option{
+		dtls.WithCertificates(dtlsCert),
+		dtls.WithSRTPProtectionProfiles(dtls.SRTP_AES128_CM_HMAC_SHA1_80, dtls.SRTP_AES128_CM_HMAC_SHA1_32),
+		dtls.WithExtendedMasterSecret(dtls.RequireExtendedMasterSecret),
+		dtls.WithInsecureSkipVerify(true),
+		dtls.WithVerifyPeerCertificate(verify),
+	}
+
+	var conn *dtls.Conn
+	var err error
+	raddr := ss.RemoteMedia
+	if wm.isClient {
+		copts := make([]dtls.ClientOption, 0, len(opts))
+		for _, o := range opts {
+			copts = append(copts, o)
+		}
+		conn, err = dtls.ClientWithOptions(wm.conn, raddr, copts...)
+	} else {
+		sopts := []dtls.ServerOption{dtls.WithClientAuth(dtls.RequireAnyClientCert)}
+		for _, o := range opts {
+			sopts = append(sopts, o)
+		}
+		conn, err = dtls.ServerWithOptions(wm.conn, raddr, sopts...)
+	}
+	if err != nil {
+		return err
+	}
+	wm.mu.Lock()
+	wm.dtlsConn = conn
+	wm.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+
+	profile, ok := conn.SelectedSRTPProtectionProfile()
+	if !ok {
+		return errors.New("no SRTP protection profile negotiated")
+	}
+	var suite string
+	switch profile {
+	case dtls.SRTP_AES128_CM_HMAC_SHA1_80:
+		suite = srtp.AES_CM_128_HMAC_SHA1_80
+	case dtls.SRTP_AES128_CM_HMAC_SHA1_32:
+		suite = srtp.AES_CM_128_HMAC_SHA1_32
+	default:
+		return fmt.Errorf("unsupported SRTP protection profile %v", profile)
+	}
+	state, ok := conn.ConnectionState()
+	if !ok {
+		return errors.New("no DTLS connection state")
+	}
+	const keyLen, saltLen = srtp.MasterKeyLen, srtp.MasterSaltLen
+	km, err := state.ExportKeyingMaterial(dtlsSRTPLabel, nil, 2*(keyLen+saltLen))
+	if err != nil {
+		return err
+	}
+	// client key | server key | client salt | server salt
+	clientKS := append(append([]byte{}, km[:keyLen]...), km[2*keyLen:2*keyLen+saltLen]...)
+	serverKS := append(append([]byte{}, km[keyLen:2*keyLen]...), km[2*keyLen+saltLen:]...)
+	localKS, remoteKS := serverKS, clientKS
+	if wm.isClient {
+		localKS, remoteKS = clientKS, serverKS
+	}
+	tx, err := srtp.NewContext(suite, localKS)
+	if err != nil {
+		return err
+	}
+	rx, err := srtp.NewContext(suite, remoteKS)
+	if err != nil {
+		return err
+	}
+
+	// published under wm.mu, so that contexts of an association closed meanwhile never replace those reset by the close
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.closed {
+		return nil
+	}
+	wm.connected = true
+	ss.srtpRx.Store(rx)
+	ss.srtpTx.Store(tx)
+	LogInfo(LTMediaStack, fmt.Sprintf("Call-ID [%s] - DTLS-SRTP established (%s)", ss.CallID, suite))
+	return nil
+}
+
+func (wm *webRTCMedia) close() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	wm.closed = true
+	if wm.dtlsConn != nil {
+		_ = wm.dtlsConn.Close()
+		wm.dtlsConn = nil
+	}
+	if wm.conn != nil {
+		_ = wm.conn.Close()
+		wm.conn = nil
+	}
+}
+
+// =========================================================================================================================
+// mediaPacketConn feeds the DTLS records demultiplexed by mediaReceiver to the DTLS stack and writes its records
+// on the media socket
+
+type mediaPacketConn struct {
+	socket *net.UDPConn
+	remote func() *net.UDPAddr // the ICE latched address, which may change after the handshake started
+	in     chan mediaDatagram
+	done   chan struct{}
+	once   sync.Once
+}
+
+type mediaDatagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+func newMediaPacketConn(socket *net.UDPConn, remote func() *net.UDPAddr) *mediaPacketConn {
+	return &mediaPacketConn{socket: socket, remote: remote, in: make(chan mediaDatagram, dtlsQueueSize), done: make(chan struct{})}
+}
+
+func (mpc *mediaPacketConn) push(pkt []byte, addr *net.UDPAddr) {
+	select {
+	case mpc.in <- mediaDatagram{data: append([]byte(nil), pkt...), addr: addr}:
+	case <-mpc.done:
+	default: // queue full, DTLS retransmits
+	}
+}
+
+func (mpc *mediaPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case dg := <-mpc.in:
+		return copy(p, dg.data), dg.addr, nil
+	case <-mpc.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (mpc *mediaPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return mpc.socket.WriteToUDP(p, mpc.remote())
+}
+
+func (mpc *mediaPacketConn) Close() error {
+	mpc.once.Do(func() { close(mpc.done) })
+	return nil
+}
+
+func (mpc *mediaPacketConn) LocalAddr() net.Addr { return mpc.socket.LocalAddr() }
+
+func (mpc *mediaPacketConn) SetDeadline(t time.Time) error { return nil }
+
+func (mpc *mediaPacketConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (mpc *mediaPacketConn) SetWriteDeadline(t time.Time) error { return nil }
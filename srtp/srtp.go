@@ -0,0 +1,333 @@
+// Package srtp implements SRTP/SRTCP (RFC 3711) with the AES_CM_128_HMAC_SHA1_80/32 crypto suites (RFC 4568)
+package srtp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"sync"
+)
+
+const (
+	AES_CM_128_HMAC_SHA1_80 = "AES_CM_128_HMAC_SHA1_80"
+	AES_CM_128_HMAC_SHA1_32 = "AES_CM_128_HMAC_SHA1_32"
+
+	MasterKeyLen  = 16
+	MasterSaltLen = 14
+
+	authKeyLen     = 20
+	rtcpTagLen     = 10 // SRTCP is always authenticated with 80 bits (RFC 4568 6.2)
+	rtcpIndexLen   = 4
+	rtcpHeaderLen  = 8
+	rtpHeaderLen   = 12
+	replayWindow   = 64
+	maxSRTCPIndex  = 0x7FFFFFFF
+	srtcpEncrypted = 0x80000000
+)
+
+// key derivation labels (RFC 3711 4.3.1)
+const (
+	labelRTPEncryption byte = iota
+	labelRTPAuth
+	labelRTPSalt
+	labelRTCPEncryption
+	labelRTCPAuth
+	labelRTCPSalt
+)
+
+var (
+	errSuite    = errors.New("unsupported SRTP crypto suite")
+	errKeyLen   = errors.New("invalid SRTP master key length")
+	errShort    = errors.New("SRTP packet too short")
+	errAuth     = errors.New("SRTP authentication failed")
+	errReplay   = errors.New("SRTP replayed packet")
+	errExhaust  = errors.New("SRTCP index exhausted")
+	errRTPHdr   = errors.New("malformed RTP header")
+	errRTCPHdr  = errors.New("malformed RTCP header")
+	tagLengths  = map[string]int{AES_CM_128_HMAC_SHA1_80: 10, AES_CM_128_HMAC_SHA1_32: 4}
+	suiteOrders = []string{AES_CM_128_HMAC_SHA1_80, AES_CM_128_HMAC_SHA1_32}
+)
+
+// Suites returns the supported crypto suites in order of preference
+func Suites() []string {
+	return suiteOrders
+}
+
+func IsSupported(suite string) bool {
+	_, ok := tagLengths[suite]
+	return ok
+}
+
+// Context holds the session keys and the cryptographic state of one direction of an SRTP stream
+type Context struct {
+	mu     sync.Mutex
+	tagLen int
+
+	rtpBlock  cipher.Block
+	rtpSalt   []byte
+	rtpMac    hash.Hash
+	rtcpBlock cipher.Block
+	rtcpSalt  []byte
+	rtcpMac   hash.Hash
+
+	// RTP sequence tracking: sending side extends the sequence number, receiving side estimates it (RFC 3711 3.3.1)
+	started bool
+	roc     uint32
+	lastSeq uint16
+	replay  replayState
+
+	srtcpIndex  uint32
+	rtcpStarted bool
+	rtcpReplay  replayState
+}
+
+type replayState struct {
+	highest uint64
+	bitmap  uint64
+}
+
+// NewContext derives the session keys from the concatenated master key and master salt
+func NewContext(suite string, masterKeySalt []byte) (*Context, error) {
+	tagLen, ok := tagLengths[suite]
+	if !ok {
+		return nil, errSuite
+	}
+	if len(masterKeySalt) != MasterKeyLen+MasterSaltLen {
+		return nil, errKeyLen
+	}
+	master, err := aes.NewCipher(masterKeySalt[:MasterKeyLen])
+	if err != nil {
+		return nil, err
+	}
+	salt := masterKeySalt[MasterKeyLen:]
+
+	ctx := &Context{tagLen: tagLen}
+	if ctx.rtpBlock, err = aes.NewCipher(deriveKey(master, salt, labelRTPEncryption, MasterKeyLen)); err != nil {
+		return nil, err
+	}
+	ctx.rtpSalt = deriveKey(master, salt, labelRTPSalt, MasterSaltLen)
+	ctx.rtpMac = hmac.New(sha1.New, deriveKey(master, salt, labelRTPAuth, authKeyLen))
+	if ctx.rtcpBlock, err = aes.NewCipher(deriveKey(master, salt, labelRTCPEncryption, MasterKeyLen)); err != nil {
+		return nil, err
+	}
+	ctx.rtcpSalt = deriveKey(master, salt, labelRTCPSalt, MasterSaltLen)
+	ctx.rtcpMac = hmac.New(sha1.New, deriveKey(master, salt, labelRTCPAuth, authKeyLen))
+	return ctx, nil
+}
+
+// deriveKey runs the AES-CM PRF keyed with the master key, with a key derivation rate of 0
+func deriveKey(master cipher.Block, salt []byte, label byte, size int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	iv[7] ^= label
+	out := make([]byte, size)
+	cipher.NewCTR(master, iv).XORKeyStream(out, out)
+	return out
+}
+
+// counter builds the AES-CM IV: (salt * 2^16) XOR (SSRC * 2^64) XOR (index * 2^16)
+func counter(salt []byte, ssrc uint32, index uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], ssrc)
+	for i := range 4 {
+		iv[4+i] ^= v[i]
+	}
+	for i := range 6 {
+		iv[13-i] ^= byte(index >> (8 * i))
+	}
+	return iv
+}
+
+func rtpHeaderSize(pkt []byte) (int, error) {
+	if len(pkt) < rtpHeaderLen || pkt[0]>>6 != 2 {
+		return 0, errRTPHdr
+	}
+	size := rtpHeaderLen + 4*int(pkt[0]&0x0F)
+	if pkt[0]&0x10 != 0 {
+		if len(pkt) < size+4 {
+			return 0, errRTPHdr
+		}
+		size += 4 + 4*int(binary.BigEndian.Uint16(pkt[size+2:size+4]))
+	}
+	if len(pkt) < size {
+		return 0, errRTPHdr
+	}
+	return size, nil
+}
+
+// ProtectRTP encrypts the RTP packet in place and appends the authentication tag
+func (ctx *Context) ProtectRTP(pkt []byte) ([]byte, error) {
+	hdr, err := rtpHeaderSize(pkt)
+	if err != nil {
+		return nil, err
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	seq := binary.BigEndian.Uint16(pkt[2:4])
+	if ctx.started && seq < ctx.lastSeq && ctx.lastSeq-seq > 0x8000 {
+		ctx.roc++
+	}
+	ctx.started = true
+	ctx.lastSeq = seq
+
+	index := uint64(ctx.roc)<<16 | uint64(seq)
+	ssrc := binary.BigEndian.Uint32(pkt[8:12])
+	cipher.NewCTR(ctx.rtpBlock, counter(ctx.rtpSalt, ssrc, index)).XORKeyStream(pkt[hdr:], pkt[hdr:])
+	return append(pkt, ctx.rtpTag(pkt, ctx.roc)...), nil
+}
+
+// UnprotectRTP authenticates and decrypts the SRTP packet in place, returning the RTP packet
+func (ctx *Context) UnprotectRTP(pkt []byte) ([]byte, error) {
+	if len(pkt) < rtpHeaderLen+ctx.tagLen {
+		return nil, errShort
+	}
+	body := pkt[:len(pkt)-ctx.tagLen]
+	hdr, err := rtpHeaderSize(body)
+	if err != nil {
+		return nil, err
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	seq := binary.BigEndian.Uint16(pkt[2:4])
+	roc := ctx.estimateROC(seq)
+	index := uint64(roc)<<16 | uint64(seq)
+	if ctx.started && !ctx.replay.check(index) {
+		return nil, errReplay
+	}
+	if subtle.ConstantTimeCompare(ctx.rtpTag(body, roc), pkt[len(body):]) != 1 {
+		return nil, errAuth
+	}
+
+	switch {
+	case !ctx.started:
+		ctx.started = true
+		ctx.roc = roc
+		ctx.lastSeq = seq
+	case roc == ctx.roc && seq > ctx.lastSeq:
+		ctx.lastSeq = seq
+	case roc == ctx.roc+1:
+		ctx.roc = roc
+		ctx.lastSeq = seq
+	}
+	ctx.replay.accept(index)
+
+	ssrc := binary.BigEndian.Uint32(pkt[8:12])
+	cipher.NewCTR(ctx.rtpBlock, counter(ctx.rtpSalt, ssrc, index)).XORKeyStream(body[hdr:], body[hdr:])
+	return body, nil
+}
+
+// estimateROC guesses the rollover counter of a received sequence number (RFC 3711 Appendix A)
+func (ctx *Context) estimateROC(seq uint16) uint32 {
+	if !ctx.started {
+		return 0
+	}
+	if ctx.lastSeq < 0x8000 {
+		if int(seq)-int(ctx.lastSeq) > 0x8000 && ctx.roc > 0 {
+			return ctx.roc - 1
+		}
+		return ctx.roc
+	}
+	if int(ctx.lastSeq)-0x8000 > int(seq) {
+		return ctx.roc + 1
+	}
+	return ctx.roc
+}
+
+func (ctx *Context) rtpTag(authPortion []byte, roc uint32) []byte {
+	ctx.rtpMac.Reset()
+	ctx.rtpMac.Write(authPortion)
+	var r [4]byte
+	binary.BigEndian.PutUint32(r[:], roc)
+	ctx.rtpMac.Write(r[:])
+	return ctx.rtpMac.Sum(nil)[:ctx.tagLen]
+}
+
+// ProtectRTCP encrypts the compound RTCP packet in place and appends the SRTCP index and the authentication tag
+func (ctx *Context) ProtectRTCP(pkt []byte) ([]byte, error) {
+	if len(pkt) < rtcpHeaderLen {
+		return nil, errRTCPHdr
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.srtcpIndex > maxSRTCPIndex {
+		return nil, errExhaust
+	}
+	index := ctx.srtcpIndex
+	ctx.srtcpIndex++
+
+	ssrc := binary.BigEndian.Uint32(pkt[4:8])
+	cipher.NewCTR(ctx.rtcpBlock, counter(ctx.rtcpSalt, ssrc, uint64(index))).XORKeyStream(pkt[rtcpHeaderLen:], pkt[rtcpHeaderLen:])
+	pkt = binary.BigEndian.AppendUint32(pkt, srtcpEncrypted|index)
+	return append(pkt, ctx.rtcpTag(pkt)...), nil
+}
+
+// UnprotectRTCP authenticates and decrypts the SRTCP packet in place, returning the compound RTCP packet
+func (ctx *Context) UnprotectRTCP(pkt []byte) ([]byte, error) {
+	if len(pkt) < rtcpHeaderLen+rtcpIndexLen+rtcpTagLen {
+		return nil, errShort
+	}
+	authPortion := pkt[:len(pkt)-rtcpTagLen]
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if subtle.ConstantTimeCompare(ctx.rtcpTag(authPortion), pkt[len(authPortion):]) != 1 {
+		return nil, errAuth
+	}
+	eindex := binary.BigEndian.Uint32(authPortion[len(authPortion)-rtcpIndexLen:])
+	index := uint64(eindex & maxSRTCPIndex)
+	if ctx.rtcpStarted && !ctx.rtcpReplay.check(index) {
+		return nil, errReplay
+	}
+	ctx.rtcpStarted = true
+	ctx.rtcpReplay.accept(index)
+
+	body := authPortion[:len(authPortion)-rtcpIndexLen]
+	if eindex&srtcpEncrypted != 0 {
+		ssrc := binary.BigEndian.Uint32(body[4:8])
+		cipher.NewCTR(ctx.rtcpBlock, counter(ctx.rtcpSalt, ssrc, index)).XORKeyStream(body[rtcpHeaderLen:], body[rtcpHeaderLen:])
+	}
+	return body, nil
+}
+
+func (ctx *Context) rtcpTag(authPortion []byte) []byte {
+	ctx.rtcpMac.Reset()
+	ctx.rtcpMac.Write(authPortion)
+	return ctx.rtcpMac.Sum(nil)[:rtcpTagLen]
+}
+
+// check reports whether the index is neither too old nor already received
+func (rs *replayState) check(index uint64) bool {
+	if index > rs.highest {
+		return true
+	}
+	diff := rs.highest - index
+	if diff >= replayWindow {
+		return false
+	}
+	return rs.bitmap&(1<<diff) == 0
+}
+
+func (rs *replayState) accept(index uint64) {
+	if index > rs.highest {
+		shift := index - rs.highest
+		if shift >= replayWindow {
+			rs.bitmap = 0
+		} else {
+			rs.bitmap <<= shift
+		}
+		rs.bitmap |= 1
+		rs.highest = index
+		return
+	}
+	rs.bitmap |= 1 << (rs.highest - index)
+}
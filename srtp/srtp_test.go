@@ -0,0 +1,92 @@
+package srtp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestAESCMKeystream checks the counter and keystream against RFC 3711 Appendix B.2
+func TestAESCMKeystream(t *testing.T) {
+	block, err := aes.NewCipher(unhex(t, "2B7E151628AED2A6ABF7158809CF4F3C"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := counter(unhex(t, "F0F1F2F3F4F5F6F7F8F9FAFBFCFD"), 0, 0)
+	if want := unhex(t, "F0F1F2F3F4F5F6F7F8F9FAFBFCFD0000"); !bytes.Equal(iv, want) {
+		t.Fatalf("counter = %X, want %X", iv, want)
+	}
+	keystream := make([]byte, 3*aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(keystream, keystream)
+	want := unhex(t, "E03EAD0935C95E80E166B16DD92B4EB4"+"D23513162B02D0F72A43A2FE4A5F97AB"+"41E95B3BB0A2E8DD477901E4FCA894C0")
+	if !bytes.Equal(keystream, want) {
+		t.Errorf("keystream = %X, want %X", keystream, want)
+	}
+}
+
+// TestKeyDerivation checks the session keys against RFC 3711 Appendix B.3
+func TestKeyDerivation(t *testing.T) {
+	master, err := aes.NewCipher(unhex(t, "E1F97A0D3E018BE0D64FA32C06DE4139"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := unhex(t, "0EC675AD498AFEEBB6960B3AABE6")
+	for _, tc := range []struct {
+		name  string
+		label byte
+		size  int
+		want  string
+	}{
+		{"cipher key", labelRTPEncryption, MasterKeyLen, "C61E7A93744F39EE10734AFE3FF7A087"},
+		{"cipher salt", labelRTPSalt, MasterSaltLen, "30CBBC08863D8C85D49DB34A9AE1"},
+		{"auth key", labelRTPAuth, authKeyLen, "CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4"},
+	} {
+		if got := deriveKey(master, salt, tc.label, tc.size); !bytes.Equal(got, unhex(t, tc.want)) {
+			t.Errorf("%s = %X, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestProtectRoundTrip checks that a protected RTP and RTCP packet is accepted once by the peer context
+func TestProtectRoundTrip(t *testing.T) {
+	key := unhex(t, "E1F97A0D3E018BE0D64FA32C06DE41390EC675AD498AFEEBB6960B3AABE6")
+	for _, suite := range Suites() {
+		tx, err := NewContext(suite, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rx, _ := NewContext(suite, key)
+
+		rtp := append([]byte{0x80, 0x00, 0x12, 0x34, 0, 0, 0, 160, 0xCA, 0xFE, 0xBA, 0xBE}, bytes.Repeat([]byte{0xD5}, 160)...)
+		srtp, err := tx.ProtectRTP(append([]byte(nil), rtp...))
+		if err != nil {
+			t.Fatalf("%s: ProtectRTP: %v", suite, err)
+		}
+		if got, err := rx.UnprotectRTP(append([]byte(nil), srtp...)); err != nil || !bytes.Equal(got, rtp) {
+			t.Fatalf("%s: UnprotectRTP = %X, %v", suite, got, err)
+		}
+		if _, err := rx.UnprotectRTP(append([]byte(nil), srtp...)); err != errReplay {
+			t.Errorf("%s: replayed RTP: %v, want %v", suite, err, errReplay)
+		}
+
+		rtcp := []byte{0x80, 0xC9, 0x00, 0x01, 0xCA, 0xFE, 0xBA, 0xBE}
+		srtcp, err := tx.ProtectRTCP(append([]byte(nil), rtcp...))
+		if err != nil {
+			t.Fatalf("%s: ProtectRTCP: %v", suite, err)
+		}
+		if got, err := rx.UnprotectRTCP(append([]byte(nil), srtcp...)); err != nil || !bytes.Equal(got, rtcp) {
+			t.Fatalf("%s: UnprotectRTCP = %X, %v", suite, got, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package udpio queues the datagrams built during a pacer slot and sends them once the slot is processed, and reads
+// media sockets through reusable buffers. On Linux, consecutive datagrams of a same socket are sent with one sendmmsg
+// and pending ones read with one recvmmsg (golang.org/x/net/ipv4 batch APIs), other platforms use one system call per
+// datagram. With a socket per call and a packet per frame, a flush still costs one system call per stream: the
+// benefit is building all the frames of a slot before any send, not fewer system calls (see BenchmarkFlush).
+package udpio
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	BatchSize  = 8    // datagrams read at most per system call
+	BufferSize = 1500 // bytes per datagram buffer
+)
+
+type entry struct {
+	conn *Conn
+	addr *net.UDPAddr
+	pkt  []byte
+}
+
+// Batch collects datagrams and sends them on Flush, consecutive ones of a same socket with one system call.
+// It is not safe for concurrent use.
+type Batch struct {
+	entries []entry
+	bufs    [][]byte
+	batchState
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Buffer returns an empty buffer of BufferSize capacity to build the next datagram in, valid until Flush
+func (b *Batch) Buffer() []byte {
+	i := len(b.entries)
+	if i == len(b.bufs) {
+		b.bufs = append(b.bufs, make([]byte, 0, BufferSize))
+	}
+	return b.bufs[i][:0]
+}
+
+// Add queues the datagram, built in the last returned Buffer, to be sent to addr from conn
+func (b *Batch) Add(conn *Conn, pkt []byte, addr *net.UDPAddr) {
+	b.bufs[len(b.entries)] = pkt[:0]
+	b.entries = append(b.entries, entry{conn: conn, addr: addr, pkt: pkt})
+}
+
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Flush sends the queued datagrams, those of a socket failing are dropped and the first error is returned
+func (b *Batch) Flush() error {
+	var first error
+	for start := 0; start < len(b.entries); {
+		end := start + 1
+		for end < len(b.entries) && b.entries[end].conn == b.entries[start].conn {
+			end++
+		}
+		if err := b.send(b.entries[start:end]); err != nil && first == nil {
+			first = err
+		}
+		start = end
+	}
+	clear(b.entries)
+	b.entries = b.entries[:0]
+	return first
+}
+
+// IsClosed tells whether the error comes from a socket released meanwhile
+func IsClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
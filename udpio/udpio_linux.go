@@ -0,0 +1,79 @@
+//go:build linux
+
+package udpio
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Conn is a media socket with its batch capable counterpart
+type Conn struct {
+	*net.UDPConn
+	pc *ipv4.PacketConn
+}
+
+func NewConn(c *net.UDPConn) *Conn {
+	return &Conn{UDPConn: c, pc: ipv4.NewPacketConn(c)}
+}
+
+type batchState struct {
+	msgs []ipv4.Message
+}
+
+// send writes datagrams of a same socket with sendmmsg
+func (b *Batch) send(entries []entry) error {
+	for len(b.msgs) < len(entries) {
+		b.msgs = append(b.msgs, ipv4.Message{Buffers: make([][]byte, 1)})
+	}
+	msgs := b.msgs[:len(entries)]
+	for i, e := range entries {
+		msgs[i].Buffers[0] = e.pkt
+		msgs[i].Addr = e.addr
+	}
+	conn := entries[0].conn
+	var err error
+	for sent := 0; sent < len(msgs); {
+		var n int
+		if n, err = conn.pc.WriteBatch(msgs[sent:], 0); err != nil {
+			break
+		}
+		sent += n
+	}
+	for i := range msgs {
+		msgs[i].Buffers[0], msgs[i].Addr = nil, nil
+	}
+	return err
+}
+
+// Reader reads datagrams from a socket, up to BatchSize per recvmmsg
+type Reader struct {
+	pc   *ipv4.PacketConn
+	msgs []ipv4.Message
+	n    int
+	next int
+}
+
+func NewReader(c *Conn) *Reader {
+	r := &Reader{pc: c.pc, msgs: make([]ipv4.Message, BatchSize)}
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{make([]byte, BufferSize)}
+	}
+	return r
+}
+
+// Read returns the next datagram - the returned bytes are only valid until the next call
+func (r *Reader) Read() ([]byte, *net.UDPAddr, error) {
+	for r.next == r.n {
+		n, err := r.pc.ReadBatch(r.msgs, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.n, r.next = n, 0
+	}
+	msg := &r.msgs[r.next]
+	r.next++
+	addr, _ := msg.Addr.(*net.UDPAddr)
+	return msg.Buffers[0][:msg.N], addr, nil
+}
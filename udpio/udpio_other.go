@@ -0,0 +1,45 @@
+//go:build !linux
+
+package udpio
+
+import "net"
+
+// Conn is a media socket
+type Conn struct {
+	*net.UDPConn
+}
+
+func NewConn(c *net.UDPConn) *Conn {
+	return &Conn{UDPConn: c}
+}
+
+type batchState struct{}
+
+// send writes datagrams of a same socket one by one
+func (b *Batch) send(entries []entry) error {
+	for _, e := range entries {
+		if _, err := e.conn.WriteToUDP(e.pkt, e.addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader reads datagrams from a socket, one per system call
+type Reader struct {
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func NewReader(c *Conn) *Reader {
+	return &Reader{conn: c.UDPConn, buf: make([]byte, BufferSize)}
+}
+
+// Read returns the next datagram - the returned bytes are only valid until the next call
+func (r *Reader) Read() ([]byte, *net.UDPAddr, error) {
+	n, addr, err := r.conn.ReadFromUDP(r.buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.buf[:n], addr, nil
+}
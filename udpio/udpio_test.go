@@ -0,0 +1,131 @@
+package udpio
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func listen(tb testing.TB) *net.UDPConn {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c
+}
+
+type datagram struct {
+	pkt []byte
+	src *net.UDPAddr
+}
+
+// receive reads count datagrams from each sink and checks them against the ones sent to it, in order
+func receive(t *testing.T, sinks []*net.UDPConn, sent [][]datagram) {
+	t.Helper()
+	for i, sink := range sinks {
+		_ = sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+		r := NewReader(NewConn(sink))
+		for k, want := range sent[i] {
+			pkt, src, err := r.Read()
+			if err != nil {
+				t.Fatalf("sink %d: datagram %d of %d: %v", i, k, len(sent[i]), err)
+			}
+			if !bytes.Equal(pkt, want.pkt) || src.String() != want.src.String() {
+				t.Fatalf("sink %d: datagram %d = %q from %s, want %q from %s", i, k, pkt, src, want.pkt, want.src)
+			}
+		}
+	}
+}
+
+// TestBatchLoopback sends runs of datagrams of several sockets to several sinks, the last run being larger than one
+// sendmmsg (UIO_MAXIOV, 1024 messages) so that it is sent in parts, and each sink reading more than one recvmmsg
+func TestBatchLoopback(t *testing.T) {
+	senders := []*Conn{NewConn(listen(t)), NewConn(listen(t)), NewConn(listen(t))}
+	sinks := make([]*net.UDPConn, 8)
+	for i := range sinks {
+		sinks[i] = listen(t)
+	}
+	sent := make([][]datagram, len(sinks))
+	batch := NewBatch()
+	k := 0
+	for _, run := range []struct{ sender, count int }{{0, 3}, {1, 1}, {2, 5}, {0, 2}, {1, 1100}} {
+		conn := senders[run.sender]
+		for range run.count {
+			pkt := fmt.Appendf(batch.Buffer(), "%d:%d", run.sender, k)
+			sink := k % len(sinks)
+			batch.Add(conn, pkt, sinks[sink].LocalAddr().(*net.UDPAddr))
+			sent[sink] = append(sent[sink], datagram{bytes.Clone(pkt), conn.LocalAddr().(*net.UDPAddr)})
+			k++
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Len() != 0 {
+		t.Fatalf("Len after Flush = %d, want 0", batch.Len())
+	}
+	receive(t, sinks, sent)
+}
+
+// TestFlushClosedSocket checks that the datagrams of a closed socket are dropped with its error, the others being sent
+func TestFlushClosedSocket(t *testing.T) {
+	sink := listen(t)
+	dst := sink.LocalAddr().(*net.UDPAddr)
+	senders := []*Conn{NewConn(listen(t)), NewConn(listen(t)), NewConn(listen(t))}
+	senders[1].Close()
+	var sent []datagram
+	batch := NewBatch()
+	for i, conn := range senders {
+		pkt := fmt.Appendf(batch.Buffer(), "socket %d", i)
+		batch.Add(conn, pkt, dst)
+		if i != 1 {
+			sent = append(sent, datagram{bytes.Clone(pkt), conn.LocalAddr().(*net.UDPAddr)})
+		}
+	}
+	if err := batch.Flush(); !IsClosed(err) {
+		t.Fatalf("Flush = %v, want %v", err, net.ErrClosed)
+	}
+	receive(t, []*net.UDPConn{sink}, [][]datagram{sent})
+}
+
+// BenchmarkFlush measures the cost per datagram of a flush, for sockets sending each one datagram per flush (the
+// RTP layout, a socket per call and a packet per frame) and for a socket sending several; ns/op is per datagram
+func BenchmarkFlush(b *testing.B) {
+	for _, tc := range []struct{ sockets, datagrams int }{{8, 1}, {1, 8}} {
+		b.Run(fmt.Sprintf("sockets=%d/datagrams=%d", tc.sockets, tc.datagrams), func(b *testing.B) {
+			sink := listen(b)
+			dst := sink.LocalAddr().(*net.UDPAddr)
+			conns := make([]*Conn, tc.sockets)
+			for i := range conns {
+				conns[i] = NewConn(listen(b))
+			}
+			batch := NewBatch()
+			for i := 0; b.Loop(); i++ {
+				if i%(tc.sockets*tc.datagrams) == 0 && batch.Len() != 0 {
+					if err := batch.Flush(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				buf := batch.Buffer()
+				batch.Add(conns[i/tc.datagrams%tc.sockets], append(buf, make([]byte, 172)...), dst)
+			}
+			_ = batch.Flush()
+		})
+	}
+}
+
+// BenchmarkWriteToUDP is the unbatched reference of BenchmarkFlush
+func BenchmarkWriteToUDP(b *testing.B) {
+	sink := listen(b)
+	dst := sink.LocalAddr().(*net.UDPAddr)
+	conn := listen(b)
+	pkt := make([]byte, 172)
+	for b.Loop() {
+		if _, err := conn.WriteToUDP(pkt, dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package webserver
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
 	. "mrfgo/global"
+	"mrfgo/rtp"
 	"mrfgo/sip"
 	"net"
 	"net/http"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -19,6 +22,19 @@ func StartWS(ip net.IP) {
 
 	r.HandleFunc("GET /api/v1/session", serveSession)
 	r.HandleFunc("GET /api/v1/stats", serveStats)
+	r.HandleFunc("GET /api/v1/registrations", serveRegistrations)
+	r.HandleFunc("GET /api/v1/records", serveCallRecords)
+	r.HandleFunc("POST /api/v1/calls", requireToken(serveOriginate))
+	r.HandleFunc("GET /api/v1/calls/{callid}", requireToken(serveCallStatus))
+	r.HandleFunc("DELETE /api/v1/calls/{callid}", requireToken(serveHangup))
+	r.HandleFunc("POST /api/v1/campaigns", requireToken(serveNewCampaign))
+	r.HandleFunc("GET /api/v1/campaigns", requireToken(serveCampaigns))
+	r.HandleFunc("GET /api/v1/campaigns/{id}", requireToken(serveCampaign))
+	r.HandleFunc("GET /api/v1/campaigns/{id}/csv", requireToken(serveCampaignCSV))
+	r.HandleFunc("POST /api/v1/campaigns/{id}/{action}", requireToken(serveCampaignAction))
+	r.HandleFunc("DELETE /api/v1/campaigns/{id}", requireToken(serveDeleteCampaign))
+	r.HandleFunc("GET /api/v1/bans", requireToken(serveBans))
+	r.HandleFunc("DELETE /api/v1/bans/{source}", requireToken(serveUnban))
 	r.Handle("GET /metrics", Prometrics.Handler())
 	r.HandleFunc("GET /", serveHome)
 
@@ -32,6 +48,28 @@ func StartWS(ip net.IP) {
 	fmt.Println("Success: HTTP", ws)
 
 	fmt.Printf("Prometheus metrics available at http://%s/metrics\n", ws)
+	if APIToken == "" {
+		fmt.Println("No API token: calls, campaigns and bans management disabled")
+	}
+}
+
+// requireToken guards the API management endpoints: they need "Authorization: Bearer <APIToken>", and are refused
+// when no token is configured
+func requireToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if APIToken == "" {
+			writeJSON(w, http.StatusForbidden, struct{ Error string }{"API token not configured"})
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(APIToken)) != 1 {
+			LogWarning(LTWebserver, fmt.Sprintf("%s %s from %s refused - invalid API token", r.Method, r.URL.Path, r.RemoteAddr))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mrfgo"`)
+			writeJSON(w, http.StatusUnauthorized, struct{ Error string }{"Invalid API token"})
+			return
+		}
+		h(w, r)
+	}
 }
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
@@ -42,13 +80,18 @@ func serveSession(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var lst []string
+	stats := make(map[string]rtp.StatsReport)
 	for _, ses := range sip.Sessions.Range() {
 		lst = append(lst, ses.String())
+		if ses.LocalSDP != nil {
+			stats[ses.CallID] = ses.MediaStats()
+		}
 	}
 
 	data := struct {
-		Sessions []string
-	}{Sessions: lst}
+		Sessions   []string
+		MediaStats map[string]rtp.StatsReport
+	}{Sessions: lst, MediaStats: stats}
 
 	response, _ := json.Marshal(data)
 	_, err := w.Write(response)
@@ -57,6 +100,18 @@ func serveSession(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func serveCallRecords(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sip.CallRecords())
+}
+
+func serveRegistrations(w http.ResponseWriter, r *http.Request) {
+	lst := make([]sip.RegistrationStatus, 0, len(sip.Registrations))
+	for _, reg := range sip.Registrations {
+		lst = append(lst, reg.Status())
+	}
+	writeJSON(w, http.StatusOK, lst)
+}
+
 func serveStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -0,0 +1,19 @@
+package webserver
+
+import (
+	"mrfgo/sip"
+	"net/http"
+)
+
+// serveBans lists the sources banned by the scanner protection
+func serveBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sip.Bans())
+}
+
+func serveUnban(w http.ResponseWriter, r *http.Request) {
+	if !sip.Unban(r.PathValue("source")) {
+		writeJSON(w, http.StatusNotFound, struct{ Error string }{"Source not banned"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
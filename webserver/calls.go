@@ -0,0 +1,55 @@
+package webserver
+
+import (
+	"encoding/json"
+	. "mrfgo/global"
+	"mrfgo/sip"
+	"net/http"
+)
+
+// serveOriginate starts an outbound call from a JSON sip.OriginationRequest
+func serveOriginate(w http.ResponseWriter, r *http.Request) {
+	var req sip.OriginationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, struct{ Error string }{err.Error()})
+		return
+	}
+	oc, err := sip.Originate(req, nil)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, struct{ Error string }{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, oc.Status())
+}
+
+func serveCallStatus(w http.ResponseWriter, r *http.Request) {
+	oc, ok := sip.GetOrigination(r.PathValue("callid"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, struct{ Error string }{"Call not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, oc.Status())
+}
+
+// serveHangup cancels or releases an outbound call
+func serveHangup(w http.ResponseWriter, r *http.Request) {
+	oc, ok := sip.GetOrigination(r.PathValue("callid"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, struct{ Error string }{"Call not found"})
+		return
+	}
+	if !oc.Hangup() {
+		writeJSON(w, http.StatusConflict, struct{ Error string }{"Call already ended"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, oc.Status())
+}
+
+func writeJSON(w http.ResponseWriter, code int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	response, _ := json.Marshal(data)
+	if _, err := w.Write(response); err != nil {
+		LogError(LTWebserver, err.Error())
+	}
+}
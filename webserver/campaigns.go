@@ -0,0 +1,89 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"mrfgo/campaign"
+	. "mrfgo/global"
+	"net/http"
+)
+
+// serveNewCampaign starts a campaign from a JSON campaign.Request
+func serveNewCampaign(w http.ResponseWriter, r *http.Request) {
+	var req campaign.Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<20)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, struct{ Error string }{err.Error()})
+		return
+	}
+	c, err := campaign.New(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, struct{ Error string }{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, c.Progress())
+}
+
+func serveCampaigns(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, campaign.List())
+}
+
+func serveCampaign(w http.ResponseWriter, r *http.Request) {
+	c, ok := campaign.Get(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, struct{ Error string }{"Campaign not found"})
+		return
+	}
+	data := struct {
+		campaign.Progress
+		Results []campaign.Result
+	}{Progress: c.Progress(), Results: c.Results()}
+	writeJSON(w, http.StatusOK, data)
+}
+
+func serveCampaignCSV(w http.ResponseWriter, r *http.Request) {
+	c, ok := campaign.Get(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, struct{ Error string }{"Campaign not found"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="campaign-%s.csv"`, c.ID))
+	if err := c.WriteCSV(w); err != nil {
+		LogError(LTWebserver, err.Error())
+	}
+}
+
+// serveCampaignAction pauses, resumes or stops a campaign
+func serveCampaignAction(w http.ResponseWriter, r *http.Request) {
+	c, ok := campaign.Get(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, struct{ Error string }{"Campaign not found"})
+		return
+	}
+	var done bool
+	switch action := r.PathValue("action"); action {
+	case "pause":
+		done = c.Pause()
+	case "resume":
+		done = c.Resume()
+	case "stop":
+		done = c.Stop()
+	default:
+		writeJSON(w, http.StatusNotFound, struct{ Error string }{fmt.Sprintf("Unknown action [%s]", action)})
+		return
+	}
+	if !done {
+		writeJSON(w, http.StatusConflict, struct{ Error string }{fmt.Sprintf("Campaign is %s", c.Progress().State)})
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Progress())
+}
+
+// serveDeleteCampaign stops a campaign and discards its results
+func serveDeleteCampaign(w http.ResponseWriter, r *http.Request) {
+	if !campaign.Delete(r.PathValue("id")) {
+		writeJSON(w, http.StatusNotFound, struct{ Error string }{"Campaign not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}